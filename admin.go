@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdminDevice describes one configured or discovered device in the /admin/devices response
+type AdminDevice struct {
+	ID         string `json:"id"`
+	Name       string `json:"name,omitempty"`
+	Type       string `json:"type"`
+	Product    string `json:"product,omitempty"`
+	Location   string `json:"location"`
+	Connected  *bool  `json:"connected,omitempty"`
+	Firmware   string `json:"firmware,omitempty"`
+	Discovered bool   `json:"discovered"`
+	Configured bool   `json:"configured"`
+	Processed  bool   `json:"processed"`
+}
+
+// requireAdminToken wraps an admin handler so it only serves requests carrying the configured bearer token
+func requireAdminToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="flume-exporter-admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminDevicesHandler lists every discovered device plus any configured device IDs Flume did not return,
+// marking which ones pass the device filter. The device list comes from the client's cache when it is fresh
+func adminDevicesHandler(client *FlumeClient, exporter *FlumeExporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		devices, err := client.GetDevices()
+		if err != nil {
+			log.Printf("Admin devices: failed to get devices: %v", err)
+			w.WriteHeader(http.StatusBadGateway)
+			jsonData, _ := json.MarshalIndent(map[string]interface{}{
+				"error":       err.Error(),
+				"error_class": classifyError(err),
+			}, "", "  ")
+			w.Write(jsonData)
+			return
+		}
+
+		config := exporter.config.Load()
+		var configuredIDs []string
+		configured := make(map[string]bool)
+		for _, id := range strings.Split(config.DeviceIDs, ",") {
+			if id = strings.TrimSpace(id); id != "" && !configured[id] {
+				configuredIDs = append(configuredIDs, id)
+				configured[id] = true
+			}
+		}
+
+		result := make([]AdminDevice, 0, len(devices)+len(configuredIDs))
+		discovered := make(map[string]bool)
+		for _, device := range devices {
+			discovered[device.ID] = true
+			result = append(result, AdminDevice{
+				ID:         device.ID,
+				Name:       config.DeviceName(device),
+				Type:       device.TypeLabel(),
+				Product:    device.Product,
+				Location:   device.Location.Name,
+				Connected:  device.Connected,
+				Firmware:   device.FirmwareLabel(),
+				Discovered: true,
+				Configured: configured[device.ID],
+				Processed:  exporter.shouldProcessDevice(device.ID),
+			})
+		}
+
+		// Configured IDs that Flume did not return are usually typos in --device-ids
+		for _, id := range configuredIDs {
+			if !discovered[id] {
+				result = append(result, AdminDevice{
+					ID:         id,
+					Type:       "unknown",
+					Configured: true,
+				})
+			}
+		}
+
+		jsonData, _ := json.MarshalIndent(map[string]interface{}{
+			"timestamp":        time.Now().Format(time.RFC3339),
+			"device_filtering": config.DeviceIDs != "",
+			"devices":          result,
+		}, "", "  ")
+		w.Write(jsonData)
+	}
+}
+
+// adminUsageHandler returns a device's total usage for a single past day, queried in the DAY bucket
+// Intended for quick checks against a water bill; each call costs one rate-limited API request
+func adminUsageHandler(client *FlumeClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		deviceID := strings.TrimSpace(r.URL.Query().Get("device"))
+		if deviceID == "" {
+			writeAdminError(w, http.StatusBadRequest, "missing device parameter")
+			return
+		}
+
+		now := time.Now().In(client.location)
+		day, err := time.ParseInLocation("2006-01-02", r.URL.Query().Get("date"), now.Location())
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid or missing date parameter (expected YYYY-MM-DD)")
+			return
+		}
+		if day.After(now) {
+			writeAdminError(w, http.StatusBadRequest, "date must not be in the future")
+			return
+		}
+
+		until := day.AddDate(0, 0, 1).Add(-time.Second)
+		usage, err := client.QueryWaterUsage(deviceID, "DAY", 0, day, &until)
+		if err != nil {
+			log.Printf("Admin usage: failed to query usage for device %s on %s: %v", deviceID, day.Format("2006-01-02"), err)
+			writeAdminError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+
+		var gallons float64
+		for _, data := range usage.Data {
+			for _, point := range data.Points() {
+				gallons += point.Value
+			}
+		}
+
+		jsonData, _ := json.MarshalIndent(map[string]interface{}{
+			"device_id": deviceID,
+			"date":      day.Format("2006-01-02"),
+			"gallons":   gallons,
+		}, "", "  ")
+		w.Write(jsonData)
+	}
+}
+
+// writeAdminError writes a JSON error response for the admin endpoints
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	jsonData, _ := json.MarshalIndent(map[string]string{"error": message}, "", "  ")
+	w.Write(jsonData)
+}
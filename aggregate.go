@@ -0,0 +1,116 @@
+package main
+
+import "time"
+
+// accountTotal is an account-wide total: the metric family it sums and the period label it is reported under
+// The flow rate total has no period label
+type accountTotal struct {
+	family string
+	period string
+}
+
+// accountTotals are the per-device values summed into account totals
+var accountTotals = []accountTotal{
+	{family: MetricFamilyFlowRate},
+	{family: MetricFamilyHourly, period: "hour"},
+	{family: MetricFamilyToday, period: "today"},
+	{family: MetricFamilyYearly, period: "year"},
+}
+
+// accountValue is a device's latest contribution to an account total
+// A failed query keeps the entry but marks it, so the device is left out until its next success
+type accountValue struct {
+	value  float64
+	failed bool
+}
+
+// recordAccountValue stores a device's latest value for a metric family; ok is false when its query failed
+func (e *FlumeExporter) recordAccountValue(family, deviceID string, value float64, ok bool) {
+	e.accountMutex.Lock()
+	defer e.accountMutex.Unlock()
+
+	if e.accountValues == nil {
+		e.accountValues = make(map[string]map[string]accountValue)
+	}
+	if e.accountValues[family] == nil {
+		e.accountValues[family] = make(map[string]accountValue)
+	}
+	e.accountValues[family][deviceID] = accountValue{value: value, failed: !ok}
+}
+
+// forgetAccountValues drops a device from the account totals
+func (e *FlumeExporter) forgetAccountValues(deviceID string) {
+	e.accountMutex.Lock()
+	defer e.accountMutex.Unlock()
+
+	for _, values := range e.accountValues {
+		delete(values, deviceID)
+	}
+}
+
+// updateAccountTotals sums the latest values of the processed sensors into the account totals
+// A sensor whose latest query failed, or that has no value yet, is left out and the total is reported as partial
+func (e *FlumeExporter) updateAccountTotals(devices []Device) {
+	e.accountMutex.Lock()
+	defer e.accountMutex.Unlock()
+
+	for _, total := range accountTotals {
+		deviceIDs := e.accountDeviceIDs(devices, total.family)
+		if len(deviceIDs) == 0 {
+			// No sensor collects this family
+			e.metrics.DeleteAccountTotal(total.period)
+			continue
+		}
+		sum, partial := sumAccountValues(e.accountValues[total.family], deviceIDs)
+		e.metrics.SetAccountTotal(total.period, sum, partial)
+	}
+}
+
+// accountDeviceIDs returns the IDs of the processed sensors that collect a metric family
+// Sensors skipped as offline still count, with the values they last reported
+func (e *FlumeExporter) accountDeviceIDs(devices []Device, family string) []string {
+	var ids []string
+	for _, device := range devices {
+		if device.Type == 1 || !e.shouldProcessDevice(device.ID) || !e.config.Load().CollectsMetricFamily(device.ID, family) {
+			continue
+		}
+		ids = append(ids, device.ID)
+	}
+	return ids
+}
+
+// sumAccountValues sums the values of deviceIDs, reporting whether any was missing or failed
+func sumAccountValues(values map[string]accountValue, deviceIDs []string) (sum float64, partial bool) {
+	for _, deviceID := range deviceIDs {
+		entry, ok := values[deviceID]
+		if !ok || entry.failed {
+			partial = true
+			continue
+		}
+		sum += entry.value
+	}
+	return sum, partial
+}
+
+// totalUsage sums every point of a usage query, like the per-device usage gauges
+func totalUsage(usage *QueryResponse) float64 {
+	var total float64
+	for _, data := range usage.Data {
+		for _, point := range data.Points() {
+			total += point.Value
+		}
+	}
+	return total
+}
+
+// currentYearUsage returns the point of a YR bucket query for now's year, or 0 if there is none yet
+func currentYearUsage(usage *QueryResponse, now time.Time) float64 {
+	for _, data := range usage.Data {
+		for _, point := range data.Points() {
+			if t, err := point.Time(); err == nil && t.Year() == now.Year() {
+				return point.Value
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCurrentYearUsage(t *testing.T) {
+	now := time.Date(2026, time.March, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		body string
+		want float64
+	}{
+		{"several years", `{"data":[{"water_usage":[["2024-01-01 00:00:00",30000],["2025-01-01 00:00:00",31000],["2026-01-01 00:00:00",6000]]}]}`, 6000},
+		{"less than a year", `{"data":[{"water_usage":[["2026-01-01 00:00:00",450.5]]}]}`, 450.5},
+		{"no reading this year yet", `{"data":[{"water_usage":[["2025-01-01 00:00:00",31000]]}]}`, 0},
+		{"no data", `{"data":[]}`, 0},
+	}
+	for _, tt := range tests {
+		var usage QueryResponse
+		if err := json.Unmarshal([]byte(tt.body), &usage); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := currentYearUsage(&usage, now); got != tt.want {
+			t.Errorf("%s: currentYearUsage = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSumAccountValues(t *testing.T) {
+	values := map[string]accountValue{
+		"d1": {value: 1.5},
+		"d2": {value: 2},
+		"d3": {value: 10, failed: true},
+	}
+	tests := []struct {
+		name        string
+		deviceIDs   []string
+		want        float64
+		wantPartial bool
+	}{
+		{"all succeeded", []string{"d1", "d2"}, 3.5, false},
+		{"one failed", []string{"d1", "d2", "d3"}, 3.5, true},
+		{"one without a value yet", []string{"d1", "d4"}, 1.5, true},
+		{"none", nil, 0, false},
+	}
+	for _, tt := range tests {
+		sum, partial := sumAccountValues(values, tt.deviceIDs)
+		if sum != tt.want || partial != tt.wantPartial {
+			t.Errorf("%s: sumAccountValues = %v, partial %v, want %v, partial %v", tt.name, sum, partial, tt.want, tt.wantPartial)
+		}
+	}
+}
+
+func TestUpdateAccountTotalsPartial(t *testing.T) {
+	e, _ := newTestExporter(t, newTestConfig(t), stubRoutes(nil))
+	// Bridges are not sensors and never count towards the totals
+	devices := []Device{{ID: "d1", Type: 2}, {ID: "d2", Type: 2}, {ID: "b1", Type: 1}}
+
+	e.recordAccountValue(MetricFamilyFlowRate, "d1", 1.5, true)
+	e.recordAccountValue(MetricFamilyFlowRate, "d2", 0, false)
+	e.updateAccountTotals(devices)
+	if got := testutil.ToFloat64(e.metrics.accountFlowRate.WithLabelValues("true")); got != 1.5 {
+		t.Errorf("partial account flow rate = %v, want 1.5 without the failed device", got)
+	}
+
+	e.recordAccountValue(MetricFamilyFlowRate, "d2", 2, true)
+	e.updateAccountTotals(devices)
+	if n := testutil.CollectAndCount(e.metrics.accountFlowRate); n != 1 {
+		t.Errorf("account flow rate has %d series, want the partial one replaced", n)
+	}
+	if got := testutil.ToFloat64(e.metrics.accountFlowRate.WithLabelValues("false")); got != 3.5 {
+		t.Errorf("account flow rate = %v, want 3.5", got)
+	}
+
+	// Yearly usage is collected by default but has no values yet; hourly usage is collected by no device
+	if n := testutil.CollectAndCount(e.metrics.accountUsage); n != 1 {
+		t.Errorf("account usage has %d series, want only the yearly one", n)
+	}
+	if got := testutil.ToFloat64(e.metrics.accountUsage.WithLabelValues("year", "true")); got != 0 {
+		t.Errorf("partial account yearly usage = %v, want 0", got)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// runAuthCheck authenticates with the configured credentials, or reuses cached tokens, prints the token details,
+// user ID and device count, and returns the process exit code: 0 if everything succeeded, 1 if authentication
+// failed and 2 if the user ID or device list could not be fetched. The token file is only written with SaveTokens
+func runAuthCheck(config *Config) int {
+	// Metrics are collected but never served
+	client := NewFlumeClient(config, NewMetricsWithRegisterer(prometheus.NewRegistry()))
+	if !config.SaveTokens {
+		// Tokens were already loaded; keep the check from writing new ones
+		client.tokenFile = ""
+	}
+
+	source := "new login"
+	if !client.needsAuthentication() {
+		source = "cached token"
+	} else if client.refreshToken != "" && !client.isTokenExpired() {
+		source = "token refresh"
+	}
+
+	if err := client.ensureValidToken(context.Background()); err != nil {
+		fmt.Fprintf(os.Stderr, "Login: FAILED (%s): %v\n", classifyError(err), err)
+		return 1
+	}
+	fmt.Printf("Login: OK (%s)\n", source)
+	fmt.Printf("Token expires: %s (in %s)\n", client.tokenExpiry.Format(time.RFC3339), time.Until(client.tokenExpiry).Round(time.Second))
+
+	exitCode := 0
+	client.rateLimiter.Wait()
+	if userID, err := client.getUserID(context.Background()); err != nil {
+		fmt.Fprintf(os.Stderr, "User ID: FAILED: %v\n", err)
+		exitCode = 2
+	} else {
+		fmt.Printf("User ID: %d\n", userID)
+	}
+
+	if devices, err := client.GetDevices(); err != nil {
+		fmt.Fprintf(os.Stderr, "Devices: FAILED: %v\n", err)
+		exitCode = 2
+	} else {
+		fmt.Printf("Devices: %d\n", len(devices))
+	}
+
+	if config.SaveTokens && client.tokenFile != "" && source != "cached token" {
+		fmt.Printf("Tokens saved to: %s\n", client.tokenFile)
+	}
+	return exitCode
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
-	"path/filepath"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // Config holds all configuration options for the exporter
@@ -17,33 +23,234 @@ type Config struct {
 	Username     string
 	Password     string
 
+	// Pre-obtained refresh token used instead of the password grant when no password is set
+	RefreshToken string
+
+	// How client credentials are sent to the OAuth token endpoint: body or header (HTTP Basic auth)
+	OAuthAuthStyle string
+
+	// Where tokens are persisted; empty picks the first writable default location
+	TokenFile string
+
 	// Server configuration
 	ListenAddress string
 	MetricsPath   string
 
+	// Additional paths serving the metrics, e.g. a path older Prometheus configs still scrape
+	MetricsPathAliases     string
+	MetricsPathAliasesList []string
+	EnableOpenMetrics      bool
+
 	// Scrape configuration
 	ScrapeInterval time.Duration
-	Timeout        time.Duration
+	UsageInterval  time.Duration
+
+	// Bounds for the scrape interval calculated from the device count
+	MinScrapeInterval time.Duration
+	MaxScrapeInterval time.Duration
+	Timeout           time.Duration
+	CollectionTimeout time.Duration
+
+	// How long to keep reporting the last nonzero flow rate while the API returns no reading
+	FlowRateGracePeriod time.Duration
+
+	// Warn when a device's latest Flume reading is older than this
+	StaleDataThreshold time.Duration
+
+	// Report flow rate scrapes that return no reading as failed instead of successful
+	EmptyResponseAsFailure bool
+
+	// Skip flow rate and usage queries for devices the API reports as disconnected
+	SkipOfflineDevices bool
+
+	// Report info, connectivity and install time series for bridge devices, which have no sensor data
+	IncludeBridgeMetrics bool
+
+	// Append the device ID to location names shared by more than one device
+	DisambiguateLocations bool
+
+	// What to report when the Flume API stops returning data: freeze the last values or flag them as stale
+	StaleMetricsPolicy string
+	StaleMetricsAfter  time.Duration
+
+	// Also expose collection cycle durations as a histogram
+	CycleDurationHistogram bool
+
+	// Serve the device metrics from a snapshot taken after each collection cycle instead of the live values
+	SnapshotMetrics bool
 
 	// Flume API configuration
-	BaseURL string
+	BaseURL             string
+	MaxResponseBodySize int64
+	MaxLogBodyBytes     int
+
+	// TLS public key pinning for the Flume API: comma-separated base64 SHA-256 SPKI hashes
+	TLSPins     string
+	TLSPinBytes [][]byte
+
+	// Extra CA certificates (a PEM file or a directory of them) trusted for the Flume API
+	CACertFile string
+	CACertPool *x509.CertPool
+
+	// Disables Flume API certificate verification entirely; only for local mock servers
+	InsecureSkipVerify bool
+
+	// Demo mode: generate synthetic data for fake devices instead of calling Flume
+	Demo bool
+
+	// Fixture mode: replay canned API responses from this directory instead of calling Flume
+	FixturesDir string
 
 	// API rate limiting
 	APIMinInterval time.Duration
+	APIHourlyQuota int
+
+	// Hard cap on requests in any trailing hour (0 disables) and what to do once it is reached: block or skip
+	MaxRequestsPerHour int
+	MaxRequestsMode    string
+
+	// Concurrent per-device daily total queries (requests are still spaced by APIMinInterval)
+	UsageQueryWorkers int
+
+	// Days of daily totals to fetch for each device in its first collection after startup
+	InitialBackfillDays int
+
+	// Authentication retries: attempts and exponential backoff base and cap
+	AuthMaxRetries      int
+	AuthRetryBackoff    time.Duration
+	AuthRetryMaxBackoff time.Duration
 
 	// Device filtering
 	DeviceIDs string
+
+	// Optional file of device IDs, one per line, re-read every DeviceIDsFileInterval
+	DeviceIDsFile         string
+	DeviceIDsFileInterval time.Duration
+
+	// Device priorities: comma-separated id:N pairs, refreshing the device's flow rate every N cycles
+	DevicePriorities string
+
+	// Per-device metric families: comma-separated id:family|family entries, parsed into DeviceMetricFamilies
+	DeviceMetrics        string
+	DeviceMetricFamilies map[string]map[string]bool
+
+	// Device name overrides: comma-separated id=name pairs, parsed into DeviceNameOverrides
+	DeviceNames         string
+	DeviceNameOverrides map[string]string
+
+	// Daily water budgets: comma-separated id=gallons pairs, parsed into DeviceBudgetGallons
+	DeviceBudgets       string
+	DeviceBudgetGallons map[string]float64
+
+	// Text appended to metric help: semicolon-separated metric_name=text pairs, parsed into MetricHelpSuffixes
+	MetricHelp         string
+	MetricHelpSuffixes map[string]string
+
+	// IANA time zone for day boundaries (e.g. "today" usage), parsed into Location; the process time zone if empty
+	Timezone string
+	Location *time.Location
+
+	// Static labels added to every exporter metric: comma-separated key=value pairs, parsed into ExtraLabelSet
+	ExtraLabels   string
+	ExtraLabelSet map[string]string
+
+	// Device list caching
+	DeviceCacheTTL time.Duration
+
+	// Cumulative usage counter
+	EnableUsageCounter bool
+
+	// Space API requests evenly across the hour instead of sending each cycle's requests back-to-back
+	SpreadRequests bool
+
+	// Push mode
+	PushgatewayURL      string
+	PushgatewayUsername string
+	PushgatewayPassword string
+	PushgatewayJob      string
+	PushgatewayInstance string
+	DisableHTTPServer   bool
+
+	// Textfile mode: write metrics for node_exporter's textfile collector after each collection
+	TextfileOutput string
+
+	// InfluxDB mode: also write metrics in line protocol to an InfluxDB write URL after each collection
+	InfluxDBURL   string
+	InfluxDBToken string
+
+	// MQTT mode: also publish flow rate and usage values to an MQTT broker after each collection
+	MQTTBroker          string
+	MQTTUsername        string
+	MQTTPassword        string
+	MQTTTopicPrefix     string
+	MQTTFormat          string
+	MQTTDiscovery       bool
+	MQTTDiscoveryPrefix string
+
+	// OTLP mode: also export metrics to an OpenTelemetry collector over OTLP/HTTP
+	OTLPEndpoint string
+	OTLPInterval time.Duration
+
+	// Optional KEY=VALUE file read at startup and again on SIGHUP
+	ConfigFile string
+
+	// Flag values before the environment and config file were applied, used by Reload
+	flagConfig *Config
+
+	// Bearer token for the /admin endpoints (admin endpoints are disabled if empty)
+	AdminToken string
+
+	// Scrape target advertised on /targets for Prometheus HTTP service discovery (disabled if empty),
+	// with static key=value target labels parsed into SDLabelSet
+	SDTarget   string
+	SDLabels   string
+	SDLabelSet map[string]string
+
+	// Number of recent raw API responses kept for /debug/last-responses (disabled if 0)
+	DebugLastResponses int
+
+	// Check the worst-case hourly request count against the quota and exit instead of starting
+	ValidateOnlyQuota bool
+	QuotaDeviceCount  int
+
+	// Check the credentials, print token details and exit instead of starting; SaveTokens also writes the token file
+	CheckAuth  bool
+	SaveTokens bool
 }
 
 // NewConfig creates a new configuration with default values
 func NewConfig() *Config {
 	return &Config{
-		ListenAddress:  ":9193",
-		MetricsPath:    "/metrics",
-		ScrapeInterval: 30 * time.Second,
-		Timeout:        10 * time.Second,
-		BaseURL:        "https://api.flumewater.com",
-		APIMinInterval: 30 * time.Second, // Default: minimum 30 seconds between API requests (120 requests/hour limit)
+		ListenAddress:       ":9193",
+		MetricsPath:         "/metrics",
+		ScrapeInterval:      30 * time.Second,
+		MinScrapeInterval:   2 * time.Minute,
+		MaxScrapeInterval:   10 * time.Minute,
+		Timeout:             10 * time.Second,
+		BaseURL:             "https://api.flumewater.com",
+		MaxResponseBodySize: 4 * 1024 * 1024,  // Default: refuse API responses larger than 4 MiB
+		MaxLogBodyBytes:     2048,             // Default: truncate response bodies in logs after 2 KiB
+		APIMinInterval:      30 * time.Second, // Default: minimum 30 seconds between API requests (120 requests/hour limit)
+		DeviceCacheTTL:      1 * time.Hour,    // Default: re-fetch the device list at most once per hour
+		APIHourlyQuota:      flumeRequestsPerHourLimit,
+		MaxRequestsMode:     RequestBudgetBlock,
+		OAuthAuthStyle:      OAuthAuthStyleBody,
+		StaleMetricsPolicy:  StaleMetricsFreeze,
+		StaleMetricsAfter:   10 * time.Minute,
+		MQTTTopicPrefix:     "flume",
+		MQTTFormat:          MQTTFormatJSON,
+		MQTTDiscoveryPrefix: "homeassistant",
+		UsageQueryWorkers:   2,
+		InitialBackfillDays: dailyTotalLookbackDays,
+		AuthMaxRetries:      3,
+		AuthRetryBackoff:    5 * time.Second, // Default: wait 5s, 10s, 20s... between authentication attempts
+		AuthRetryMaxBackoff: 2 * time.Minute,
+		PushgatewayJob:      "flume_exporter",
+
+		DeviceIDsFileInterval: 30 * time.Second,
+		OTLPInterval:          1 * time.Minute,
+		FlowRateGracePeriod:   1 * time.Minute, // Default: bridge over one or two empty flow rate responses
+		StaleDataThreshold:    15 * time.Minute,
 	}
 }
 
@@ -56,128 +263,1136 @@ func LoadConfig() (*Config, error) {
 	flag.StringVar(&config.ClientSecret, "client-secret", "", "Flume API client secret")
 	flag.StringVar(&config.Username, "username", "", "Flume account email address")
 	flag.StringVar(&config.Password, "password", "", "Flume account password")
+	flag.StringVar(&config.RefreshToken, "refresh-token", "", "Pre-obtained Flume OAuth refresh token; replaces --username and --password, and the exporter only ever refreshes")
+	flag.StringVar(&config.OAuthAuthStyle, "oauth-auth-style", config.OAuthAuthStyle, "How to send the client ID and secret to the OAuth token endpoint: body (in the JSON body) or header (Authorization: Basic)")
+	flag.StringVar(&config.TokenFile, "token-file", "", "File to persist OAuth tokens in (default: the first writable of /var/lib/flume-exporter, the user cache directory and the temp directory)")
 	flag.StringVar(&config.ListenAddress, "listen-address", config.ListenAddress, "Address to listen on")
 	flag.StringVar(&config.MetricsPath, "metrics-path", config.MetricsPath, "Path under which to expose metrics")
+	flag.StringVar(&config.MetricsPathAliases, "metrics-path-aliases", "", "Comma-separated additional paths that also serve the metrics, e.g. /prometheus")
+	flag.BoolVar(&config.EnableOpenMetrics, "enable-openmetrics", config.EnableOpenMetrics, "Serve OpenMetrics exposition format when requested via the Accept header")
 	flag.DurationVar(&config.ScrapeInterval, "scrape-interval", config.ScrapeInterval, "Interval between metric scrapes")
+	flag.DurationVar(&config.MinScrapeInterval, "min-scrape-interval", config.MinScrapeInterval, "Shortest scrape interval calculated from the device count; at least 32s, and raised further for more devices to stay within Flume's hourly limit")
+	flag.DurationVar(&config.MaxScrapeInterval, "max-scrape-interval", config.MaxScrapeInterval, "Longest scrape interval calculated from the device count, unless Flume's hourly limit requires a longer one")
+	flag.DurationVar(&config.UsageInterval, "usage-interval", config.UsageInterval, "Separate interval for usage queries (hourly, daily and yearly totals); 0 collects them with every scrape")
 	flag.DurationVar(&config.Timeout, "timeout", config.Timeout, "Request timeout")
+	flag.DurationVar(&config.CollectionTimeout, "collection-timeout", config.CollectionTimeout, "Maximum duration of a single collection cycle before it is aborted (0 disables)")
+	flag.DurationVar(&config.StaleDataThreshold, "stale-data-threshold", config.StaleDataThreshold, "Log a warning when a device's latest Flume reading is older than this (0 disables the warning)")
+	flag.DurationVar(&config.FlowRateGracePeriod, "flow-rate-grace-period", config.FlowRateGracePeriod, "Keep reporting the last nonzero flow rate for this long when the API returns no reading (0 reports 0 immediately)")
+	flag.BoolVar(&config.EmptyResponseAsFailure, "empty-response-as-failure", false, "Report flow rate scrapes that return no reading as failed (flume_exporter_scrape_success 0) instead of successful")
+	flag.BoolVar(&config.SkipOfflineDevices, "skip-offline-devices", false, "Skip flow rate and usage queries for devices the Flume API reports as disconnected, saving their requests; flume_device_connected is still reported")
+	flag.BoolVar(&config.IncludeBridgeMetrics, "include-bridge-metrics", false, "Report flume_device_info, flume_device_connected and flume_device_install_timestamp_seconds for bridges (flow rate and usage are never queried for bridges)")
+	flag.BoolVar(&config.DisambiguateLocations, "disambiguate-locations", false, "Append the device ID to the location label, e.g. 'Home (1234)', when more than one device shares a location name")
+	flag.StringVar(&config.StaleMetricsPolicy, "stale-metrics-policy", config.StaleMetricsPolicy, "What to report while the Flume API returns no data: freeze (keep the last values) or flag (keep them and set flume_exporter_data_stale)")
+	flag.DurationVar(&config.StaleMetricsAfter, "stale-metrics-after", config.StaleMetricsAfter, "With --stale-metrics-policy=flag, how long an endpoint may keep failing before the metrics are flagged as stale")
+	flag.BoolVar(&config.SnapshotMetrics, "snapshot-metrics", false, "Serve device metrics from a snapshot taken after each collection cycle, so scrapes never see a partly updated cycle")
+	flag.BoolVar(&config.CycleDurationHistogram, "cycle-duration-histogram", false, "Also expose collection cycle durations as a histogram (flume_exporter_collection_cycle_duration_histogram_seconds)")
 	flag.StringVar(&config.BaseURL, "base-url", config.BaseURL, "Flume API base URL")
+	flag.StringVar(&config.TLSPins, "tls-pins", "", "Comma-separated base64 SHA-256 hashes of pinned Flume API public keys (standard verification only if empty)")
+	flag.StringVar(&config.CACertFile, "ca-cert-file", "", "PEM file, or directory of .pem/.crt files, with CA certificates to trust for the Flume API in addition to the system roots")
+	flag.BoolVar(&config.InsecureSkipVerify, "insecure-skip-verify", false, "INSECURE: disable Flume API certificate verification; for local testing against a mock server only, never in production; use --ca-cert-file for private CAs")
+	flag.BoolVar(&config.Demo, "demo", false, "Serve synthetic data for fake devices without a Flume account (series are labelled demo=\"true\")")
+	flag.StringVar(&config.FixturesDir, "fixtures-dir", "", "Directory of recorded JSON responses to serve instead of calling the Flume API (for development and demos)")
+	flag.Int64Var(&config.MaxResponseBodySize, "max-response-body-size", config.MaxResponseBodySize, "Maximum size in bytes of a Flume API response body (0 disables the limit)")
+	flag.IntVar(&config.MaxLogBodyBytes, "max-log-body-bytes", config.MaxLogBodyBytes, "Maximum number of response body bytes written to logs (0 disables truncation)")
 	flag.DurationVar(&config.APIMinInterval, "api-min-interval", config.APIMinInterval, "Minimum interval between Flume API requests")
+	flag.IntVar(&config.AuthMaxRetries, "auth-max-retries", config.AuthMaxRetries, "Authentication attempts at startup before giving up")
+	flag.DurationVar(&config.AuthRetryBackoff, "auth-retry-backoff", config.AuthRetryBackoff, "Wait after the first failed authentication attempt, doubled after each further failure")
+	flag.DurationVar(&config.AuthRetryMaxBackoff, "auth-retry-max-backoff", config.AuthRetryMaxBackoff, "Maximum wait between authentication attempts")
+	flag.IntVar(&config.InitialBackfillDays, "initial-backfill-days", config.InitialBackfillDays, fmt.Sprintf("Days of daily totals to fetch in each device's first collection after startup (%d-%d)", dailyTotalLookbackDays, maxInitialBackfillDays))
+	flag.IntVar(&config.UsageQueryWorkers, "usage-query-workers", config.UsageQueryWorkers, "Maximum concurrent per-device daily total queries (requests are still spaced by --api-min-interval)")
+	flag.BoolVar(&config.ValidateOnlyQuota, "validate-only-quota", false, "Print the worst-case API requests per hour and exit non-zero if they exceed the hourly quota, without starting the exporter")
+	flag.IntVar(&config.QuotaDeviceCount, "quota-device-count", 0, "Device count for --validate-only-quota (defaults to the number of DEVICE_IDS)")
+	flag.BoolVar(&config.CheckAuth, "check-auth", false, "Authenticate (or use cached tokens), print the token expiry, user ID and device count, and exit without starting the exporter")
+	flag.BoolVar(&config.SaveTokens, "save-tokens", false, "With --check-auth, also write the obtained tokens to the token file")
+	flag.IntVar(&config.MaxRequestsPerHour, "max-requests-per-hour", 0, "Hard cap on Flume API requests in any trailing hour, enforced before each request (0 disables)")
+	flag.StringVar(&config.MaxRequestsMode, "max-requests-mode", config.MaxRequestsMode, "What to do once --max-requests-per-hour is reached: block (wait for the window to free up) or skip (fail the request)")
+	flag.IntVar(&config.APIHourlyQuota, "api-hourly-quota", config.APIHourlyQuota, "Flume API requests allowed per hour; usage queries are deferred when the trailing hour nears it (0 disables)")
 	flag.StringVar(&config.DeviceIDs, "device-ids", "", "Comma-separated list of device IDs to scrape (e.g., 123,456,789)")
+	flag.StringVar(&config.DeviceIDsFile, "device-ids-file", "", "File listing device IDs to scrape, one per line (# starts a comment); cannot be combined with --device-ids")
+	flag.DurationVar(&config.DeviceIDsFileInterval, "device-ids-file-interval", config.DeviceIDsFileInterval, "How often to re-read the device IDs file for changes (0 disables watching)")
+	flag.StringVar(&config.DevicePriorities, "device-priorities", "", "Comma-separated device_id:N pairs; the device's flow rate is refreshed every N collection cycles (default 1)")
+	flag.StringVar(&config.ExtraLabels, "extra-labels", "", "Comma-separated key=value labels added to every exporter metric (e.g., site=home,env=prod)")
+	flag.StringVar(&config.MetricHelp, "metric-help", "", "Semicolon-separated metric_name=text pairs appended to the metrics' HELP text (e.g., flume_current_flow_rate_gallons_per_minute=Owned by the platform team)")
+	flag.StringVar(&config.DeviceBudgets, "device-budgets", "", "Comma-separated device_id=gallons daily water budgets, compared with today's usage in flume_daily_usage_budget_ratio (requires the today metric family)")
+	flag.StringVar(&config.DeviceNames, "device-names", "", "Comma-separated device_id=name pairs overriding the device_name label (e.g., 123=Kitchen,456=Garage)")
+	flag.StringVar(&config.DeviceMetrics, "device-metrics", "", "Comma-separated device_id:family|family entries selecting which metric families to collect per device (flow_rate, daily_total, hourly, yearly, today)")
+	flag.StringVar(&config.Timezone, "timezone", "", "IANA time zone of the Flume account (e.g., America/Denver), used for day boundaries such as today's usage (defaults to the process time zone)")
+	flag.DurationVar(&config.DeviceCacheTTL, "device-cache-ttl", config.DeviceCacheTTL, "How long to cache the device list and user ID before re-fetching (0 disables caching)")
+	flag.DurationVar(&config.DeviceCacheTTL, "device-refresh-interval", config.DeviceCacheTTL, "Deprecated alias of -device-cache-ttl; it only sets the cache TTL and does not refresh devices in the background")
+	flag.BoolVar(&config.SpreadRequests, "spread-requests", false, "Space API requests evenly across the hour based on the expected requests per hour, instead of sending each cycle's requests back-to-back (never faster than --api-min-interval)")
+	flag.BoolVar(&config.EnableUsageCounter, "enable-usage-counter", false, "Emit flume_water_usage_gallons_total, a counter of usage since start derived from daily totals")
+	flag.StringVar(&config.PushgatewayURL, "pushgateway-url", "", "Pushgateway URL to push metrics to after each collection (disabled if empty)")
+	flag.StringVar(&config.PushgatewayUsername, "pushgateway-username", "", "Basic auth username for the Pushgateway")
+	flag.StringVar(&config.PushgatewayPassword, "pushgateway-password", "", "Basic auth password for the Pushgateway")
+	flag.StringVar(&config.PushgatewayJob, "pushgateway-job", config.PushgatewayJob, "Job label used when pushing to the Pushgateway")
+	flag.StringVar(&config.PushgatewayInstance, "pushgateway-instance", "", "Instance label used when pushing to the Pushgateway (defaults to the hostname)")
+	flag.BoolVar(&config.DisableHTTPServer, "disable-http-server", false, "Do not start the HTTP server (requires --pushgateway-url, --textfile-output, --otlp-endpoint, --influxdb-url or --mqtt-broker)")
+	flag.StringVar(&config.OTLPEndpoint, "otlp-endpoint", "", "OTLP/HTTP metrics endpoint URL to also export metrics to (e.g. http://collector:4318/v1/metrics; disabled if empty)")
+	flag.DurationVar(&config.OTLPInterval, "otlp-interval", config.OTLPInterval, "Interval between OTLP metric exports")
+	flag.StringVar(&config.TextfileOutput, "textfile-output", "", "Path of a .prom file to write metrics to after each collection, for node_exporter's textfile collector")
+	flag.StringVar(&config.InfluxDBURL, "influxdb-url", "", "InfluxDB write URL to send metrics to in line protocol after each collection (e.g. http://influxdb:8086/api/v2/write?org=home&bucket=flume; disabled if empty)")
+	flag.StringVar(&config.InfluxDBToken, "influxdb-token", "", "API token sent as 'Authorization: Token ...' with InfluxDB writes")
+	flag.StringVar(&config.MQTTBroker, "mqtt-broker", "", "MQTT broker to publish flow rate and usage values to after each collection, as host:port or tcp://, mqtt://, ssl://, tls:// or mqtts:// URL (disabled if empty)")
+	flag.StringVar(&config.MQTTUsername, "mqtt-username", "", "MQTT username")
+	flag.StringVar(&config.MQTTPassword, "mqtt-password", "", "MQTT password")
+	flag.StringVar(&config.MQTTTopicPrefix, "mqtt-topic-prefix", config.MQTTTopicPrefix, "Prefix of the MQTT topics, published as <prefix>/<device_id>/<value>")
+	flag.StringVar(&config.MQTTFormat, "mqtt-format", config.MQTTFormat, "MQTT payload format: json ({\"value\": 1.5}) or plain (1.5)")
+	flag.BoolVar(&config.MQTTDiscovery, "mqtt-discovery", false, "Publish Home Assistant MQTT discovery configs for the published values")
+	flag.StringVar(&config.MQTTDiscoveryPrefix, "mqtt-discovery-prefix", config.MQTTDiscoveryPrefix, "Home Assistant MQTT discovery prefix")
+	flag.StringVar(&config.AdminToken, "admin-token", "", "Bearer token required by the /admin endpoints (admin endpoints disabled if empty)")
+	flag.StringVar(&config.SDTarget, "sd-target", "", "host:port at which Prometheus can scrape this exporter, served on /targets for HTTP service discovery (requires --admin-token; disabled if empty)")
+	flag.IntVar(&config.DebugLastResponses, "debug-last-responses", 0, "Keep the last N raw Flume API responses in memory, served on /debug/last-responses (requires --admin-token; disabled if 0)")
+	flag.StringVar(&config.SDLabels, "sd-labels", "", "Comma-separated key=value target labels served on /targets (e.g., account=home,site=cabin)")
+	flag.StringVar(&config.ConfigFile, "config-file", "", "File of KEY=VALUE settings (same names as the environment variables), re-read on SIGHUP")
 
 	// Add flag to clear tokens
 	clearTokens := flag.Bool("clear-tokens", false, "Clear stored authentication tokens")
 
 	flag.Parse()
-
-	// Handle clear-tokens flag
-	if *clearTokens {
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			log.Printf("Warning: Could not determine home directory: %v", err)
-			homeDir = "."
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "device-refresh-interval" {
+			log.Printf("Warning: -device-refresh-interval is deprecated and only sets the device cache TTL; use -device-cache-ttl")
 		}
-		tokenFile := filepath.Join(homeDir, ".flume_exporter_tokens.json")
+	})
+
+	// Snapshot the flag values so a reload can re-apply the environment and config file on top of them
+	flagConfig := *config
+	config.flagConfig = &flagConfig
+
+	if err := applyConfigSources(config); err != nil {
+		return nil, err
+	}
 
-		if err := os.Remove(tokenFile); err != nil {
+	// Clear the token file the client would use, so TOKEN_FILE and the config file are honored
+	if *clearTokens {
+		if tokenFile := selectTokenFile(config.TokenFile); tokenFile == "" {
+			log.Println("No token file location is writable, so there are no tokens to clear")
+		} else if err := os.Remove(tokenFile); err != nil {
 			if os.IsNotExist(err) {
 				log.Println("No token file found to clear")
 			} else {
 				log.Printf("Warning: Failed to remove token file: %v", err)
 			}
 		} else {
-			log.Println("Authentication tokens cleared successfully")
+			log.Printf("Authentication tokens cleared successfully from %s", tokenFile)
+		}
+	}
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Reload re-reads the environment and config file on top of the original flag values
+// The result is a complete, validated configuration; callers decide which fields to apply
+func (c *Config) Reload() (*Config, error) {
+	next := *c.flagConfig
+	next.flagConfig = c.flagConfig
+
+	if err := applyConfigSources(&next); err != nil {
+		return nil, err
+	}
+	if err := validateConfig(&next); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// applyConfigSources applies the config file, if any, and then the environment, which takes precedence
+func applyConfigSources(config *Config) error {
+	if val := os.Getenv("CONFIG_FILE"); val != "" {
+		config.ConfigFile = val
+	}
+
+	fileValues := map[string]string{}
+	if config.ConfigFile != "" {
+		values, err := readConfigFile(config.ConfigFile)
+		if err != nil {
+			return err
+		}
+		fileValues = values
+	}
+
+	applyEnvOverrides(config, func(key string) string {
+		if val := os.Getenv(key); val != "" {
+			return val
+		}
+		return fileValues[key]
+	})
+	return nil
+}
+
+// readConfigFile reads KEY=VALUE lines in the same format as config.example
+// Blank lines and # comments are skipped, and values may be wrapped in single or double quotes
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid line %d in config file %s (expected KEY=VALUE)", i+1, path)
+		}
+
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
 		}
+		values[strings.TrimSpace(parts[0])] = value
 	}
 
+	return values, nil
+}
+
+// applyEnvOverrides overrides config values with the variables returned by getenv
+func applyEnvOverrides(config *Config, getenv func(string) string) {
 	// Override with environment variables if present
-	if val := os.Getenv("FLUME_CLIENT_ID"); val != "" {
+	if val := getenv("FLUME_CLIENT_ID"); val != "" {
 		config.ClientID = val
 	}
-	if val := os.Getenv("FLUME_CLIENT_SECRET"); val != "" {
+	if val := getenv("FLUME_CLIENT_SECRET"); val != "" {
 		config.ClientSecret = val
 	}
-	if val := os.Getenv("FLUME_USERNAME"); val != "" {
+	if val := getenv("FLUME_USERNAME"); val != "" {
 		config.Username = val
 	}
-	if val := os.Getenv("FLUME_PASSWORD"); val != "" {
+	if val := getenv("FLUME_PASSWORD"); val != "" {
 		config.Password = val
 	}
-	if val := os.Getenv("LISTEN_ADDRESS"); val != "" {
+	if val := getenv("FLUME_REFRESH_TOKEN"); val != "" {
+		config.RefreshToken = val
+	}
+	if val := getenv("OAUTH_AUTH_STYLE"); val != "" {
+		config.OAuthAuthStyle = val
+	}
+	if val := getenv("TOKEN_FILE"); val != "" {
+		config.TokenFile = val
+	}
+	if val := getenv("LISTEN_ADDRESS"); val != "" {
 		config.ListenAddress = val
 	}
-	if val := os.Getenv("METRICS_PATH"); val != "" {
+	if val := getenv("METRICS_PATH"); val != "" {
 		config.MetricsPath = val
 	}
-	if val := os.Getenv("BASE_URL"); val != "" {
+	if val := getenv("METRICS_PATH_ALIASES"); val != "" {
+		config.MetricsPathAliases = val
+	}
+	if val := getenv("ENABLE_OPENMETRICS"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.EnableOpenMetrics = parsed
+		} else {
+			log.Printf("Warning: Invalid ENABLE_OPENMETRICS value '%s', using default: %v", val, config.EnableOpenMetrics)
+		}
+	}
+	if val := getenv("BASE_URL"); val != "" {
 		config.BaseURL = val
 	}
-	if val := os.Getenv("SCRAPE_INTERVAL"); val != "" {
+	if val := getenv("TLS_PINS"); val != "" {
+		config.TLSPins = val
+	}
+	if val := getenv("CA_CERT_FILE"); val != "" {
+		config.CACertFile = val
+	}
+	if val := getenv("INSECURE_SKIP_VERIFY"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.InsecureSkipVerify = parsed
+		} else {
+			log.Printf("Warning: Invalid INSECURE_SKIP_VERIFY value '%s', using default: %v", val, config.InsecureSkipVerify)
+		}
+	}
+	if val := getenv("DEMO"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.Demo = parsed
+		} else {
+			log.Printf("Warning: Invalid DEMO value '%s', using default: %v", val, config.Demo)
+		}
+	}
+	if val := getenv("FIXTURES_DIR"); val != "" {
+		config.FixturesDir = val
+	}
+	if val := getenv("MAX_RESPONSE_BODY_SIZE"); val != "" {
+		if parsed, err := strconv.ParseInt(val, 10, 64); err == nil {
+			config.MaxResponseBodySize = parsed
+		} else {
+			log.Printf("Warning: Invalid MAX_RESPONSE_BODY_SIZE value '%s', using default: %d", val, config.MaxResponseBodySize)
+		}
+	}
+	if val := getenv("MAX_LOG_BODY_BYTES"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			config.MaxLogBodyBytes = parsed
+		} else {
+			log.Printf("Warning: Invalid MAX_LOG_BODY_BYTES value '%s', using default: %d", val, config.MaxLogBodyBytes)
+		}
+	}
+	if val := getenv("SCRAPE_INTERVAL"); val != "" {
 		if parsed, err := time.ParseDuration(val); err == nil {
 			config.ScrapeInterval = parsed
 		} else {
 			log.Printf("Warning: Invalid SCRAPE_INTERVAL value '%s', using default: %v", val, config.ScrapeInterval)
 		}
 	}
-	if val := os.Getenv("TIMEOUT"); val != "" {
+	if val := getenv("MIN_SCRAPE_INTERVAL"); val != "" {
+		if parsed, err := time.ParseDuration(val); err == nil {
+			config.MinScrapeInterval = parsed
+		} else {
+			log.Printf("Warning: Invalid MIN_SCRAPE_INTERVAL value '%s', using default: %v", val, config.MinScrapeInterval)
+		}
+	}
+	if val := getenv("MAX_SCRAPE_INTERVAL"); val != "" {
+		if parsed, err := time.ParseDuration(val); err == nil {
+			config.MaxScrapeInterval = parsed
+		} else {
+			log.Printf("Warning: Invalid MAX_SCRAPE_INTERVAL value '%s', using default: %v", val, config.MaxScrapeInterval)
+		}
+	}
+	if val := getenv("USAGE_INTERVAL"); val != "" {
+		if parsed, err := time.ParseDuration(val); err == nil {
+			config.UsageInterval = parsed
+		} else {
+			log.Printf("Warning: Invalid USAGE_INTERVAL value '%s', using default: %v", val, config.UsageInterval)
+		}
+	}
+	if val := getenv("TIMEOUT"); val != "" {
 		if parsed, err := time.ParseDuration(val); err == nil {
 			config.Timeout = parsed
 		} else {
 			log.Printf("Warning: Invalid TIMEOUT value '%s', using default: %v", val, config.Timeout)
 		}
 	}
-	if val := os.Getenv("API_MIN_INTERVAL"); val != "" {
+	if val := getenv("COLLECTION_TIMEOUT"); val != "" {
+		if parsed, err := time.ParseDuration(val); err == nil {
+			config.CollectionTimeout = parsed
+		} else {
+			log.Printf("Warning: Invalid COLLECTION_TIMEOUT value '%s', using default: %v", val, config.CollectionTimeout)
+		}
+	}
+	if val := getenv("FLOW_RATE_GRACE_PERIOD"); val != "" {
+		if parsed, err := time.ParseDuration(val); err == nil {
+			config.FlowRateGracePeriod = parsed
+		} else {
+			log.Printf("Warning: Invalid FLOW_RATE_GRACE_PERIOD value '%s', using default: %v", val, config.FlowRateGracePeriod)
+		}
+	}
+	if val := getenv("STALE_DATA_THRESHOLD"); val != "" {
+		if parsed, err := time.ParseDuration(val); err == nil {
+			config.StaleDataThreshold = parsed
+		} else {
+			log.Printf("Warning: Invalid STALE_DATA_THRESHOLD value '%s', using default: %v", val, config.StaleDataThreshold)
+		}
+	}
+	if val := getenv("EMPTY_RESPONSE_AS_FAILURE"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.EmptyResponseAsFailure = parsed
+		} else {
+			log.Printf("Warning: Invalid EMPTY_RESPONSE_AS_FAILURE value '%s', using default: %v", val, config.EmptyResponseAsFailure)
+		}
+	}
+	if val := getenv("SKIP_OFFLINE_DEVICES"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.SkipOfflineDevices = parsed
+		} else {
+			log.Printf("Warning: Invalid SKIP_OFFLINE_DEVICES value '%s', using default: %v", val, config.SkipOfflineDevices)
+		}
+	}
+	if val := getenv("INCLUDE_BRIDGE_METRICS"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.IncludeBridgeMetrics = parsed
+		} else {
+			log.Printf("Warning: Invalid INCLUDE_BRIDGE_METRICS value '%s', using default: %v", val, config.IncludeBridgeMetrics)
+		}
+	}
+	if val := getenv("DISAMBIGUATE_LOCATIONS"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.DisambiguateLocations = parsed
+		} else {
+			log.Printf("Warning: Invalid DISAMBIGUATE_LOCATIONS value '%s', using default: %v", val, config.DisambiguateLocations)
+		}
+	}
+	if val := getenv("STALE_METRICS_POLICY"); val != "" {
+		config.StaleMetricsPolicy = val
+	}
+	if val := getenv("STALE_METRICS_AFTER"); val != "" {
+		if parsed, err := time.ParseDuration(val); err == nil && parsed >= 0 {
+			config.StaleMetricsAfter = parsed
+		} else {
+			log.Printf("Warning: Invalid STALE_METRICS_AFTER value '%s', using default: %v", val, config.StaleMetricsAfter)
+		}
+	}
+	if val := getenv("SNAPSHOT_METRICS"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.SnapshotMetrics = parsed
+		} else {
+			log.Printf("Warning: Invalid SNAPSHOT_METRICS value '%s', using default: %v", val, config.SnapshotMetrics)
+		}
+	}
+	if val := getenv("CYCLE_DURATION_HISTOGRAM"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.CycleDurationHistogram = parsed
+		} else {
+			log.Printf("Warning: Invalid CYCLE_DURATION_HISTOGRAM value '%s', using default: %v", val, config.CycleDurationHistogram)
+		}
+	}
+	if val := getenv("API_MIN_INTERVAL"); val != "" {
 		if parsed, err := time.ParseDuration(val); err == nil {
 			config.APIMinInterval = parsed
 		} else {
 			log.Printf("Warning: Invalid API_MIN_INTERVAL value '%s', using default: %v", val, config.APIMinInterval)
 		}
 	}
-	if val := os.Getenv("DEVICE_IDS"); val != "" {
+	if val := getenv("AUTH_MAX_RETRIES"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed > 0 {
+			config.AuthMaxRetries = parsed
+		} else {
+			log.Printf("Warning: Invalid AUTH_MAX_RETRIES value '%s', using default: %d", val, config.AuthMaxRetries)
+		}
+	}
+	if val := getenv("AUTH_RETRY_BACKOFF"); val != "" {
+		if parsed, err := time.ParseDuration(val); err == nil {
+			config.AuthRetryBackoff = parsed
+		} else {
+			log.Printf("Warning: Invalid AUTH_RETRY_BACKOFF value '%s', using default: %v", val, config.AuthRetryBackoff)
+		}
+	}
+	if val := getenv("AUTH_RETRY_MAX_BACKOFF"); val != "" {
+		if parsed, err := time.ParseDuration(val); err == nil {
+			config.AuthRetryMaxBackoff = parsed
+		} else {
+			log.Printf("Warning: Invalid AUTH_RETRY_MAX_BACKOFF value '%s', using default: %v", val, config.AuthRetryMaxBackoff)
+		}
+	}
+	if val := getenv("USAGE_QUERY_WORKERS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed > 0 {
+			config.UsageQueryWorkers = parsed
+		} else {
+			log.Printf("Warning: Invalid USAGE_QUERY_WORKERS value '%s', using default: %d", val, config.UsageQueryWorkers)
+		}
+	}
+	if val := getenv("INITIAL_BACKFILL_DAYS"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			config.InitialBackfillDays = parsed
+		} else {
+			log.Printf("Warning: Invalid INITIAL_BACKFILL_DAYS value '%s', using default: %d", val, config.InitialBackfillDays)
+		}
+	}
+	if val := getenv("VALIDATE_ONLY_QUOTA"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.ValidateOnlyQuota = parsed
+		} else {
+			log.Printf("Warning: Invalid VALIDATE_ONLY_QUOTA value '%s', using default: %v", val, config.ValidateOnlyQuota)
+		}
+	}
+	if val := getenv("CHECK_AUTH"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.CheckAuth = parsed
+		} else {
+			log.Printf("Warning: Invalid CHECK_AUTH value '%s', using default: %v", val, config.CheckAuth)
+		}
+	}
+	if val := getenv("SAVE_TOKENS"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.SaveTokens = parsed
+		} else {
+			log.Printf("Warning: Invalid SAVE_TOKENS value '%s', using default: %v", val, config.SaveTokens)
+		}
+	}
+	if val := getenv("QUOTA_DEVICE_COUNT"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed > 0 {
+			config.QuotaDeviceCount = parsed
+		} else {
+			log.Printf("Warning: Invalid QUOTA_DEVICE_COUNT value '%s', using default: %d", val, config.QuotaDeviceCount)
+		}
+	}
+	if val := getenv("API_HOURLY_QUOTA"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil {
+			config.APIHourlyQuota = parsed
+		} else {
+			log.Printf("Warning: Invalid API_HOURLY_QUOTA value '%s', using default: %d", val, config.APIHourlyQuota)
+		}
+	}
+	if val := getenv("MAX_REQUESTS_PER_HOUR"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed >= 0 {
+			config.MaxRequestsPerHour = parsed
+		} else {
+			log.Printf("Warning: Invalid MAX_REQUESTS_PER_HOUR value '%s', using default: %d", val, config.MaxRequestsPerHour)
+		}
+	}
+	if val := getenv("MAX_REQUESTS_MODE"); val != "" {
+		config.MaxRequestsMode = val
+	}
+	if val := getenv("DEVICE_IDS"); val != "" {
 		config.DeviceIDs = val
 	}
+	if val := getenv("DEVICE_IDS_FILE"); val != "" {
+		config.DeviceIDsFile = val
+	}
+	if val := getenv("DEVICE_IDS_FILE_INTERVAL"); val != "" {
+		if parsed, err := time.ParseDuration(val); err == nil {
+			config.DeviceIDsFileInterval = parsed
+		} else {
+			log.Printf("Warning: Invalid DEVICE_IDS_FILE_INTERVAL value '%s', using default: %v", val, config.DeviceIDsFileInterval)
+		}
+	}
+	if val := getenv("DEVICE_PRIORITIES"); val != "" {
+		config.DevicePriorities = val
+	}
+	if val := getenv("DEVICE_NAMES"); val != "" {
+		config.DeviceNames = val
+	}
+	if val := getenv("DEVICE_BUDGETS"); val != "" {
+		config.DeviceBudgets = val
+	}
+	if val := getenv("METRIC_HELP"); val != "" {
+		config.MetricHelp = val
+	}
+	if val := getenv("EXTRA_LABELS"); val != "" {
+		config.ExtraLabels = val
+	}
+	if val := getenv("TIMEZONE"); val != "" {
+		config.Timezone = val
+	}
+	if val := getenv("DEVICE_METRICS"); val != "" {
+		config.DeviceMetrics = val
+	}
+	// DEVICE_REFRESH_INTERVAL is a deprecated alias of DEVICE_CACHE_TTL, which wins when both are set
+	for _, key := range []string{"DEVICE_REFRESH_INTERVAL", "DEVICE_CACHE_TTL"} {
+		if val := getenv(key); val != "" {
+			if key == "DEVICE_REFRESH_INTERVAL" {
+				log.Printf("Warning: DEVICE_REFRESH_INTERVAL is deprecated and only sets the device cache TTL; use DEVICE_CACHE_TTL")
+			}
+			if parsed, err := time.ParseDuration(val); err == nil {
+				config.DeviceCacheTTL = parsed
+			} else {
+				log.Printf("Warning: Invalid %s value '%s', using default: %v", key, val, config.DeviceCacheTTL)
+			}
+		}
+	}
+	if val := getenv("ENABLE_USAGE_COUNTER"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.EnableUsageCounter = parsed
+		} else {
+			log.Printf("Warning: Invalid ENABLE_USAGE_COUNTER value '%s', using default: %v", val, config.EnableUsageCounter)
+		}
+	}
+	if val := getenv("SPREAD_REQUESTS"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.SpreadRequests = parsed
+		} else {
+			log.Printf("Warning: Invalid SPREAD_REQUESTS value '%s', using default: %v", val, config.SpreadRequests)
+		}
+	}
+	if val := getenv("PUSHGATEWAY_URL"); val != "" {
+		config.PushgatewayURL = val
+	}
+	if val := getenv("PUSHGATEWAY_USERNAME"); val != "" {
+		config.PushgatewayUsername = val
+	}
+	if val := getenv("PUSHGATEWAY_PASSWORD"); val != "" {
+		config.PushgatewayPassword = val
+	}
+	if val := getenv("PUSHGATEWAY_JOB"); val != "" {
+		config.PushgatewayJob = val
+	}
+	if val := getenv("PUSHGATEWAY_INSTANCE"); val != "" {
+		config.PushgatewayInstance = val
+	}
+	if val := getenv("TEXTFILE_OUTPUT"); val != "" {
+		config.TextfileOutput = val
+	}
+	if val := getenv("INFLUXDB_URL"); val != "" {
+		config.InfluxDBURL = val
+	}
+	if val := getenv("INFLUXDB_TOKEN"); val != "" {
+		config.InfluxDBToken = val
+	}
+	if val := getenv("MQTT_BROKER"); val != "" {
+		config.MQTTBroker = val
+	}
+	if val := getenv("MQTT_USERNAME"); val != "" {
+		config.MQTTUsername = val
+	}
+	if val := getenv("MQTT_PASSWORD"); val != "" {
+		config.MQTTPassword = val
+	}
+	if val := getenv("MQTT_TOPIC_PREFIX"); val != "" {
+		config.MQTTTopicPrefix = val
+	}
+	if val := getenv("MQTT_FORMAT"); val != "" {
+		config.MQTTFormat = val
+	}
+	if val := getenv("MQTT_DISCOVERY"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.MQTTDiscovery = parsed
+		} else {
+			log.Printf("Warning: Invalid MQTT_DISCOVERY value '%s', using default: %v", val, config.MQTTDiscovery)
+		}
+	}
+	if val := getenv("MQTT_DISCOVERY_PREFIX"); val != "" {
+		config.MQTTDiscoveryPrefix = val
+	}
+	if val := getenv("OTLP_ENDPOINT"); val != "" {
+		config.OTLPEndpoint = val
+	}
+	if val := getenv("OTLP_INTERVAL"); val != "" {
+		if parsed, err := time.ParseDuration(val); err == nil && parsed > 0 {
+			config.OTLPInterval = parsed
+		} else {
+			log.Printf("Warning: Invalid OTLP_INTERVAL value '%s', using default: %v", val, config.OTLPInterval)
+		}
+	}
+	if val := getenv("DISABLE_HTTP_SERVER"); val != "" {
+		if parsed, err := strconv.ParseBool(val); err == nil {
+			config.DisableHTTPServer = parsed
+		} else {
+			log.Printf("Warning: Invalid DISABLE_HTTP_SERVER value '%s', using default: %v", val, config.DisableHTTPServer)
+		}
+	}
+	if val := getenv("ADMIN_TOKEN"); val != "" {
+		config.AdminToken = val
+	}
+	if val := getenv("SD_TARGET"); val != "" {
+		config.SDTarget = val
+	}
+	if val := getenv("SD_LABELS"); val != "" {
+		config.SDLabels = val
+	}
+	if val := getenv("DEBUG_LAST_RESPONSES"); val != "" {
+		if parsed, err := strconv.Atoi(val); err == nil && parsed >= 0 {
+			config.DebugLastResponses = parsed
+		} else {
+			log.Printf("Warning: Invalid DEBUG_LAST_RESPONSES value '%s', using default: %d", val, config.DebugLastResponses)
+		}
+	}
+}
+
+// validateConfig fills in demo and fixture mode defaults, checks required settings and parses derived fields
+func validateConfig(config *Config) error {
+	if config.Demo && config.FixturesDir != "" {
+		return fmt.Errorf("demo mode and fixture mode cannot be used together")
+	}
+
+	// Demo, fixture and quota validation mode do not talk to Flume, so credentials are optional
+	if config.Demo || config.FixturesDir != "" || config.ValidateOnlyQuota {
+		if config.FixturesDir != "" {
+			if info, err := os.Stat(config.FixturesDir); err != nil || !info.IsDir() {
+				return fmt.Errorf("fixtures directory '%s' does not exist or is not a directory", config.FixturesDir)
+			}
+		}
+		if config.ClientID == "" {
+			config.ClientID = "fixture-client"
+		}
+		if config.ClientSecret == "" {
+			config.ClientSecret = "fixture-secret"
+		}
+		// A refresh token replaces the username and password, which cannot be set alongside it
+		if config.RefreshToken == "" {
+			if config.Username == "" {
+				config.Username = "fixture@example.com"
+			}
+			if config.Password == "" {
+				config.Password = "fixture-password"
+			}
+		}
+	}
 
 	// Validate required configuration with helpful error messages
 	if config.ClientID == "" {
-		return nil, fmt.Errorf("client ID is required (set via --client-id flag or FLUME_CLIENT_ID env var)\n" +
+		return fmt.Errorf("client ID is required (set via --client-id flag or FLUME_CLIENT_ID env var)\n" +
 			"Get your API credentials from: https://portal.flumewater.com/ -> Settings -> Generate API Client")
 	}
 	if config.ClientSecret == "" {
-		return nil, fmt.Errorf("client secret is required (set via --client-secret flag or FLUME_CLIENT_SECRET env var)\n" +
+		return fmt.Errorf("client secret is required (set via --client-secret flag or FLUME_CLIENT_SECRET env var)\n" +
 			"Get your API credentials from: https://portal.flumewater.com/ -> Settings -> Generate API Client")
 	}
-	if config.Username == "" {
-		return nil, fmt.Errorf("email address is required (set via --username flag or FLUME_USERNAME env var)\n" +
+	if config.Password != "" && config.RefreshToken != "" {
+		return fmt.Errorf("password and refresh token cannot both be set; use one of --password and --refresh-token")
+	}
+	if config.Password == "" && config.RefreshToken == "" {
+		return fmt.Errorf("password or refresh token is required (set via --password flag or FLUME_PASSWORD env var,\n" +
+			"or --refresh-token flag or FLUME_REFRESH_TOKEN env var to run without storing your password)")
+	}
+	if config.Username == "" && config.Password != "" {
+		return fmt.Errorf("email address is required (set via --username flag or FLUME_USERNAME env var)\n" +
 			"This should be the email address you use to log into your Flume account")
 	}
-	if config.Password == "" {
-		return nil, fmt.Errorf("password is required (set via --password flag or FLUME_PASSWORD env var)\n" +
-			"This should be the password for your Flume account")
+	if config.DeviceIDsFile != "" {
+		if config.DeviceIDs != "" {
+			return fmt.Errorf("device IDs can be set via --device-ids/DEVICE_IDS or --device-ids-file/DEVICE_IDS_FILE, not both")
+		}
+		ids, err := readDeviceIDsFile(config.DeviceIDsFile)
+		if err != nil {
+			return err
+		}
+		config.DeviceIDs = strings.Join(ids, ",")
 	}
 
-	return config, nil
+	families, err := parseDeviceMetrics(config.DeviceMetrics)
+	if err != nil {
+		return err
+	}
+	config.DeviceMetricFamilies = families
+
+	pins, err := parseSPKIPins(config.TLSPins)
+	if err != nil {
+		return err
+	}
+	config.TLSPinBytes = pins
+
+	if config.CACertFile != "" {
+		pool, err := loadCACertPool(config.CACertFile)
+		if err != nil {
+			return err
+		}
+		config.CACertPool = pool
+	}
+	if config.InsecureSkipVerify && (len(config.TLSPinBytes) > 0 || config.CACertFile != "") {
+		return fmt.Errorf("insecure-skip-verify cannot be combined with tls-pins or ca-cert-file")
+	}
+
+	names, err := parseDeviceNames(config.DeviceNames)
+	if err != nil {
+		return err
+	}
+	config.DeviceNameOverrides = names
+
+	budgets, err := parseDeviceBudgets(config.DeviceBudgets)
+	if err != nil {
+		return err
+	}
+	config.DeviceBudgetGallons = budgets
+	for deviceID := range budgets {
+		if !config.CollectsMetricFamily(deviceID, MetricFamilyToday) {
+			log.Printf("Warning: device %s has a daily budget but not the today metric family, so no budget ratio is reported", deviceID)
+		}
+	}
+
+	helpSuffixes, err := parseMetricHelp(config.MetricHelp)
+	if err != nil {
+		return err
+	}
+	config.MetricHelpSuffixes = helpSuffixes
+
+	if config.Timezone != "" {
+		location, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone '%s': %w", config.Timezone, err)
+		}
+		config.Location = location
+	}
+
+	extraLabels, err := parseExtraLabels(config.ExtraLabels)
+	if err != nil {
+		return err
+	}
+	if err := checkReservedLabels(extraLabels); err != nil {
+		return err
+	}
+	config.ExtraLabelSet = extraLabels
+
+	if err := validateListenAddress(config.ListenAddress); err != nil {
+		return err
+	}
+
+	if config.SDTarget != "" {
+		if config.AdminToken == "" {
+			return fmt.Errorf("the /targets endpoint requires an admin token (set --admin-token or ADMIN_TOKEN)")
+		}
+		if _, _, err := net.SplitHostPort(config.SDTarget); err != nil {
+			return fmt.Errorf("invalid service discovery target '%s' (expected host:port): %w", config.SDTarget, err)
+		}
+	}
+	if config.DebugLastResponses > 0 {
+		if config.AdminToken == "" {
+			return fmt.Errorf("the /debug/last-responses endpoint requires an admin token (set --admin-token or ADMIN_TOKEN)")
+		}
+		if config.DebugLastResponses > maxDebugLastResponses {
+			return fmt.Errorf("debug last responses must be at most %d, got %d", maxDebugLastResponses, config.DebugLastResponses)
+		}
+	}
+
+	sdLabels, err := parseExtraLabels(config.SDLabels)
+	if err == nil {
+		err = checkReservedLabels(sdLabels)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid service discovery labels: %w", err)
+	}
+	config.SDLabelSet = sdLabels
+
+	if !strings.HasPrefix(config.MetricsPath, "/") {
+		config.MetricsPath = "/" + config.MetricsPath
+	}
+	if reservedPaths[config.MetricsPath] {
+		return fmt.Errorf("metrics path '%s' conflicts with a built-in endpoint (set a different --metrics-path or METRICS_PATH)", config.MetricsPath)
+	}
+	aliases, err := parseMetricsPathAliases(config.MetricsPathAliases, config.MetricsPath)
+	if err != nil {
+		return err
+	}
+	config.MetricsPathAliasesList = aliases
+
+	if floor := quotaScrapeInterval(1); config.MinScrapeInterval < floor {
+		return fmt.Errorf("min scrape interval (%s) must be at least %s, the interval that keeps a single device within Flume's %d requests/hour limit", config.MinScrapeInterval, floor, flumeRequestsPerHourLimit)
+	}
+	if config.MaxScrapeInterval < config.MinScrapeInterval {
+		return fmt.Errorf("max scrape interval (%s) must not be below min scrape interval (%s)", config.MaxScrapeInterval, config.MinScrapeInterval)
+	}
+
+	if config.InitialBackfillDays < dailyTotalLookbackDays || config.InitialBackfillDays > maxInitialBackfillDays {
+		return fmt.Errorf("initial backfill days must be between %d and %d, got %d", dailyTotalLookbackDays, maxInitialBackfillDays, config.InitialBackfillDays)
+	}
+
+	if config.OAuthAuthStyle != OAuthAuthStyleBody && config.OAuthAuthStyle != OAuthAuthStyleHeader {
+		return fmt.Errorf("invalid OAuth auth style '%s' (expected %s or %s)", config.OAuthAuthStyle, OAuthAuthStyleBody, OAuthAuthStyleHeader)
+	}
+	if config.MaxRequestsMode != RequestBudgetBlock && config.MaxRequestsMode != RequestBudgetSkip {
+		return fmt.Errorf("invalid max requests mode '%s' (expected %s or %s)", config.MaxRequestsMode, RequestBudgetBlock, RequestBudgetSkip)
+	}
+
+	if config.StaleMetricsPolicy != StaleMetricsFreeze && config.StaleMetricsPolicy != StaleMetricsFlag {
+		return fmt.Errorf("invalid stale metrics policy '%s' (expected %s or %s)", config.StaleMetricsPolicy, StaleMetricsFreeze, StaleMetricsFlag)
+	}
+
+	if config.OTLPEndpoint != "" && config.OTLPInterval <= 0 {
+		return fmt.Errorf("OTLP interval must be positive, got %s", config.OTLPInterval)
+	}
+
+	if config.MQTTBroker != "" {
+		if _, _, err := parseMQTTBroker(config.MQTTBroker); err != nil {
+			return err
+		}
+		if config.MQTTFormat != MQTTFormatJSON && config.MQTTFormat != MQTTFormatPlain {
+			return fmt.Errorf("invalid MQTT format '%s' (expected %s or %s)", config.MQTTFormat, MQTTFormatJSON, MQTTFormatPlain)
+		}
+		if strings.ContainsAny(config.MQTTTopicPrefix, "+#") || strings.Trim(config.MQTTTopicPrefix, "/") == "" {
+			return fmt.Errorf("invalid MQTT topic prefix '%s' (must be non-empty and contain no + or # wildcards)", config.MQTTTopicPrefix)
+		}
+	}
+
+	if config.DisableHTTPServer && config.PushgatewayURL == "" && config.TextfileOutput == "" && config.OTLPEndpoint == "" && config.InfluxDBURL == "" && config.MQTTBroker == "" {
+		return fmt.Errorf("the HTTP server can only be disabled when push, textfile, OTLP, InfluxDB or MQTT mode is enabled (set --pushgateway-url/PUSHGATEWAY_URL, --textfile-output/TEXTFILE_OUTPUT, --otlp-endpoint/OTLP_ENDPOINT, --influxdb-url/INFLUXDB_URL or --mqtt-broker/MQTT_BROKER)")
+	}
+
+	return nil
+}
+
+// reservedPaths are served by built-in handlers and cannot be used as the metrics path
+var reservedPaths = map[string]bool{
+	"/":                     true,
+	"/health":               true,
+	"/health/detailed":      true,
+	"/admin/devices":        true,
+	"/admin/usage":          true,
+	"/export.csv":           true,
+	"/targets":              true,
+	"/debug/last-responses": true,
+}
+
+// parseMetricsPathAliases parses comma-separated metrics path aliases, adding a missing leading /
+// Aliases must be plain paths that differ from the metrics path, the built-in endpoints and each other
+func parseMetricsPathAliases(value, metricsPath string) ([]string, error) {
+	var aliases []string
+	seen := map[string]bool{metricsPath: true}
+	for _, alias := range strings.Split(value, ",") {
+		alias = strings.TrimSpace(alias)
+		if alias == "" {
+			continue
+		}
+		if !strings.HasPrefix(alias, "/") {
+			alias = "/" + alias
+		}
+		if alias == "/" || strings.HasSuffix(alias, "/") || path.Clean(alias) != alias || strings.ContainsAny(alias, " ?#{}") {
+			return nil, fmt.Errorf("invalid metrics path alias '%s' (expected a path like /prometheus without a trailing /)", alias)
+		}
+		if reservedPaths[alias] {
+			return nil, fmt.Errorf("metrics path alias '%s' conflicts with a built-in endpoint", alias)
+		}
+		if seen[alias] {
+			return nil, fmt.Errorf("metrics path alias '%s' is configured more than once or equals the metrics path", alias)
+		}
+		seen[alias] = true
+		aliases = append(aliases, alias)
+	}
+	return aliases, nil
+}
+
+// validateListenAddress checks that the listen address is a host:port or :port with a valid port
+func validateListenAddress(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid listen address '%s' (expected host:port or :port, e.g. :9193): %w", address, err)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("invalid port in listen address '%s': %w", address, err)
+	}
+	return nil
+}
+
+// Metric families that can be enabled per device
+const (
+	MetricFamilyFlowRate   = "flow_rate"
+	MetricFamilyDailyTotal = "daily_total"
+	MetricFamilyHourly     = "hourly"
+	MetricFamilyYearly     = "yearly"
+	MetricFamilyToday      = "today"
+)
+
+// parseDeviceMetrics parses comma-separated device_id:family|family entries
+func parseDeviceMetrics(value string) (map[string]map[string]bool, error) {
+	families := make(map[string]map[string]bool)
+	if value == "" {
+		return families, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid device metrics entry '%s' (expected device_id:family|family)", entry)
+		}
+
+		deviceID := strings.TrimSpace(parts[0])
+		families[deviceID] = make(map[string]bool)
+		for _, family := range strings.Split(parts[1], "|") {
+			family = strings.TrimSpace(family)
+			switch family {
+			case MetricFamilyFlowRate, MetricFamilyDailyTotal, MetricFamilyHourly, MetricFamilyYearly, MetricFamilyToday:
+				families[deviceID][family] = true
+			case "":
+			default:
+				return nil, fmt.Errorf("unknown metric family '%s' for device %s (valid: flow_rate, daily_total, hourly, yearly, today)", family, deviceID)
+			}
+		}
+	}
+
+	return families, nil
+}
+
+// parseDeviceNames parses comma-separated device_id=name pairs
+func parseDeviceNames(value string) (map[string]string, error) {
+	names := make(map[string]string)
+	if value == "" {
+		return names, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid device name entry '%s' (expected device_id=name)", entry)
+		}
+		names[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return names, nil
+}
+
+// parseDeviceBudgets parses comma-separated device_id=gallons daily budgets
+func parseDeviceBudgets(value string) (map[string]float64, error) {
+	budgets := make(map[string]float64)
+	if value == "" {
+		return budgets, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid device budget entry '%s' (expected device_id=gallons)", entry)
+		}
+		gallons, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || gallons <= 0 {
+			return nil, fmt.Errorf("invalid daily budget '%s' for device %s (expected a positive number of gallons)", strings.TrimSpace(parts[1]), strings.TrimSpace(parts[0]))
+		}
+		budgets[strings.TrimSpace(parts[0])] = gallons
+	}
+
+	return budgets, nil
+}
+
+// parseMetricHelp parses semicolon-separated metric_name=text pairs; semicolons separate entries so the
+// text can contain commas
+func parseMetricHelp(value string) (map[string]string, error) {
+	help := make(map[string]string)
+	if value == "" {
+		return help, nil
+	}
+
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid metric help entry '%s' (expected metric_name=text)", entry)
+		}
+		name, text := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if !utf8.ValidString(text) {
+			return nil, fmt.Errorf("metric help for '%s' is not valid UTF-8", name)
+		}
+		help[name] = text
+	}
+
+	return help, nil
+}
+
+// labelNamePattern matches valid Prometheus label names
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseExtraLabels parses comma-separated key=value static labels, checking names against Prometheus rules
+func parseExtraLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if value == "" {
+		return labels, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid extra label '%s' (expected name=value with a non-empty value)", entry)
+		}
+		name, labelValue := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid extra label name '%s' (must match [a-zA-Z_][a-zA-Z0-9_]* and not start with __)", name)
+		}
+		if !utf8.ValidString(labelValue) {
+			return nil, fmt.Errorf("extra label '%s' has a value that is not valid UTF-8", name)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("extra label '%s' is set more than once", name)
+		}
+		labels[name] = labelValue
+	}
+
+	return labels, nil
+}
+
+// TimeLocation returns the time zone for day boundaries and reading times: Location, or the process time zone
+func (c *Config) TimeLocation() *time.Location {
+	if c.Location != nil {
+		return c.Location
+	}
+	return time.Local
+}
+
+// checkReservedLabels rejects static labels whose names the exporter's metrics already use (see reservedLabelNames)
+func checkReservedLabels(labels map[string]string) error {
+	for name := range labels {
+		if reservedLabelNames[name] {
+			return fmt.Errorf("extra label name '%s' is already used by the exporter's metrics", name)
+		}
+	}
+	return nil
+}
+
+// DeviceName returns the device_name label for a device: the configured override,
+// then the device name set in the Flume app, the Flume location name and finally the device ID
+func (c *Config) DeviceName(device Device) string {
+	if name, ok := c.DeviceNameOverrides[device.ID]; ok {
+		return name
+	}
+	if name := strings.TrimSpace(device.Name); name != "" {
+		return name
+	}
+	if device.Location.Name != "" {
+		return device.Location.Name
+	}
+	return device.ID
+}
+
+// CollectsMetricFamily reports whether a metric family should be collected for a device
+// Unlisted devices collect flow_rate, daily_total and yearly (at most once a day); hourly usage costs an extra request
+// per cycle and is only collected for devices that list it explicitly
+func (c *Config) CollectsMetricFamily(deviceID, family string) bool {
+	families, ok := c.DeviceMetricFamilies[deviceID]
+	if !ok {
+		// Hourly and today's usage cost a request every cycle, so they must be enabled explicitly
+		return family != MetricFamilyHourly && family != MetricFamilyToday
+	}
+	return families[family]
+}
+
+// flumeRequestsPerHourLimit is Flume's documented API rate limit
+const flumeRequestsPerHourLimit = 120
+
+// dailyTotalLookbackDays is how many days of daily totals each scheduled collection queries
+const dailyTotalLookbackDays = 30
+
+// maxInitialBackfillDays bounds the initial backfill to one year of daily readings in a single query
+const maxInitialBackfillDays = 365
+
+// scrapeQuotaTargetPerHour is the request rate the calculated scrape interval aims for: 95% of Flume's limit,
+// leaving headroom for requests not counted by requestsPerScrape
+const scrapeQuotaTargetPerHour = flumeRequestsPerHourLimit * 95 / 100
+
+// requestsPerScrape estimates the API requests made by one collection cycle: one flow rate query per device
+// The device list and user ID are cached for DeviceCacheTTL and daily totals are collected about twice a day,
+// so their share per scrape is small and covered by the margin below Flume's limit, like retries are
+func requestsPerScrape(deviceCount int) int {
+	return deviceCount
+}
+
+// EstimatedRequestsPerHour estimates the hourly API request rate at the given device count and scrape interval
+func (c *Config) EstimatedRequestsPerHour(deviceCount int, interval time.Duration) float64 {
+	if interval <= 0 {
+		return 0
+	}
+	return float64(requestsPerScrape(deviceCount)) * float64(time.Hour) / float64(interval)
+}
+
+// quotaScrapeInterval returns the shortest scrape interval, in whole seconds, that keeps deviceCount devices
+// within scrapeQuotaTargetPerHour
+func quotaScrapeInterval(deviceCount int) time.Duration {
+	requests := requestsPerScrape(deviceCount)
+	seconds := (requests*3600 + scrapeQuotaTargetPerHour - 1) / scrapeQuotaTargetPerHour
+	return time.Duration(seconds) * time.Second
 }
 
 // calculateOptimalScrapeInterval determines the optimal scrape interval based on device count
-// to stay under Flume's 120 requests/hour limit
+// to stay within 95% of Flume's 120 requests/hour limit
 func (c *Config) calculateOptimalScrapeInterval(deviceCount int) time.Duration {
-	// Base requests per scrape: 1 (get devices) + deviceCount (flow rate) + deviceCount (daily total when scheduled)
-	// Daily total is collected ~2x per day, so average per scrape is minimal
-	baseRequestsPerScrape := 1 + deviceCount
-
-	// Target: stay under 120 requests/hour
-	// Formula: interval = 3600 seconds / (120 / baseRequestsPerScrape)
-	// Simplified: interval = 30 * baseRequestsPerScrape seconds
-	optimalIntervalSeconds := 30 * baseRequestsPerScrape
-
-	// Convert to time.Duration
-	optimalInterval := time.Duration(optimalIntervalSeconds) * time.Second
-
-	// Ensure minimum interval of 2 minutes and maximum of 10 minutes
-	// 2 minutes provides safer margin below rate limit for all device counts
-	if optimalInterval < 2*time.Minute {
-		optimalInterval = 2 * time.Minute
-	} else if optimalInterval > 10*time.Minute {
-		optimalInterval = 10 * time.Minute
+	quotaInterval := quotaScrapeInterval(deviceCount)
+
+	// Keep the interval within the configured bounds, 2 and 10 minutes by default
+	// The 2 minute floor provides a wider margin below the rate limit for small device counts
+	optimalInterval := quotaInterval
+	if optimalInterval < c.MinScrapeInterval {
+		optimalInterval = c.MinScrapeInterval
+	} else if optimalInterval > c.MaxScrapeInterval {
+		optimalInterval = c.MaxScrapeInterval
+	}
+
+	// The ceiling never forces an interval that would exceed the hourly limit
+	if optimalInterval < quotaInterval {
+		optimalInterval = quotaInterval
 	}
 
 	return optimalInterval
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExtraLabels(t *testing.T) {
+	labels, err := parseExtraLabels(" site=home , env = prod,,")
+	if err != nil {
+		t.Fatalf("parseExtraLabels: %v", err)
+	}
+	if len(labels) != 2 || labels["site"] != "home" || labels["env"] != "prod" {
+		t.Errorf("labels = %v, want site=home and env=prod", labels)
+	}
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"site", "expected name=value"},
+		{"site=", "expected name=value"},
+		{"1site=home", "invalid extra label name"},
+		{"__site=home", "invalid extra label name"},
+		{"site-name=home", "invalid extra label name"},
+		{"site=home,site=cabin", "set more than once"},
+		{"site=\xff", "not valid UTF-8"},
+	}
+	for _, tt := range tests {
+		_, err := parseExtraLabels(tt.value)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseExtraLabels(%q) = %v, want an error containing %q", tt.value, err, tt.want)
+		}
+	}
+}
+
+func TestValidateConfigRejectsReservedLabels(t *testing.T) {
+	for _, tt := range []struct {
+		extraLabels, sdLabels string
+	}{
+		{extraLabels: "device_id=d1"},
+		{extraLabels: "site=home,reason=gap"},
+		{sdLabels: "partial=true"},
+	} {
+		config := NewConfig()
+		config.Demo = true
+		config.ExtraLabels = tt.extraLabels
+		config.SDLabels = tt.sdLabels
+		err := validateConfig(config)
+		if err == nil || !strings.Contains(err.Error(), "already used by the exporter's metrics") {
+			t.Errorf("validateConfig with extra labels %q and SD labels %q = %v, want a reserved label error", tt.extraLabels, tt.sdLabels, err)
+		}
+	}
+
+	config := NewConfig()
+	config.Demo = true
+	config.ExtraLabels = "site=home"
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("validateConfig: %v", err)
+	}
+	if config.ExtraLabelSet["site"] != "home" {
+		t.Errorf("extra labels = %v, want site=home", config.ExtraLabelSet)
+	}
+}
+
+func TestValidateConfigRejectsMinScrapeIntervalBelowQuota(t *testing.T) {
+	config := NewConfig()
+	config.Demo = true
+	config.MinScrapeInterval = 30 * time.Second
+	if err := validateConfig(config); err == nil || !strings.Contains(err.Error(), "must be at least 32s") {
+		t.Errorf("validateConfig with a 30s min scrape interval = %v, want an error naming the 32s floor", err)
+	}
+
+	config = NewConfig()
+	config.Demo = true
+	config.MinScrapeInterval = 32 * time.Second
+	if err := validateConfig(config); err != nil {
+		t.Errorf("validateConfig with a 32s min scrape interval: %v", err)
+	}
+}
+
+func TestDeviceName(t *testing.T) {
+	names, err := parseDeviceNames("d1=Kitchen, d2 = Garden ")
+	if err != nil {
+		t.Fatalf("parseDeviceNames: %v", err)
+	}
+	config := &Config{DeviceNameOverrides: names}
+
+	device := func(id, name, location string) Device {
+		d := Device{ID: id, Name: name}
+		d.Location.Name = location
+		return d
+	}
+	tests := []struct {
+		device Device
+		want   string
+	}{
+		{device("d1", "Main", "Home"), "Kitchen"},
+		{device("d2", "", ""), "Garden"},
+		{device("d3", "Main", "Home"), "Main"},
+		{device("d3", "  ", "Home"), "Home"},
+		{device("d3", "", ""), "d3"},
+	}
+	for _, tt := range tests {
+		if got := config.DeviceName(tt.device); got != tt.want {
+			t.Errorf("DeviceName(%+v) = %q, want %q", tt.device, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"d1", "d1=", "=Kitchen"} {
+		if _, err := parseDeviceNames(value); err == nil {
+			t.Errorf("parseDeviceNames(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestCalculateOptimalScrapeInterval(t *testing.T) {
+	// 95% of Flume's hourly limit allows one flow rate request per device every 3600/114 seconds, rounded up
+	tests := []struct {
+		name     string
+		min, max time.Duration
+		devices  int
+		want     time.Duration
+	}{
+		{"defaults, one device", 2 * time.Minute, 10 * time.Minute, 1, 2 * time.Minute},
+		{"defaults, five devices", 2 * time.Minute, 10 * time.Minute, 5, 2*time.Minute + 38*time.Second},
+		{"defaults, past the ceiling", 2 * time.Minute, 10 * time.Minute, 30, 15*time.Minute + 48*time.Second},
+		{"lowest floor", 32 * time.Second, 5 * time.Minute, 1, 32 * time.Second},
+		{"floor below the limit", 32 * time.Second, 5 * time.Minute, 3, 95 * time.Second},
+		{"higher floor", 5 * time.Minute, 20 * time.Minute, 3, 5 * time.Minute},
+		{"ceiling below the limit", 40 * time.Second, time.Minute, 3, 95 * time.Second},
+		{"ceiling", 40 * time.Second, 64 * time.Second, 2, 64 * time.Second},
+	}
+	for _, tt := range tests {
+		config := NewConfig()
+		config.MinScrapeInterval = tt.min
+		config.MaxScrapeInterval = tt.max
+		if got := config.calculateOptimalScrapeInterval(tt.devices); got != tt.want {
+			t.Errorf("%s: interval = %s, want %s", tt.name, got, tt.want)
+		}
+		if got := config.GetScrapeInterval(tt.devices); got != tt.want {
+			t.Errorf("%s: GetScrapeInterval = %s, want the optimal %s", tt.name, got, tt.want)
+		}
+	}
+
+	// A configured scrape interval is used as is
+	config := NewConfig()
+	config.ScrapeInterval = 45 * time.Second
+	if got := config.GetScrapeInterval(5); got != 45*time.Second {
+		t.Errorf("GetScrapeInterval with a configured interval = %s, want 45s", got)
+	}
+}
+
+func TestDeviceRefreshIntervalAlias(t *testing.T) {
+	tests := []struct {
+		env  map[string]string
+		want time.Duration
+	}{
+		{map[string]string{"DEVICE_REFRESH_INTERVAL": "15m"}, 15 * time.Minute},
+		{map[string]string{"DEVICE_CACHE_TTL": "20m"}, 20 * time.Minute},
+		// The deprecated alias never overrides the current name
+		{map[string]string{"DEVICE_REFRESH_INTERVAL": "15m", "DEVICE_CACHE_TTL": "20m"}, 20 * time.Minute},
+	}
+	for _, tt := range tests {
+		config := NewConfig()
+		applyEnvOverrides(config, func(key string) string { return tt.env[key] })
+		if config.DeviceCacheTTL != tt.want {
+			t.Errorf("device cache TTL with %v = %s, want %s", tt.env, config.DeviceCacheTTL, tt.want)
+		}
+	}
+}
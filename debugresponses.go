@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// maxDebugLastResponses bounds the number of raw responses kept for /debug/last-responses
+const maxDebugLastResponses = 100
+
+// maxDebugBodyBytes bounds the body kept for each raw response
+const maxDebugBodyBytes = 4096
+
+// DebugResponse is one raw Flume API response kept for /debug/last-responses
+type DebugResponse struct {
+	Time      time.Time `json:"time"`
+	Endpoint  string    `json:"endpoint"`
+	RequestID string    `json:"request_id"`
+	Status    int       `json:"status,omitempty"`
+	Body      string    `json:"body,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// responseRing keeps the last raw API responses in a fixed-size ring buffer
+// A nil ring records nothing, so callers need not check whether debugging is enabled
+type responseRing struct {
+	mutex   sync.Mutex
+	entries []DebugResponse
+	next    int
+	full    bool
+}
+
+// newResponseRing creates a ring holding the last size responses
+func newResponseRing(size int) *responseRing {
+	return &responseRing{entries: make([]DebugResponse, size)}
+}
+
+// add stores an entry, overwriting the oldest once the ring is full
+func (r *responseRing) add(entry DebugResponse) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// addError records a request that failed before a response arrived
+func (r *responseRing) addError(endpoint, requestID string, err error) {
+	if r == nil {
+		return
+	}
+	r.add(DebugResponse{Time: time.Now(), Endpoint: endpoint, RequestID: requestID, Error: redactSecrets(err.Error())})
+}
+
+// capture wraps the response body so the first maxDebugBodyBytes read by the caller are recorded
+// when the body is closed; the caller reads the body exactly as before
+func (r *responseRing) capture(endpoint, requestID string, resp *http.Response) {
+	if r == nil {
+		return
+	}
+	resp.Body = &capturingBody{
+		ReadCloser: resp.Body,
+		ring:       r,
+		entry:      DebugResponse{Time: time.Now(), Endpoint: endpoint, RequestID: requestID, Status: resp.StatusCode},
+	}
+}
+
+// Snapshot returns the stored responses, newest first
+func (r *responseRing) Snapshot() []DebugResponse {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	count := r.next
+	if r.full {
+		count = len(r.entries)
+	}
+	snapshot := make([]DebugResponse, 0, count)
+	for i := 1; i <= count; i++ {
+		snapshot = append(snapshot, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return snapshot
+}
+
+// capturingBody records the start of a response body as it is read, adding it to the ring on Close
+type capturingBody struct {
+	io.ReadCloser
+	ring   *responseRing
+	entry  DebugResponse
+	body   []byte
+	closed bool
+}
+
+// Read reads from the response body, keeping up to maxDebugBodyBytes
+func (b *capturingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	keep := max(min(n, maxDebugBodyBytes-len(b.body)), 0)
+	b.body = append(b.body, p[:keep]...)
+	if keep < n {
+		b.entry.Truncated = true
+	}
+	return n, err
+}
+
+// Close closes the response body and records the captured response once
+func (b *capturingBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		b.entry.Body = redactSecrets(string(b.body))
+		b.ring.add(b.entry)
+	}
+	return b.ReadCloser.Close()
+}
+
+// secretFieldPattern matches JSON string fields that carry credentials or tokens, including a value cut off by truncation
+var secretFieldPattern = regexp.MustCompile(`"(access_token|refresh_token|id_token|password|client_secret)"\s*:\s*"[^"]*"?`)
+
+// bearerPattern matches bearer tokens echoed in error messages
+var bearerPattern = regexp.MustCompile(`(?i)bearer\s+[A-Za-z0-9._~+/=-]+`)
+
+// redactSecrets replaces tokens and credentials in a response body or error message
+func redactSecrets(text string) string {
+	text = secretFieldPattern.ReplaceAllString(text, `"$1":"[REDACTED]"`)
+	return bearerPattern.ReplaceAllString(text, "Bearer [REDACTED]")
+}
+
+// lastResponsesHandler serves the last raw Flume API responses as JSON, newest first
+func lastResponsesHandler(client *FlumeClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		jsonData, _ := json.MarshalIndent(client.lastResponses.Snapshot(), "", "  ")
+		w.Write(jsonData)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// readDeviceIDsFile reads device IDs from path, one per line
+// Blank lines and # comments are ignored; invalid lines are logged with their line number and skipped
+func readDeviceIDsFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device IDs file: %w", err)
+	}
+	defer file.Close()
+
+	var ids []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		id := strings.TrimSpace(line)
+		if id == "" {
+			continue
+		}
+		if strings.ContainsAny(id, ", \t") {
+			log.Printf("Warning: Invalid device ID on line %d of %s: '%s' (expected one ID per line), skipping", lineNumber, path, id)
+			continue
+		}
+		if seen[id] {
+			log.Printf("Warning: Duplicate device ID '%s' on line %d of %s, skipping", id, lineNumber, path)
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read device IDs file: %w", err)
+	}
+
+	return ids, nil
+}
+
+// WatchDeviceIDsFile checks the device IDs file every interval until the exporter stops, re-reading it
+// when its modification time or size changes and applying the new device filter if its IDs changed
+func (e *FlumeExporter) WatchDeviceIDsFile(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastModTime time.Time
+	var lastSize int64
+	if info, err := os.Stat(path); err == nil {
+		lastModTime, lastSize = info.ModTime(), info.Size()
+	}
+
+	for {
+		select {
+		case <-e.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			// Report a missing file once; it is read again as soon as it reappears
+			if lastSize >= 0 {
+				log.Printf("Error checking device IDs file, keeping current device filter: %v", err)
+				lastModTime, lastSize = time.Time{}, -1
+			}
+			continue
+		}
+		if info.ModTime().Equal(lastModTime) && info.Size() == lastSize {
+			continue
+		}
+		lastModTime, lastSize = info.ModTime(), info.Size()
+		e.reloadDeviceIDsFile(path)
+	}
+}
+
+// reloadDeviceIDsFile applies the IDs currently in the device IDs file as the device filter
+// A file that cannot be read leaves the current filter in place
+func (e *FlumeExporter) reloadDeviceIDsFile(path string) {
+	ids, err := readDeviceIDsFile(path)
+	if err != nil {
+		log.Printf("Error reloading device IDs file, keeping current device filter: %v", err)
+		return
+	}
+	deviceIDs := strings.Join(ids, ",")
+
+	// Wait for running cycles so they never see the filter change halfway through
+	e.collectionMutex.Lock()
+	defer e.collectionMutex.Unlock()
+	e.usageMutex.Lock()
+	defer e.usageMutex.Unlock()
+
+	current := e.config.Load()
+	if deviceIDs == current.DeviceIDs {
+		return
+	}
+	log.Printf("Device IDs file changed: device IDs changed from '%s' to '%s'", current.DeviceIDs, deviceIDs)
+	updated := *current
+	updated.DeviceIDs = deviceIDs
+	e.config.Store(&updated)
+	e.pruneExcludedDevices()
+}
+
+// pruneExcludedDevices removes the metrics of known devices that the device filter no longer selects
+// Callers must hold the collection mutexes
+func (e *FlumeExporter) pruneExcludedDevices() {
+	pruned := false
+	for _, deviceID := range e.knownDevices() {
+		if e.shouldProcessDevice(deviceID) {
+			continue
+		}
+		if e.forgetDevice(deviceID) {
+			log.Printf("Removed metrics for device %s (no longer in the device filter)", deviceID)
+			pruned = true
+		}
+	}
+
+	// Drop the removed series from the served snapshot without waiting for the next cycle
+	if pruned {
+		e.metrics.PublishSnapshot()
+	}
+}
+
+// handleDeviceListChange logs devices that appeared on or disappeared from the account since the previous
+// cycle and removes the metrics of the disappeared ones, so their series do not linger
+func (e *FlumeExporter) handleDeviceListChange(added, removed []string) {
+	log.Printf("Device list changed: added=[%s] removed=[%s]", strings.Join(added, ","), strings.Join(removed, ","))
+	e.metrics.RecordDeviceListChange()
+
+	for _, deviceID := range removed {
+		if e.forgetDevice(deviceID) {
+			log.Printf("Removed metrics for device %s (no longer on the account)", deviceID)
+		}
+	}
+}
+
+// forgetDevice removes a device's metrics and per-device collection state, reporting whether any series existed
+func (e *FlumeExporter) forgetDevice(deviceID string) bool {
+	deleted := e.metrics.DeleteDeviceMetrics(deviceID)
+
+	e.yearlyCollectionMutex.Lock()
+	delete(e.lastYearlyCollection, deviceID)
+	e.yearlyCollectionMutex.Unlock()
+
+	e.lastFlowRateMutex.Lock()
+	delete(e.lastFlowRates, deviceID)
+	delete(e.lastReadings, deviceID)
+	e.lastFlowRateMutex.Unlock()
+
+	e.forgetAccountValues(deviceID)
+
+	return deleted
+}
+
+// disambiguateLocations returns a copy of devices in which location names shared by more than one
+// processed sensor carry the device ID, e.g. "Home (1234)", when DisambiguateLocations is set
+// Bridges usually share their sensor's location and never count as a duplicate
+// A device whose location label changes has its old series removed, so no panel shows both
+func (e *FlumeExporter) disambiguateLocations(devices []Device) []Device {
+	if !e.config.Load().DisambiguateLocations {
+		return devices
+	}
+
+	counts := make(map[string]int)
+	for _, device := range devices {
+		if device.Location.Name != "" && device.Type != 1 && e.shouldProcessDevice(device.ID) {
+			counts[device.Location.Name]++
+		}
+	}
+
+	labeled := make([]Device, len(devices))
+	copy(labeled, devices)
+
+	e.lastCycleMutex.Lock()
+	defer e.lastCycleMutex.Unlock()
+	if e.locationLabels == nil {
+		e.locationLabels = make(map[string]string)
+	}
+	for i := range labeled {
+		device := &labeled[i]
+		if counts[device.Location.Name] > 1 && device.Type != 1 && e.shouldProcessDevice(device.ID) {
+			device.Location.Name = fmt.Sprintf("%s (%s)", device.Location.Name, device.ID)
+		}
+		if previous, ok := e.locationLabels[device.ID]; ok && previous != device.Location.Name {
+			log.Printf("Location label of device %s changed from '%s' to '%s', removing its old series", device.ID, previous, device.Location.Name)
+			e.forgetDevice(device.ID)
+		}
+		e.locationLabels[device.ID] = device.Location.Name
+	}
+	return labeled
+}
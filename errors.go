@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// ErrorClass is a small, bounded classification of Flume API errors
+// Used as a metric label value, so new classes must be added sparingly
+type ErrorClass string
+
+const (
+	ErrorClassTimeout      ErrorClass = "timeout"
+	ErrorClassUnauthorized ErrorClass = "unauthorized"
+	ErrorClassRateLimited  ErrorClass = "rate_limited"
+	ErrorClassDecodeError  ErrorClass = "decode_error"
+	ErrorClassServerError  ErrorClass = "server_error"
+)
+
+// ErrServiceUnavailable is wrapped by errors for Flume maintenance responses: a 503 or a 2xx HTML page
+var ErrServiceUnavailable = errors.New("flume API unavailable")
+
+// ErrRequestBudgetExhausted is wrapped by errors for requests skipped because the hourly request cap was reached
+var ErrRequestBudgetExhausted = errors.New("hourly request budget exhausted")
+
+// errorClasses lists every ErrorClass so metrics can reset the ones that do not apply
+var errorClasses = []ErrorClass{
+	ErrorClassTimeout,
+	ErrorClassUnauthorized,
+	ErrorClassRateLimited,
+	ErrorClassDecodeError,
+	ErrorClassServerError,
+}
+
+// APIError is a typed error returned by FlumeClient that carries its classification
+type APIError struct {
+	Endpoint   string
+	Class      ErrorClass
+	StatusCode int
+	Err        error
+}
+
+// Error returns the underlying error message
+func (e *APIError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// newStatusError builds an APIError for a non-200 response, classifying it by status code
+func newStatusError(endpoint string, statusCode int, format string, args ...interface{}) error {
+	class := ErrorClassServerError
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		class = ErrorClassUnauthorized
+	case http.StatusTooManyRequests:
+		class = ErrorClassRateLimited
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		class = ErrorClassTimeout
+	}
+
+	return &APIError{
+		Endpoint:   endpoint,
+		Class:      class,
+		StatusCode: statusCode,
+		Err:        fmt.Errorf(format, args...),
+	}
+}
+
+// isRetryableError reports whether err is transient (rate limited, timed out or a server error) and the
+// request is worth retrying; authentication and decode errors are not
+func isRetryableError(err error) bool {
+	switch classifyError(err) {
+	case ErrorClassRateLimited, ErrorClassTimeout, ErrorClassServerError:
+		return true
+	}
+	return false
+}
+
+// newDecodeError builds an APIError for a response body that could not be decoded
+func newDecodeError(endpoint string, format string, args ...interface{}) error {
+	return &APIError{
+		Endpoint: endpoint,
+		Class:    ErrorClassDecodeError,
+		Err:      fmt.Errorf(format, args...),
+	}
+}
+
+// classifyError derives the ErrorClass for any error returned by FlumeClient
+// Errors that cannot be classified more precisely are reported as server errors
+func classifyError(err error) ErrorClass {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Class
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorClassTimeout
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return ErrorClassDecodeError
+	}
+
+	return ErrorClassServerError
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSV export range limits: days exported when no range is given, and the longest range accepted
+const (
+	exportDefaultDays = 30
+	exportMaxDays     = 365
+)
+
+// exportCSVHandler streams daily totals as CSV with the columns device_id, date and gallons
+// The range is the last days (default 30) or from..to (YYYY-MM-DD, inclusive). Daily totals already
+// collected are served from memory; a device whose collected totals start after the range is queried
+// once for the whole range, waiting for the rate limiter like any other request
+func exportCSVHandler(client *FlumeClient, metrics *Metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		from, to, err := parseExportRange(r, time.Now().In(client.location))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		deviceIDs := metrics.DailyTotalDevices()
+		if deviceID := strings.TrimSpace(r.URL.Query().Get("device")); deviceID != "" {
+			deviceIDs = []string{deviceID}
+		}
+
+		// Fill in ranges not covered by the collected totals before anything is written, so a failed
+		// query can still be reported as an error instead of a truncated CSV
+		totals := make(map[string]map[string]float64, len(deviceIDs))
+		fromDate := from.Format("2006-01-02")
+		for _, deviceID := range deviceIDs {
+			days := metrics.DailyTotals(deviceID)
+			if earliest, ok := earliestDate(days); !ok || earliest > fromDate {
+				until := to.AddDate(0, 0, 1).Add(-time.Second)
+				usage, err := client.QueryDailyTotalWaterUsage(deviceID, from, until)
+				if err != nil {
+					log.Printf("CSV export: failed to query daily totals for device %s: %v", deviceID, err)
+					writeAdminError(w, http.StatusBadGateway, err.Error())
+					return
+				}
+				for _, data := range usage.Data {
+					for _, dayData := range data.DailyTotalWaterUsage {
+						t, err := dayData.Time()
+						if err != nil {
+							continue
+						}
+						days[t.Format("2006-01-02")] = dayData.Value
+					}
+				}
+			}
+			totals[deviceID] = days
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="flume-daily-totals.csv"`)
+		out := csv.NewWriter(w)
+		out.Write([]string{"device_id", "date", "gallons"})
+		for _, deviceID := range deviceIDs {
+			for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+				date := day.Format("2006-01-02")
+				if gallons, ok := totals[deviceID][date]; ok {
+					out.Write([]string{deviceID, date, strconv.FormatFloat(gallons, 'f', -1, 64)})
+				}
+			}
+		}
+		out.Flush()
+		if err := out.Error(); err != nil {
+			log.Printf("CSV export: failed to write response: %v", err)
+		}
+	}
+}
+
+// parseExportRange reads the export range from the days, or from and to, query parameters
+// Returns the first and last day of the range at midnight in now's time zone
+func parseExportRange(r *http.Request, now time.Time) (time.Time, time.Time, error) {
+	query := r.URL.Query()
+	today := startOfDay(now, now.Location())
+
+	if query.Get("from") == "" && query.Get("to") == "" {
+		days := exportDefaultDays
+		if value := query.Get("days"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 || parsed > exportMaxDays {
+				return time.Time{}, time.Time{}, fmt.Errorf("invalid days parameter '%s' (expected 1-%d)", value, exportMaxDays)
+			}
+			days = parsed
+		}
+		return today.AddDate(0, 0, 1-days), today, nil
+	}
+
+	if query.Get("days") != "" {
+		return time.Time{}, time.Time{}, fmt.Errorf("days cannot be combined with from and to")
+	}
+	from, err := time.ParseInLocation("2006-01-02", query.Get("from"), now.Location())
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid or missing from parameter (expected YYYY-MM-DD)")
+	}
+	to := today
+	if value := query.Get("to"); value != "" {
+		if to, err = time.ParseInLocation("2006-01-02", value, now.Location()); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to parameter (expected YYYY-MM-DD)")
+		}
+	}
+	switch {
+	case to.After(today):
+		return time.Time{}, time.Time{}, fmt.Errorf("to must not be in the future")
+	case from.After(to):
+		return time.Time{}, time.Time{}, fmt.Errorf("from must not be after to")
+	case from.AddDate(0, 0, exportMaxDays).Before(to.AddDate(0, 0, 1)):
+		return time.Time{}, time.Time{}, fmt.Errorf("range must not exceed %d days", exportMaxDays)
+	}
+	return from, to, nil
+}
+
+// earliestDate returns the earliest YYYY-MM-DD key of a daily totals map
+func earliestDate(days map[string]float64) (string, bool) {
+	earliest := ""
+	for date := range days {
+		if earliest == "" || date < earliest {
+			earliest = date
+		}
+	}
+	return earliest, earliest != ""
+}
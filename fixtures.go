@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fixtureTransport is an http.RoundTripper that replays canned JSON responses from a directory
+// instead of calling the Flume API. Files are named per endpoint:
+//
+//	token.json                              POST /oauth/token
+//	me.json                                 GET  /me
+//	devices.json                            GET  /me/devices
+//	flow_rate_<device>.json, flow_rate.json GET  /users/{user}/devices/{device}/query/active
+//	<request_id>_<device>.json, <request_id>.json
+//	                                        POST /me/devices/{device}/query
+//	                                        POST /users/{user}/devices/{device}/query (shared devices)
+//
+// Device-specific files take precedence over the generic ones.
+type fixtureTransport struct {
+	dir string
+}
+
+// newFixtureTransport creates a transport that reads fixtures from dir
+func newFixtureTransport(dir string) *fixtureTransport {
+	return &fixtureTransport{dir: dir}
+}
+
+// RoundTrip serves the fixture matching the request, or a 404 if none exists
+func (t *fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	candidates, err := fixtureNames(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range candidates {
+		data, err := os.ReadFile(filepath.Join(t.dir, name))
+		if err == nil {
+			log.Printf("Fixture mode: serving %s %s from %s", req.Method, req.URL.Path, name)
+			return fixtureResponse(req, http.StatusOK, data), nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read fixture %s: %w", name, err)
+		}
+	}
+
+	log.Printf("Fixture mode: no fixture for %s %s (tried %s)", req.Method, req.URL.Path, strings.Join(candidates, ", "))
+	body := fmt.Sprintf(`{"success":false,"code":404,"message":"no fixture for %s %s"}`, req.Method, req.URL.Path)
+	return fixtureResponse(req, http.StatusNotFound, []byte(body)), nil
+}
+
+// fixtureNames returns the fixture file names to try for a request, most specific first
+func fixtureNames(req *http.Request) ([]string, error) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 2 && parts[0] == "oauth" && parts[1] == "token":
+		return []string{"token.json"}, nil
+	case len(parts) == 1 && parts[0] == "me":
+		return []string{"me.json"}, nil
+	case len(parts) == 2 && parts[0] == "me" && parts[1] == "devices":
+		return []string{"devices.json"}, nil
+	case len(parts) == 6 && parts[0] == "users" && parts[4] == "query" && parts[5] == "active":
+		deviceID := parts[3]
+		return []string{"flow_rate_" + deviceID + ".json", "flow_rate.json"}, nil
+	case len(parts) == 4 && parts[0] == "me" && parts[1] == "devices" && parts[3] == "query",
+		len(parts) == 5 && parts[0] == "users" && parts[2] == "devices" && parts[4] == "query":
+		deviceID := parts[len(parts)-2]
+		requestID, err := fixtureRequestID(req)
+		if err != nil {
+			return nil, err
+		}
+		return []string{requestID + "_" + deviceID + ".json", requestID + ".json"}, nil
+	}
+
+	return []string{strings.ReplaceAll(strings.Join(parts, "_"), ".", "_") + ".json"}, nil
+}
+
+// fixtureRequestID reads the request_id of the first query in a query request body
+func fixtureRequestID(req *http.Request) (string, error) {
+	if req.Body == nil {
+		return "query", nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read query request body: %w", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	var queryReq QueryRequest
+	if err := json.Unmarshal(body, &queryReq); err != nil || len(queryReq.Queries) == 0 {
+		return "query", nil
+	}
+	return queryReq.Queries[0].RequestID, nil
+}
+
+// fixtureResponse builds a JSON http.Response for a fixture body
+func fixtureResponse(req *http.Request, status int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
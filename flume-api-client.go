@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -12,13 +14,20 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// HTTPDoer is the subset of *http.Client used by FlumeClient
+// Tests and fixture mode can substitute their own implementation
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
 // FlumeClient handles communication with the Flume API
 type FlumeClient struct {
 	baseURL      string
-	httpClient   *http.Client
+	httpClient   HTTPDoer
 	accessToken  string
 	refreshToken string
 	clientID     string
@@ -29,10 +38,70 @@ type FlumeClient struct {
 	tokenFile    string
 	rateLimiter  *RateLimiter
 	metrics      *Metrics
+	maxBodySize  int64
+	maxLogBody   int
+
+	// Refresh token from the configuration, kept for when a saved one is rejected
+	configuredRefreshToken string
+
+	// How client credentials are sent to the token endpoint: OAuthAuthStyleBody or OAuthAuthStyleHeader
+	oauthAuthStyle string
+
+	// Authentication state tracking for health reporting
+	hasAuthenticated bool
+	refreshFailures  int
+
+	// Guards the tokens and authentication state above; held across a refresh or re-authentication so
+	// concurrent callers wait for it and reuse its tokens instead of starting their own
+	tokenMutex sync.Mutex
+
+	// Serializes token file writes, e.g. a refresh racing the final save at shutdown
+	tokenFileMutex sync.Mutex
+
+	// Authentication retry backoff
+	authRetryBackoff    time.Duration
+	authRetryMaxBackoff time.Duration
+
+	// Requests sent in the trailing hour, for the quota estimate and the hard request cap
+	hourlyQuota       int
+	requestTimes      []time.Time
+	requestTimesMutex sync.Mutex
+	maxRequests       int
+	maxRequestsMode   string
+	budgetExhausted   bool
+	requestsSent      int64
+
+	// Recent raw responses for /debug/last-responses, nil when disabled
+	lastResponses *responseRing
+
+	// Usage queries in flight, keyed by queryKey, shared by concurrent identical callers
+	inflightQueries map[string]*inflightQuery
+	inflightMutex   sync.Mutex
+
+	// Time zone of the account, for reading times and query ranges
+	location *time.Location
+
+	// Deadline for a shared usage query, which runs detached from any one caller's context
+	requestTimeout time.Duration
+
+	// Device list and user ID cache, both refreshed after deviceCacheTTL
+	deviceCache      []Device
+	deviceCacheTime  time.Time
+	deviceCacheTTL   time.Duration
+	cachedUserID     int
+	userIDCacheTime  time.Time
+	deviceCacheMutex sync.Mutex
+
+	// Device list fetched by Warmup, handed to the first GetDevices call even when caching is disabled
+	warmupDevices []Device
 }
 
+// tokenFileVersion is the current token file schema version; files without a version are version 0
+const tokenFileVersion = 1
+
 // TokenData represents the token data structure for persistence
 type TokenData struct {
+	Version      int       `json:"version"`
 	AccessToken  string    `json:"access_token"`
 	RefreshToken string    `json:"refresh_token"`
 	TokenType    string    `json:"token_type"`
@@ -42,27 +111,134 @@ type TokenData struct {
 	ClientID     string    `json:"client_id"`
 }
 
+// selectTokenFile picks where tokens are persisted: the configured path, then /var/lib/flume-exporter,
+// the user cache directory and the temp directory, using the first whose directory is writable
+// Returns an empty path, keeping tokens in memory only, when none of them are
+func selectTokenFile(configured string) string {
+	return firstWritableTokenFile(tokenFileCandidates(configured))
+}
+
+// tokenFileCandidates lists the token file locations selectTokenFile tries, in order
+func tokenFileCandidates(configured string) []string {
+	var candidates []string
+	if configured != "" {
+		candidates = append(candidates, configured)
+	}
+	candidates = append(candidates, "/var/lib/flume-exporter/tokens.json")
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		candidates = append(candidates, filepath.Join(cacheDir, "flume-exporter", "tokens.json"))
+	}
+	return append(candidates, filepath.Join(os.TempDir(), "flume_exporter_tokens.json"))
+}
+
+// firstWritableTokenFile returns the first candidate whose directory is writable, or "" if there is none
+func firstWritableTokenFile(candidates []string) string {
+	for _, candidate := range candidates {
+		if err := checkTokenDirWritable(filepath.Dir(candidate)); err != nil {
+			log.Printf("Token file location %s is not usable: %v", candidate, err)
+			continue
+		}
+		log.Printf("Using token file: %s", candidate)
+		return candidate
+	}
+	log.Printf("Warning: No writable token file location found, tokens will be kept in memory only")
+	return ""
+}
+
+// checkTokenDirWritable creates dir if needed and verifies a file can be created in it
+func checkTokenDirWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".flume_exporter_probe_*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
 // NewFlumeClient creates a new Flume API client
 func NewFlumeClient(config *Config, metrics *Metrics) *FlumeClient {
-	// Always use /tmp for token storage - it's guaranteed to be writable
-	tokenFile := "/tmp/flume_exporter_tokens.json"
-	log.Printf("Using token file: %s", tokenFile)
+	return NewFlumeClientWithHTTP(config, metrics, nil)
+}
+
+// NewFlumeClientWithTransport creates a new Flume API client whose requests go through transport,
+// keeping the configured timeout. Useful for recording or mocking transports in tests and for
+// request middleware such as extra logging or metrics. A nil transport uses http.DefaultTransport
+func NewFlumeClientWithTransport(config *Config, metrics *Metrics, transport http.RoundTripper) *FlumeClient {
+	return NewFlumeClientWithHTTP(config, metrics, &http.Client{
+		Timeout:   config.Timeout,
+		Transport: transport,
+	})
+}
+
+// NewFlumeClientWithHTTP creates a new Flume API client that sends requests through doer
+// A nil doer builds the standard *http.Client (or the fixture client in fixture mode)
+func NewFlumeClientWithHTTP(config *Config, metrics *Metrics, doer HTTPDoer) *FlumeClient {
+	var tokenFile string
+
+	httpClient := &http.Client{
+		Timeout: config.Timeout,
+	}
+
+	// In demo and fixture mode, answer locally and never touch the real token file
+	if config.Demo {
+		logDemoMode()
+		httpClient.Transport = newDemoTransport(config.TimeLocation())
+		tokenFile = ""
+	} else if config.FixturesDir != "" {
+		log.Printf("Fixture mode: serving API responses from %s", config.FixturesDir)
+		httpClient.Transport = newFixtureTransport(config.FixturesDir)
+		tokenFile = ""
+	} else {
+		tokenFile = selectTokenFile(config.TokenFile)
+		if transport := newAPITransport(config, metrics); transport != nil {
+			httpClient.Transport = transport
+		}
+	}
+
+	if doer == nil {
+		doer = httpClient
+	}
 
 	client := &FlumeClient{
-		baseURL: config.BaseURL,
-		httpClient: &http.Client{
-			Timeout: config.Timeout,
-		},
-		clientID:     config.ClientID,
-		clientSecret: config.ClientSecret,
-		username:     config.Username,
-		password:     config.Password,
-		tokenFile:    tokenFile,
-		rateLimiter:  NewRateLimiter(config.APIMinInterval),
-		metrics:      metrics,
-	}
-
-	// Try to load existing tokens
+		baseURL:        config.BaseURL,
+		httpClient:     doer,
+		clientID:       config.ClientID,
+		clientSecret:   config.ClientSecret,
+		username:       config.Username,
+		password:       config.Password,
+		tokenFile:      tokenFile,
+		rateLimiter:    NewRateLimiter(config.APIMinInterval),
+		metrics:        metrics,
+		deviceCacheTTL: config.DeviceCacheTTL,
+		maxBodySize:    config.MaxResponseBodySize,
+		maxLogBody:     config.MaxLogBodyBytes,
+		hourlyQuota:    config.APIHourlyQuota,
+		requestTimeout: config.Timeout,
+		location:       config.TimeLocation(),
+
+		maxRequests:     config.MaxRequestsPerHour,
+		maxRequestsMode: config.MaxRequestsMode,
+
+		authRetryBackoff:    config.AuthRetryBackoff,
+		authRetryMaxBackoff: config.AuthRetryMaxBackoff,
+	}
+
+	if config.DebugLastResponses > 0 {
+		client.lastResponses = newResponseRing(config.DebugLastResponses)
+	}
+
+	client.updateQuotaMetric()
+	if metrics != nil {
+		metrics.SetEffectiveAPIInterval(client.rateLimiter.EffectiveInterval())
+	}
+
+	// A configured refresh token is the starting point; a saved one, possibly rotated since, replaces it
+	client.refreshToken = config.RefreshToken
+	client.configuredRefreshToken = config.RefreshToken
+	client.oauthAuthStyle = config.OAuthAuthStyle
 	client.loadTokens()
 
 	return client
@@ -85,6 +261,7 @@ func (c *FlumeClient) loadTokens() {
 		log.Printf("Failed to parse token file: %v", err)
 		return
 	}
+	migrateTokenData(&tokenData)
 
 	// Validate that tokens belong to the current user/client
 	if tokenData.Username != c.username || tokenData.ClientID != c.clientID {
@@ -92,24 +269,64 @@ func (c *FlumeClient) loadTokens() {
 		return
 	}
 
+	// Files without an expiry time fall back to the access token's JWT exp claim
+	if tokenData.ExpiryTime.IsZero() && tokenData.AccessToken != "" {
+		c.accessToken = tokenData.AccessToken
+		if fields, ok := c.extractTokenClaims(); ok {
+			tokenData.ExpiryTime = fields.Expiry
+		}
+		c.accessToken = ""
+	}
+
 	// Check if tokens are still valid
 	if time.Now().Before(tokenData.ExpiryTime) {
 		c.accessToken = tokenData.AccessToken
 		c.refreshToken = tokenData.RefreshToken
 		c.tokenExpiry = tokenData.ExpiryTime
+		c.hasAuthenticated = true
+		c.reconcileTokenExpiry()
 		log.Printf("Loaded valid tokens from file, expires at: %v", c.tokenExpiry)
+	} else if c.password == "" && tokenData.RefreshToken != "" {
+		c.refreshToken = tokenData.RefreshToken
+		log.Printf("Access token in file is expired, will refresh it with the saved refresh token")
 	} else {
 		log.Printf("Tokens in file are expired, will need to re-authenticate")
 	}
 }
 
+// migrateTokenData upgrades token data read from an older token file to the current schema
+// Unversioned (version 0) files hold the same fields without a version; absent fields keep their zero
+// values and an absent expiry time is recovered from the JWT by loadTokens. Files from a newer release
+// are read on a best-effort basis, ignoring fields this release does not know
+func migrateTokenData(tokenData *TokenData) {
+	switch {
+	case tokenData.Version > tokenFileVersion:
+		log.Printf("Warning: token file version %d is newer than supported version %d, reading known fields only", tokenData.Version, tokenFileVersion)
+	case tokenData.Version < tokenFileVersion:
+		log.Printf("Migrating token file from version %d to %d", tokenData.Version, tokenFileVersion)
+		tokenData.Version = tokenFileVersion
+	}
+}
+
 // saveTokens saves the current tokens to the token file
 func (c *FlumeClient) saveTokens() error {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	return c.saveTokensLocked()
+}
+
+// saveTokensLocked saves the current tokens to the token file; callers must hold tokenMutex
+// The file is written to a temporary file and renamed into place, so it is never left partially written
+func (c *FlumeClient) saveTokensLocked() error {
 	if c.tokenFile == "" {
 		return nil
 	}
 
+	c.tokenFileMutex.Lock()
+	defer c.tokenFileMutex.Unlock()
+
 	tokenData := TokenData{
+		Version:      tokenFileVersion,
 		AccessToken:  c.accessToken,
 		RefreshToken: c.refreshToken,
 		ExpiryTime:   c.tokenExpiry,
@@ -129,9 +346,14 @@ func (c *FlumeClient) saveTokens() error {
 	}
 
 	// Write with restrictive permissions
-	if err := os.WriteFile(c.tokenFile, data, 0600); err != nil {
+	tmpFile := c.tokenFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0600); err != nil {
 		return fmt.Errorf("failed to write token file: %w", err)
 	}
+	if err := os.Rename(tmpFile, c.tokenFile); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("failed to replace token file: %w", err)
+	}
 
 	log.Printf("Tokens saved to: %s", c.tokenFile)
 	return nil
@@ -155,9 +377,93 @@ type TokenResponse struct {
 type Device struct {
 	ID       string `json:"id"`
 	Type     int    `json:"type"`
+	Name     string `json:"name"` // Device name set in the Flume app, when the API reports one
 	Location struct {
 		Name string `json:"name"`
 	} `json:"location"`
+
+	// Whether the device is currently connected, when the API reports it
+	Connected *bool `json:"connected"`
+
+	// Product generation or model (e.g. "flume2"), empty when the API does not report it
+	Product string `json:"product"`
+
+	// Firmware version, when the device detail includes it (field name varies between API versions)
+	FirmwareVersion string `json:"firmware_version"`
+	Firmware        string `json:"firmware"`
+
+	// ID of the user who owns the device, when the API reports it
+	UserID json.Number `json:"user_id"`
+
+	// When the device was added to the account, i.e. installed or activated, when the API reports it
+	AddedDatetime string `json:"added_datetime"`
+
+	// Whether the device is owned by another user who shared it; set by the client, not the API
+	Shared bool `json:"-"`
+}
+
+// Offline reports whether the API reports the device as disconnected; devices without connectivity
+// information are assumed to be online
+func (d Device) Offline() bool {
+	return d.Connected != nil && !*d.Connected
+}
+
+// TypeLabel decodes the numeric device type into a readable name
+func (d Device) TypeLabel() string {
+	switch d.Type {
+	case 1:
+		return "bridge"
+	case 2:
+		return "sensor"
+	}
+	return "unknown"
+}
+
+// OwnerID returns the ID of the user who owns the device, or 0 if the API did not report one
+func (d Device) OwnerID() int {
+	id, err := d.UserID.Int64()
+	if err != nil {
+		return 0
+	}
+	return int(id)
+}
+
+// FirmwareLabel returns the device's firmware version, or an empty string if the API did not report one
+func (d Device) FirmwareLabel() string {
+	if d.FirmwareVersion != "" {
+		return d.FirmwareVersion
+	}
+	return d.Firmware
+}
+
+// addedDatetimeFormats are the layouts accepted for a device's added datetime, most common first
+var addedDatetimeFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+}
+
+// InstalledAt returns when the device was added to the account; ok is false if the API did not report
+// it or it could not be parsed
+func (d Device) InstalledAt() (time.Time, bool) {
+	if d.AddedDatetime == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range addedDatetimeFormats {
+		if t, err := time.Parse(layout, d.AddedDatetime); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// validQueryBuckets lists the bucket sizes accepted by the Flume query API
+var validQueryBuckets = map[string]bool{
+	"MIN": true,
+	"HR":  true,
+	"DAY": true,
+	"MON": true,
+	"YR":  true,
 }
 
 // QueryRequest represents a query request to the Flume API
@@ -166,6 +472,9 @@ type QueryRequest struct {
 }
 
 // Query represents a single query within a request
+// GroupMultiplier aggregates that many buckets into each returned reading: with MIN, 15 returns
+// 15-minute readings; with HR, 6 returns 6-hour readings; with DAY, 7 returns weekly readings.
+// It is rarely useful with MON and YR. Zero (omitted) means one reading per bucket
 type Query struct {
 	RequestID       string `json:"request_id"`
 	Bucket          string `json:"bucket"`
@@ -174,20 +483,94 @@ type Query struct {
 	GroupMultiplier int    `json:"group_multiplier,omitempty"`
 }
 
+// UsagePoint is a single datetime/value reading from a query response
+// Flume returns readings either as {"datetime": ..., "value": ...} objects or as [datetime, value] tuples
+type UsagePoint struct {
+	DateTime string  `json:"datetime"`
+	Value    float64 `json:"value"`
+}
+
+// UnmarshalJSON accepts both the object and the tuple form of a reading
+func (p *UsagePoint) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var tuple []json.RawMessage
+		if err := json.Unmarshal(trimmed, &tuple); err != nil {
+			return err
+		}
+		if len(tuple) != 2 {
+			return fmt.Errorf("expected [datetime, value] tuple, got %d elements", len(tuple))
+		}
+		if err := json.Unmarshal(tuple[0], &p.DateTime); err != nil {
+			return fmt.Errorf("invalid tuple datetime: %w", err)
+		}
+		if err := json.Unmarshal(tuple[1], &p.Value); err != nil {
+			return fmt.Errorf("invalid tuple value: %w", err)
+		}
+		return nil
+	}
+
+	// Alias drops the UnmarshalJSON method to avoid recursion
+	type usagePointObject UsagePoint
+	var obj usagePointObject
+	if err := json.Unmarshal(trimmed, &obj); err != nil {
+		return err
+	}
+	*p = UsagePoint(obj)
+	return nil
+}
+
+// usageDatetimeFormats are the datetime layouts Flume uses for readings, most common first
+var usageDatetimeFormats = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// Time parses the reading's datetime, returning an error if it is not in a known format
+func (p UsagePoint) Time() (time.Time, error) {
+	for _, layout := range usageDatetimeFormats {
+		if t, err := time.Parse(layout, p.DateTime); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("malformed reading datetime '%s'", p.DateTime)
+}
+
+// TimeIn parses the reading's datetime as a point in time in loc, the time zone Flume reports the
+// account's readings in
+func (p UsagePoint) TimeIn(loc *time.Location) (time.Time, error) {
+	for _, layout := range usageDatetimeFormats {
+		if t, err := time.ParseInLocation(layout, p.DateTime, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("malformed reading datetime '%s'", p.DateTime)
+}
+
+// QueryResult holds the readings returned for a single query within a response
+type QueryResult struct {
+	WaterUsage []UsagePoint `json:"water_usage"`
+	QueryData  []UsagePoint `json:"query_data"`
+	RequestID  string       `json:"request_id"`
+	Bucket     string       `json:"bucket"`
+}
+
+// Points returns the readings of the result, whichever format the API used
+func (r QueryResult) Points() []UsagePoint {
+	if len(r.WaterUsage) > 0 {
+		return r.WaterUsage
+	}
+	return r.QueryData
+}
+
 // QueryResponse represents the response from a query
 type QueryResponse struct {
-	Success bool   `json:"success"`
-	Code    int    `json:"code"`
-	Message string `json:"message"`
-	Data    []struct {
-		WaterUsage []struct {
-			DateTime string  `json:"datetime"`
-			Value    float64 `json:"value"`
-		} `json:"water_usage"`
-		RequestID string `json:"request_id"`
-		Bucket    string `json:"bucket"`
-	} `json:"data"`
-	Count int `json:"count"`
+	Success bool          `json:"success"`
+	Code    int           `json:"code"`
+	Message string        `json:"message"`
+	Data    []QueryResult `json:"data"`
+	Count   int           `json:"count"`
 }
 
 // DailyTotalWaterUsageResponse represents the response from a daily total water usage query
@@ -196,19 +579,25 @@ type DailyTotalWaterUsageResponse struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 	Data    []struct {
-		DailyTotalWaterUsage []struct {
-			DateTime string  `json:"datetime"`
-			Value    float64 `json:"value"`
-		} `json:"daily_total_water_usage"`
-		RequestID string `json:"request_id"`
+		DailyTotalWaterUsage []UsagePoint `json:"daily_total_water_usage"`
+		RequestID            string       `json:"request_id"`
 	} `json:"data"`
 	Count int `json:"count"`
 }
 
 // FlowRateResponse represents the current flow rate response
+// Optional sensor readings are nil when the device does not report them
+// Value is always in gallons per minute; SourceUnits records the unit the API reported, if any
 type FlowRateResponse struct {
-	Value float64 `json:"value"`
-	Units string  `json:"units"`
+	Value       float64  `json:"value"`
+	Units       string   `json:"units"`
+	SourceUnits string   `json:"source_units,omitempty"`
+	Active      bool     `json:"active"`
+	PressurePSI *float64 `json:"pressure_psi,omitempty"`
+	NoData      bool     `json:"no_data,omitempty"` // The API returned no reading; Value is 0
+
+	// When Flume took the reading, zero if the datetime was missing or malformed
+	ReadingTime time.Time `json:"-"`
 }
 
 // DevicesResponse represents the response from the devices endpoint
@@ -219,6 +608,13 @@ type DevicesResponse struct {
 
 // isTokenExpired checks if the current token is expired
 func (c *FlumeClient) isTokenExpired() bool {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	return c.isTokenExpiredLocked()
+}
+
+// isTokenExpiredLocked is isTokenExpired for callers holding tokenMutex
+func (c *FlumeClient) isTokenExpiredLocked() bool {
 	if c.accessToken == "" {
 		return true
 	}
@@ -227,8 +623,8 @@ func (c *FlumeClient) isTokenExpired() bool {
 	return time.Now().Add(5 * time.Minute).After(c.tokenExpiry)
 }
 
-// isTokenExpiringSoon checks if the token will expire within the next hour
-func (c *FlumeClient) isTokenExpiringSoon() bool {
+// isTokenExpiringSoonLocked checks if the token will expire within the next hour; callers must hold tokenMutex
+func (c *FlumeClient) isTokenExpiringSoonLocked() bool {
 	if c.accessToken == "" {
 		return true
 	}
@@ -239,18 +635,25 @@ func (c *FlumeClient) isTokenExpiringSoon() bool {
 
 // needsAuthentication checks if we need to authenticate or refresh tokens
 func (c *FlumeClient) needsAuthentication() bool {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	return c.needsAuthenticationLocked()
+}
+
+// needsAuthenticationLocked is needsAuthentication for callers holding tokenMutex
+func (c *FlumeClient) needsAuthenticationLocked() bool {
 	// No token means we need authentication
 	if c.accessToken == "" {
 		return true
 	}
 
 	// Token expired means we need authentication
-	if c.isTokenExpired() {
+	if c.isTokenExpiredLocked() {
 		return true
 	}
 
 	// Token expiring soon means we should refresh
-	if c.isTokenExpiringSoon() && c.refreshToken != "" {
+	if c.isTokenExpiringSoonLocked() && c.refreshToken != "" {
 		return true
 	}
 
@@ -258,32 +661,68 @@ func (c *FlumeClient) needsAuthentication() bool {
 }
 
 // ensureValidToken ensures we have a valid token, refreshing if necessary
-func (c *FlumeClient) ensureValidToken() error {
+// Concurrent callers are serialized, so one refreshes and the others find the new token valid;
+// ctx cancels the token request
+func (c *FlumeClient) ensureValidToken(ctx context.Context) error {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+
 	// If we don't need authentication, we're good
-	if !c.needsAuthentication() {
+	if !c.needsAuthenticationLocked() {
 		return nil
 	}
 
 	// If we have a refresh token and token is expiring soon, try to refresh
-	if c.refreshToken != "" && c.isTokenExpiringSoon() && !c.isTokenExpired() {
+	if c.refreshToken != "" && c.isTokenExpiringSoonLocked() && !c.isTokenExpiredLocked() {
 		log.Printf("Token expiring soon, attempting to refresh...")
-		if err := c.refreshAccessToken(); err != nil {
+		if err := c.refreshAccessToken(ctx); err != nil {
+			c.refreshFailures++
 			log.Printf("Failed to refresh token: %v, will re-authenticate", err)
 			// Clear tokens and fall through to full authentication
-			c.clearTokens()
+			c.clearTokensLocked()
 		} else {
+			c.refreshFailures = 0
 			return nil // Successfully refreshed
 		}
 	}
 
 	// Need full authentication
 	log.Printf("Performing full authentication...")
-	return c.Authenticate()
+	return c.authenticateLocked(ctx)
+}
+
+// currentAccessToken returns the access token to send with a request
+func (c *FlumeClient) currentAccessToken() string {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	return c.accessToken
+}
+
+// tokenState is a consistent copy of the client's token state, for readers outside the client
+type tokenState struct {
+	hasAccessToken   bool
+	hasAuthenticated bool
+	refreshFailures  int
+	expired          bool
+}
+
+// tokenState returns a copy of the token state taken under tokenMutex
+func (c *FlumeClient) tokenState() tokenState {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	return tokenState{
+		hasAccessToken:   c.accessToken != "",
+		hasAuthenticated: c.hasAuthenticated,
+		refreshFailures:  c.refreshFailures,
+		expired:          c.isTokenExpiredLocked(),
+	}
 }
 
-// refreshAccessToken refreshes the access token using the refresh token
-func (c *FlumeClient) refreshAccessToken() error {
+// refreshAccessToken refreshes the access token using the refresh token; callers must hold tokenMutex
+func (c *FlumeClient) refreshAccessToken(ctx context.Context) (err error) {
 	log.Printf("refreshAccessToken: Attempting to refresh token...")
+	start := time.Now()
+	defer func() { c.recordOAuthMetrics(true, time.Since(start), err) }()
 
 	tokenData := map[string]string{
 		"grant_type":    "refresh_token",
@@ -292,20 +731,13 @@ func (c *FlumeClient) refreshAccessToken() error {
 		"refresh_token": c.refreshToken,
 	}
 
-	jsonData, err := json.Marshal(tokenData)
-	if err != nil {
-		return fmt.Errorf("failed to marshal refresh token request: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", c.baseURL+"/oauth/token", bytes.NewBuffer(jsonData))
+	req, err := c.newTokenRequest(ctx, tokenData)
 	if err != nil {
 		return fmt.Errorf("failed to create refresh token request: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-
 	log.Printf("refreshAccessToken: Sending refresh request to %s", c.baseURL+"/oauth/token")
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.doRequest(req, "token")
 	if err != nil {
 		return fmt.Errorf("failed to send refresh token request: %w", err)
 	}
@@ -313,15 +745,24 @@ func (c *FlumeClient) refreshAccessToken() error {
 
 	log.Printf("refreshAccessToken: Response status: %d", resp.StatusCode)
 
+	if err := c.checkMaintenanceResponse(resp, "token"); err != nil {
+		return err
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("refreshAccessToken: Error response body: %s", string(body))
-		return fmt.Errorf("refresh token request failed with status %d: %s", resp.StatusCode, string(body))
+		body, _ := c.readBody(resp.Body, "token")
+		log.Printf("refreshAccessToken: Error response body: %s", c.logBody(body))
+		return newStatusError("token", resp.StatusCode, "refresh token request failed with status %d: %s", resp.StatusCode, c.logBody(body))
+	}
+
+	body, err := c.readBody(resp.Body, "token")
+	if err != nil {
+		return err
 	}
 
 	var tokenResp TokenResponse
-	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-		return fmt.Errorf("failed to decode refresh token response: %w", err)
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return newDecodeError("token", "failed to decode refresh token response: %w", err)
 	}
 
 	// Validate response structure
@@ -331,6 +772,12 @@ func (c *FlumeClient) refreshAccessToken() error {
 
 	refreshTokenData := tokenResp.Data[0] // Get first token from data array
 
+	// Keep the current tokens when the response carries no access token; the caller clears them and
+	// falls back to full authentication
+	if refreshTokenData.AccessToken == "" {
+		return fmt.Errorf("refresh succeeded but returned empty access token")
+	}
+
 	log.Printf("refreshAccessToken: Successfully refreshed token, expires in %d seconds", refreshTokenData.ExpiresIn)
 
 	c.accessToken = refreshTokenData.AccessToken
@@ -339,18 +786,64 @@ func (c *FlumeClient) refreshAccessToken() error {
 	}
 	// Set new expiry time
 	c.tokenExpiry = time.Now().Add(time.Duration(refreshTokenData.ExpiresIn) * time.Second)
+	c.reconcileTokenExpiry()
 
 	// Save the refreshed tokens
-	if err := c.saveTokens(); err != nil {
+	if err := c.saveTokensLocked(); err != nil {
 		log.Printf("Warning: Failed to save refreshed tokens: %v", err)
 	}
 
 	return nil
 }
 
+// Ways of sending the client credentials to the OAuth token endpoint
+const (
+	OAuthAuthStyleBody   = "body"   // client_id and client_secret in the JSON body
+	OAuthAuthStyleHeader = "header" // HTTP Basic auth with client_id:client_secret
+)
+
+// newTokenRequest builds a token endpoint request with tokenData as its JSON body
+// With the header auth style the client credentials move from the body to an Authorization: Basic header
+func (c *FlumeClient) newTokenRequest(ctx context.Context, tokenData map[string]string) (*http.Request, error) {
+	if c.oauthAuthStyle == OAuthAuthStyleHeader {
+		delete(tokenData, "client_id")
+		delete(tokenData, "client_secret")
+	}
+
+	jsonData, err := json.Marshal(tokenData)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/oauth/token", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if c.oauthAuthStyle == OAuthAuthStyleHeader {
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.clientID+":"+c.clientSecret)))
+	}
+	return req, nil
+}
+
 // Authenticate obtains access token from the Flume API
-func (c *FlumeClient) Authenticate() error {
+// Without a password the refresh token grant stands in for the password grant
+func (c *FlumeClient) Authenticate(ctx context.Context) error {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	return c.authenticateLocked(ctx)
+}
+
+// authenticateLocked is Authenticate for callers holding tokenMutex
+func (c *FlumeClient) authenticateLocked(ctx context.Context) (err error) {
+	if c.password == "" {
+		return c.authenticateWithRefreshToken(ctx)
+	}
+
 	log.Printf("Authenticate: Starting authentication with username: %s", c.username)
+	start := time.Now()
+	defer func() { c.recordOAuthMetrics(false, time.Since(start), err) }()
 
 	tokenData := map[string]string{
 		"grant_type":    "password",
@@ -367,20 +860,13 @@ func (c *FlumeClient) Authenticate() error {
 		"password":   "***",
 	})
 
-	jsonData, err := json.Marshal(tokenData)
-	if err != nil {
-		return fmt.Errorf("failed to marshal token request: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", c.baseURL+"/oauth/token", bytes.NewBuffer(jsonData))
+	req, err := c.newTokenRequest(ctx, tokenData)
 	if err != nil {
 		return fmt.Errorf("failed to create token request: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-
 	log.Printf("Authenticate: Sending request to %s", c.baseURL+"/oauth/token")
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.doRequest(req, "token")
 	if err != nil {
 		return fmt.Errorf("failed to send token request: %w", err)
 	}
@@ -388,15 +874,22 @@ func (c *FlumeClient) Authenticate() error {
 
 	log.Printf("Authenticate: Response status: %d", resp.StatusCode)
 
+	if err := c.checkMaintenanceResponse(resp, "token"); err != nil {
+		return err
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("Authenticate: Error response body: %s", string(body))
-		return fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, string(body))
+		body, _ := c.readBody(resp.Body, "token")
+		log.Printf("Authenticate: Error response body: %s", c.logBody(body))
+		return newStatusError("token", resp.StatusCode, "token request failed with status %d: %s", resp.StatusCode, c.logBody(body))
 	}
 
 	// Log the response body for debugging
-	body, _ := io.ReadAll(resp.Body)
-	log.Printf("Authenticate: Response body: %s", string(body))
+	body, err := c.readBody(resp.Body, "token")
+	if err != nil {
+		return err
+	}
+	log.Printf("Authenticate: Response body: %s", c.logBody(body))
 	log.Printf("Authenticate: Response headers: %+v", resp.Header)
 
 	// Try to parse as generic JSON first to see the structure
@@ -413,8 +906,8 @@ func (c *FlumeClient) Authenticate() error {
 	var tokenResp TokenResponse
 	if err := json.NewDecoder(bodyReader).Decode(&tokenResp); err != nil {
 		log.Printf("Authenticate: Failed to decode response: %v", err)
-		log.Printf("Authenticate: Raw response: %s", string(body))
-		return fmt.Errorf("failed to decode token response: %w", err)
+		log.Printf("Authenticate: Raw response: %s", c.logBody(body))
+		return newDecodeError("token", "failed to decode token response: %w", err)
 	}
 
 	// Validate response structure
@@ -433,6 +926,7 @@ func (c *FlumeClient) Authenticate() error {
 	c.refreshToken = authTokenData.RefreshToken
 	// Set expiry time
 	c.tokenExpiry = time.Now().Add(time.Duration(authTokenData.ExpiresIn) * time.Second)
+	c.reconcileTokenExpiry()
 
 	// Validate that we actually got tokens
 	if c.accessToken == "" {
@@ -442,21 +936,62 @@ func (c *FlumeClient) Authenticate() error {
 		log.Printf("Warning: No refresh token received")
 	}
 
+	c.hasAuthenticated = true
+	c.refreshFailures = 0
+
 	// Save the tokens for future use
-	if err := c.saveTokens(); err != nil {
+	if err := c.saveTokensLocked(); err != nil {
 		log.Printf("Warning: Failed to save tokens: %v", err)
 	}
 
 	return nil
 }
 
+// authenticateWithRefreshToken obtains an access token with the refresh token, for running without a password
+// Callers must hold tokenMutex
+func (c *FlumeClient) authenticateWithRefreshToken(ctx context.Context) error {
+	if c.refreshToken == "" {
+		return fmt.Errorf("no refresh token available; set --refresh-token or FLUME_REFRESH_TOKEN to a current refresh token")
+	}
+
+	log.Printf("Authenticate: No password configured, refreshing the access token instead")
+	if err := c.refreshAccessToken(ctx); err != nil {
+		// A saved refresh token may be older than one configured since, e.g. after revoking it
+		if c.configuredRefreshToken == "" || c.configuredRefreshToken == c.refreshToken {
+			return err
+		}
+		log.Printf("Authenticate: Saved refresh token was rejected (%v), trying the configured one", err)
+		c.refreshToken = c.configuredRefreshToken
+		if err := c.refreshAccessToken(ctx); err != nil {
+			return err
+		}
+	}
+
+	c.hasAuthenticated = true
+	c.refreshFailures = 0
+	return nil
+}
+
 // clearTokens clears the current tokens and removes the token file
 func (c *FlumeClient) clearTokens() {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	c.clearTokensLocked()
+}
+
+// clearTokensLocked is clearTokens for callers holding tokenMutex
+// Without a password the refresh token is the only way to authenticate, so it and the token file are kept
+func (c *FlumeClient) clearTokensLocked() {
 	c.accessToken = ""
-	c.refreshToken = ""
 	c.tokenExpiry = time.Time{}
+	if c.password != "" {
+		c.refreshToken = ""
+	}
 
-	if c.tokenFile != "" {
+	// The cached device list belongs to the old session
+	c.InvalidateDeviceCache()
+
+	if c.tokenFile != "" && c.password != "" {
 		if err := os.Remove(c.tokenFile); err != nil {
 			log.Printf("Warning: Failed to remove token file: %v", err)
 		} else {
@@ -466,22 +1001,29 @@ func (c *FlumeClient) clearTokens() {
 }
 
 // AuthenticateWithRetry attempts authentication with retry logic
-func (c *FlumeClient) AuthenticateWithRetry(maxRetries int) error {
+// The wait between attempts starts at the configured backoff and doubles up to the configured cap;
+// it ends early with ctx's error when ctx is done
+func (c *FlumeClient) AuthenticateWithRetry(ctx context.Context, maxRetries int) error {
 	var lastErr error
 
 	for attempt := 1; attempt <= maxRetries; attempt++ {
 		log.Printf("Authentication attempt %d/%d", attempt, maxRetries)
 
-		if err := c.Authenticate(); err != nil {
+		if err := c.Authenticate(ctx); err != nil {
 			lastErr = err
-			log.Printf("Authentication attempt %d failed: %v", attempt, maxRetries)
 
 			if attempt < maxRetries {
 				// Clear any partial tokens and wait before retry
 				c.clearTokens()
-				waitTime := time.Duration(attempt) * 5 * time.Second
-				log.Printf("Waiting %v before retry...", waitTime)
-				time.Sleep(waitTime)
+				waitTime := authRetryDelay(attempt, c.authRetryBackoff, c.authRetryMaxBackoff)
+				log.Printf("Authentication attempt %d/%d failed, retrying in %v: %v", attempt, maxRetries, waitTime, err)
+				select {
+				case <-time.After(waitTime):
+				case <-ctx.Done():
+					return fmt.Errorf("authentication retry cancelled: %w", ctx.Err())
+				}
+			} else {
+				log.Printf("Authentication attempt %d/%d failed, giving up: %v", attempt, maxRetries, err)
 			}
 		} else {
 			log.Printf("Authentication successful on attempt %d", attempt)
@@ -492,32 +1034,172 @@ func (c *FlumeClient) AuthenticateWithRetry(maxRetries int) error {
 	return fmt.Errorf("authentication failed after %d attempts, last error: %w", maxRetries, lastErr)
 }
 
+// authRetryDelay returns the wait after the given failed attempt: base doubled for each
+// earlier failure, capped at max (a max of 0 means no cap)
+func authRetryDelay(attempt int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if max > 0 && delay >= max {
+			return max
+		}
+	}
+	if max > 0 && delay > max {
+		return max
+	}
+	return delay
+}
+
 // GetDevices retrieves all devices for the authenticated user
+// The device list rarely changes, so results are cached for the configured TTL
 func (c *FlumeClient) GetDevices() ([]Device, error) {
+	if devices, ok := c.takeWarmupDevices(); ok {
+		log.Printf("GetDevices: Using device list fetched at startup (%d devices)", len(devices))
+		return devices, nil
+	}
+	if devices, age, ok := c.getCachedDevices(); ok {
+		log.Printf("GetDevices: Using cached device list (%d devices, fetched %s ago)", len(devices), age.Round(time.Second))
+		if c.metrics != nil {
+			c.metrics.SetDeviceCacheAge(age)
+		}
+		return devices, nil
+	}
+
+	devices, err := c.fetchDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	c.setCachedDevices(devices)
+	if c.metrics != nil {
+		c.metrics.SetDeviceCacheAge(0)
+	}
+	return devices, nil
+}
+
+// InvalidateDeviceCache drops the cached device list and user ID so the next calls re-fetch them
+func (c *FlumeClient) InvalidateDeviceCache() {
+	c.deviceCacheMutex.Lock()
+	defer c.deviceCacheMutex.Unlock()
+
+	c.deviceCache = nil
+	c.deviceCacheTime = time.Time{}
+	c.cachedUserID = 0
+	c.userIDCacheTime = time.Time{}
+	c.warmupDevices = nil
+}
+
+// Warmup fetches the device list and user ID into the cache, so the first collection cycle reuses
+// them instead of repeating the requests. A failed device fetch is retried with backoff before
+// giving up. Returns the device list
+func (c *FlumeClient) Warmup(ctx context.Context) ([]Device, error) {
+	var devices []Device
+	var err error
+	for attempt := 1; attempt <= warmupMaxAttempts; attempt++ {
+		if attempt > 1 {
+			wait := authRetryDelay(attempt-1, warmupRetryBackoff, warmupRetryMaxBackoff)
+			log.Printf("Warmup: device list attempt %d/%d failed, retrying in %v: %v", attempt-1, warmupMaxAttempts, wait, err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, fmt.Errorf("device list retry cancelled: %w", ctx.Err())
+			}
+		}
+
+		devices, err = c.GetDevices()
+		if err == nil || !isRetryableError(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.deviceCacheMutex.Lock()
+	c.warmupDevices = devices
+	c.deviceCacheMutex.Unlock()
+
+	// A cached user ID needs no request, so no rate limiter slot is spent on it
+	if _, ok := c.userIDFromCache(); ok {
+		return devices, nil
+	}
+	c.rateLimiter.Wait()
+	if _, err := c.getUserID(ctx); err != nil {
+		// Flow rate queries resolve the user ID again when they need it
+		log.Printf("Warmup: Failed to resolve user ID: %v", err)
+	}
+	return devices, nil
+}
+
+// Startup device list retries: attempts made by Warmup and the backoff between them
+const (
+	warmupMaxAttempts     = 3
+	warmupRetryBackoff    = 5 * time.Second
+	warmupRetryMaxBackoff = 30 * time.Second
+)
+
+// takeWarmupDevices returns the device list fetched by Warmup once, then forgets it
+func (c *FlumeClient) takeWarmupDevices() ([]Device, bool) {
+	c.deviceCacheMutex.Lock()
+	defer c.deviceCacheMutex.Unlock()
+
+	devices := c.warmupDevices
+	c.warmupDevices = nil
+	return devices, devices != nil
+}
+
+// getCachedDevices returns the cached device list and its age if it is still within its TTL
+func (c *FlumeClient) getCachedDevices() ([]Device, time.Duration, bool) {
+	c.deviceCacheMutex.Lock()
+	defer c.deviceCacheMutex.Unlock()
+
+	if c.deviceCacheTTL <= 0 || c.deviceCache == nil {
+		return nil, 0, false
+	}
+	age := time.Since(c.deviceCacheTime)
+	if age >= c.deviceCacheTTL {
+		return nil, 0, false
+	}
+
+	return c.deviceCache, age, true
+}
+
+// setCachedDevices stores a freshly fetched device list in the cache
+func (c *FlumeClient) setCachedDevices(devices []Device) {
+	c.deviceCacheMutex.Lock()
+	defer c.deviceCacheMutex.Unlock()
+
+	c.deviceCache = devices
+	c.deviceCacheTime = time.Now()
+}
+
+// fetchDevices retrieves the device list from the Flume API, bypassing the cache
+func (c *FlumeClient) fetchDevices() ([]Device, error) {
 	// Apply rate limiting
 	c.rateLimiter.Wait()
 
 	// Ensure we have a valid token before making the request
-	if err := c.ensureValidToken(); err != nil {
+	if err := c.ensureValidToken(context.Background()); err != nil {
 		return nil, fmt.Errorf("failed to ensure valid token: %w", err)
 	}
 
-	log.Printf("GetDevices: Using access token: %s...", c.accessToken[:10])
+	accessToken := c.currentAccessToken()
+	log.Printf("GetDevices: Using access token: %s...", accessToken[:min(10, len(accessToken))])
 
 	req, err := http.NewRequest("GET", c.baseURL+"/me/devices", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create devices request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.accessToken)
-	if len(c.accessToken) >= 10 {
-		log.Printf("GetDevices: Set Authorization header: Bearer %s...", c.accessToken[:10])
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	if len(accessToken) >= 10 {
+		log.Printf("GetDevices: Set Authorization header: Bearer %s...", accessToken[:10])
 	} else {
-		log.Printf("GetDevices: Set Authorization header: Bearer %s", c.accessToken)
+		log.Printf("GetDevices: Set Authorization header: Bearer %s", accessToken)
 	}
 	log.Printf("GetDevices: Full Authorization header: %s", req.Header.Get("Authorization"))
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.doRequest(req, "devices")
 	if err != nil {
 		return nil, fmt.Errorf("failed to send devices request: %w", err)
 	}
@@ -528,63 +1210,260 @@ func (c *FlumeClient) GetDevices() ([]Device, error) {
 		return nil, err
 	}
 
+	// Maintenance pages come back as HTML rather than JSON
+	if err := c.checkMaintenanceResponse(resp, "devices"); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		c.InvalidateDeviceCache()
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("devices request failed with status %d: %s", resp.StatusCode, string(body))
+		body, _ := c.readBody(resp.Body, "devices")
+		return nil, newStatusError("devices", resp.StatusCode, "devices request failed with status %d: %s", resp.StatusCode, c.logBody(body))
+	}
+
+	body, err := c.readBody(resp.Body, "devices")
+	if err != nil {
+		return nil, err
 	}
 
 	var devicesResp DevicesResponse
-	if err := json.NewDecoder(resp.Body).Decode(&devicesResp); err != nil {
-		return nil, fmt.Errorf("failed to decode devices response: %w", err)
+	if err := json.Unmarshal(body, &devicesResp); err != nil {
+		return nil, newDecodeError("devices", "failed to decode devices response: %w", err)
 	}
 
+	c.markSharedDevices(devicesResp.Data)
 	return devicesResp.Data, nil
 }
 
-// GetCurrentFlowRate retrieves the current flow rate for a device
-// Using the direct flow rate endpoint: /users/{user_id}/devices/{device_id}/query/active
-func (c *FlumeClient) GetCurrentFlowRate(deviceID string) (*FlowRateResponse, error) {
-	// Apply rate limiting
-	c.rateLimiter.Wait()
-
-	// Ensure we have a valid token before making the request
-	if err := c.ensureValidToken(); err != nil {
-		return nil, fmt.Errorf("failed to ensure valid token: %w", err)
+// markSharedDevices flags the devices owned by another user, which Flume lists alongside the user's own
+// devices when they were shared with them. Only resolves the user ID when a device reports an owner
+func (c *FlumeClient) markSharedDevices(devices []Device) {
+	hasOwners := false
+	for _, device := range devices {
+		if device.OwnerID() != 0 {
+			hasOwners = true
+			break
+		}
+	}
+	if !hasOwners {
+		return
 	}
 
-	// Use the direct flow rate endpoint
-	// First get the user ID from the /me endpoint
-	meURL := fmt.Sprintf("%s/me", c.baseURL)
-	meReq, err := http.NewRequest("GET", meURL, nil)
+	c.rateLimiter.Wait()
+	userID, err := c.getUserID(context.Background())
 	if err != nil {
-		return nil, fmt.Errorf("failed to create me request: %w", err)
+		log.Printf("GetDevices: Failed to resolve user ID, treating all devices as owned: %v", err)
+		return
 	}
-
+	for i := range devices {
+		owner := devices[i].OwnerID()
+		devices[i].Shared = owner != 0 && owner != userID
+		if devices[i].Shared {
+			log.Printf("GetDevices: Device %s is shared by user %d", devices[i].ID, owner)
+		}
+	}
+}
+
+// sharedDeviceOwner returns the owner's user ID for a cached shared device, or 0 for the user's own devices
+// Queries for shared devices must use the owner's user ID, since /me only covers the user's own devices
+func (c *FlumeClient) sharedDeviceOwner(deviceID string) int {
+	c.deviceCacheMutex.Lock()
+	defer c.deviceCacheMutex.Unlock()
+
+	for _, device := range c.deviceCache {
+		if device.ID == deviceID && device.Shared {
+			return device.OwnerID()
+		}
+	}
+	return 0
+}
+
+// GetCurrentFlowRate retrieves the current flow rate for a device
+// Using the direct flow rate endpoint: /users/{user_id}/devices/{device_id}/query/active
+func (c *FlumeClient) GetCurrentFlowRate(deviceID string) (*FlowRateResponse, error) {
+	// Apply rate limiting
+	c.rateLimiter.Wait()
+
+	// Ensure we have a valid token before making the request
+	if err := c.ensureValidToken(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to ensure valid token: %w", err)
+	}
+
+	// The flow rate endpoint is keyed by user ID, so resolve it from the /me endpoint first
+	userID, err := c.getUserID(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return c.queryActiveFlow(userID, deviceID)
+}
+
+// FlowRateResult holds the outcome of a single device's flow rate query within a batch
+type FlowRateResult struct {
+	FlowRate *FlowRateResponse
+	Err      error
+	Duration time.Duration
+}
+
+// GetCurrentFlowRates retrieves the current flow rate for several devices, keyed by device ID
+// Flume has no bulk active-flow endpoint, so this resolves the user ID once and then
+// queries each device in turn, saving one /me request per additional device
+func (c *FlumeClient) GetCurrentFlowRates(deviceIDs []string) map[string]FlowRateResult {
+	results := make(map[string]FlowRateResult, len(deviceIDs))
+	if len(deviceIDs) == 0 {
+		return results
+	}
+
+	// Apply rate limiting
+	c.rateLimiter.Wait()
+
+	// Ensure we have a valid token and resolve the user ID shared by every device
+	var userID int
+	err := c.ensureValidToken(context.Background())
+	if err == nil {
+		userID, err = c.getUserID(context.Background())
+	}
+	if err != nil {
+		// Fall back to per-device calls, which retry authentication and user ID resolution individually
+		log.Printf("GetCurrentFlowRates: Batch setup failed, falling back to per-device queries: %v", err)
+		for _, deviceID := range deviceIDs {
+			deviceStart := time.Now()
+			flowRate, err := c.GetCurrentFlowRate(deviceID)
+			results[deviceID] = FlowRateResult{FlowRate: flowRate, Err: err, Duration: time.Since(deviceStart)}
+		}
+		return results
+	}
+
+	for i, deviceID := range deviceIDs {
+		// Each duration covers the device's own rate limiter wait and request, never the batch setup
+		start := time.Now()
+		if i > 0 {
+			c.rateLimiter.Wait()
+		}
+		flowRate, err := c.queryActiveFlow(userID, deviceID)
+		results[deviceID] = FlowRateResult{FlowRate: flowRate, Err: err, Duration: time.Since(start)}
+	}
+
+	return results
+}
+
+// userIDFromCache returns the cached user ID while it is younger than the device cache TTL
+func (c *FlumeClient) userIDFromCache() (int, bool) {
+	c.deviceCacheMutex.Lock()
+	defer c.deviceCacheMutex.Unlock()
+
+	if c.deviceCacheTTL > 0 && c.cachedUserID != 0 && time.Since(c.userIDCacheTime) < c.deviceCacheTTL {
+		return c.cachedUserID, true
+	}
+	return 0, false
+}
+
+// getUserID returns the numeric Flume user ID, from the cache while it is within the device cache TTL
+// The wait between /me retries ends early with ctx's error when ctx is done
+func (c *FlumeClient) getUserID(ctx context.Context) (int, error) {
+	if userID, ok := c.userIDFromCache(); ok {
+		log.Printf("getUserID: Using cached user ID %d", userID)
+		return userID, nil
+	}
+
+	// Retry transient /me failures with backoff, then fall back to the user ID in the JWT claims
+	var userID int
+	var err error
+	for attempt := 1; attempt <= userIDMaxAttempts; attempt++ {
+		if attempt > 1 {
+			wait := authRetryDelay(attempt-1, userIDRetryBackoff, userIDRetryMaxBackoff)
+			log.Printf("getUserID: /me attempt %d/%d failed, retrying in %v: %v", attempt-1, userIDMaxAttempts, wait, err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return 0, fmt.Errorf("user ID retry cancelled: %w", ctx.Err())
+			}
+			if err := c.rateLimiter.WaitContext(ctx); err != nil {
+				return 0, fmt.Errorf("user ID retry cancelled: %w", err)
+			}
+		}
+
+		start := time.Now()
+		userID, err = c.fetchUserID(ctx)
+		if c.metrics != nil {
+			c.metrics.RecordScrapeMetrics("me", time.Since(start), err == nil)
+			c.metrics.RecordScrapeError("me", err)
+		}
+		if err == nil || !isRetryableError(err) {
+			break
+		}
+	}
+	if err != nil {
+		tokenUserID := c.extractUserIDFromToken()
+		if tokenUserID <= 0 {
+			return 0, fmt.Errorf("failed to resolve user ID from /me: %w", err)
+		}
+		log.Printf("getUserID: /me failed, using user ID %d from JWT token: %v", tokenUserID, err)
+		userID = tokenUserID
+	}
+
+	c.deviceCacheMutex.Lock()
+	c.cachedUserID = userID
+	c.userIDCacheTime = time.Now()
+	c.deviceCacheMutex.Unlock()
+	return userID, nil
+}
+
+// User ID resolution retries: attempts per getUserID call and the backoff between them
+const (
+	userIDMaxAttempts     = 3
+	userIDRetryBackoff    = 2 * time.Second
+	userIDRetryMaxBackoff = 10 * time.Second
+)
+
+// fetchUserID resolves the numeric Flume user ID from the /me endpoint, falling back to the JWT claims
+func (c *FlumeClient) fetchUserID(ctx context.Context) (int, error) {
+	meURL := fmt.Sprintf("%s/me", c.baseURL)
+	meReq, err := http.NewRequestWithContext(ctx, "GET", meURL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create me request: %w", err)
+	}
+
 	meReq.Header.Set("Accept", "application/json")
-	meReq.Header.Set("Authorization", "Bearer "+c.accessToken)
+	meReq.Header.Set("Authorization", "Bearer "+c.currentAccessToken())
 
-	meResp, err := c.httpClient.Do(meReq)
+	meResp, err := c.doRequest(meReq, "me")
 	if err != nil {
-		return nil, fmt.Errorf("failed to send me request: %w", err)
+		return 0, fmt.Errorf("failed to send me request: %w", err)
 	}
 	defer meResp.Body.Close()
 
+	// Check for rate limit error first
+	if err := c.checkRateLimitError(meResp, "me"); err != nil {
+		return 0, err
+	}
+
+	if err := c.checkMaintenanceResponse(meResp, "me"); err != nil {
+		return 0, err
+	}
+
 	if meResp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(meResp.Body)
-		return nil, fmt.Errorf("me request failed with status %d: %s", meResp.StatusCode, string(body))
+		body, _ := c.readBody(meResp.Body, "me")
+		return 0, newStatusError("me", meResp.StatusCode, "me request failed with status %d: %s", meResp.StatusCode, c.logBody(body))
 	}
 
 	// Parse user ID from response
-	meBody, _ := io.ReadAll(meResp.Body)
-	log.Printf("GetCurrentFlowRate: /me response body: %s", string(meBody))
+	meBody, err := c.readBody(meResp.Body, "me")
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("getUserID: /me response body: %s", c.logBody(meBody))
 
 	// Try to parse as generic JSON first to see the structure
 	var meData map[string]interface{}
 	if err := json.Unmarshal(meBody, &meData); err != nil {
-		return nil, fmt.Errorf("failed to decode me response: %w", err)
+		return 0, newDecodeError("me", "failed to decode me response: %w", err)
 	}
 
-	log.Printf("GetCurrentFlowRate: /me response structure: %+v", meData)
+	log.Printf("getUserID: /me response structure: %+v", meData)
 
 	// Extract user ID from the response
 	var userID int
@@ -593,38 +1472,38 @@ func (c *FlumeClient) GetCurrentFlowRate(deviceID string) (*FlowRateResponse, er
 			// Try to get user ID from the 'id' field first (as shown in the /me response)
 			if userIDFloat, ok := firstItem["id"].(float64); ok {
 				userID = int(userIDFloat)
-				log.Printf("GetCurrentFlowRate: Found user ID in 'id' field: %d", userID)
+				log.Printf("getUserID: Found user ID in 'id' field: %d", userID)
 			} else if userIDInt, ok := firstItem["id"].(int); ok {
 				userID = userIDInt
-				log.Printf("GetCurrentFlowRate: Found user ID in 'id' field: %d", userID)
+				log.Printf("getUserID: Found user ID in 'id' field: %d", userID)
 			} else if userIDStr, ok := firstItem["id"].(string); ok {
 				// Try to parse string user ID
 				if parsed, err := fmt.Sscanf(userIDStr, "%d", &userID); err != nil || parsed != 1 {
-					return nil, fmt.Errorf("failed to parse id string '%s': %w", userIDStr, err)
+					return 0, newDecodeError("me", "failed to parse id string '%s': %w", userIDStr, err)
 				}
-				log.Printf("GetCurrentFlowRate: Found user ID in 'id' field (string): %d", userID)
+				log.Printf("getUserID: Found user ID in 'id' field (string): %d", userID)
 			} else {
 				// Fallback: try to get from 'user_id' field
 				if userIDFloat, ok := firstItem["user_id"].(float64); ok {
 					userID = int(userIDFloat)
-					log.Printf("GetCurrentFlowRate: Found user ID in 'user_id' field: %d", userID)
+					log.Printf("getUserID: Found user ID in 'user_id' field: %d", userID)
 				} else if userIDInt, ok := firstItem["user_id"].(int); ok {
 					userID = userIDInt
-					log.Printf("GetCurrentFlowRate: Found user ID in 'user_id' field: %d", userID)
+					log.Printf("getUserID: Found user ID in 'user_id' field: %d", userID)
 				} else if userIDStr, ok := firstItem["user_id"].(string); ok {
 					// Try to parse string user ID
 					if parsed, err := fmt.Sscanf(userIDStr, "%d", &userID); err != nil || parsed != 1 {
-						return nil, fmt.Errorf("failed to parse user_id string '%s': %w", userIDStr, err)
+						return 0, newDecodeError("me", "failed to parse user_id string '%s': %w", userIDStr, err)
 					}
-					log.Printf("GetCurrentFlowRate: Found user ID in 'user_id' field (string): %d", userID)
+					log.Printf("getUserID: Found user ID in 'user_id' field (string): %d", userID)
 				} else {
-					log.Printf("GetCurrentFlowRate: Neither 'id' nor 'user_id' field found in /me response")
+					log.Printf("getUserID: Neither 'id' nor 'user_id' field found in /me response")
 					// Final fallback: try to extract from JWT token
 					if userIDFromToken := c.extractUserIDFromToken(); userIDFromToken > 0 {
 						userID = userIDFromToken
-						log.Printf("GetCurrentFlowRate: Using user ID from JWT token: %d", userID)
+						log.Printf("getUserID: Using user ID from JWT token: %d", userID)
 					} else {
-						return nil, fmt.Errorf("could not extract user ID from /me response or JWT token")
+						return 0, newDecodeError("me", "could not extract user ID from /me response or JWT token")
 					}
 				}
 			}
@@ -632,12 +1511,20 @@ func (c *FlumeClient) GetCurrentFlowRate(deviceID string) (*FlowRateResponse, er
 	}
 
 	if userID == 0 {
-		return nil, fmt.Errorf("invalid user ID (0) extracted from /me response")
+		return 0, newDecodeError("me", "invalid user ID (0) extracted from /me response")
 	}
 
-	log.Printf("GetCurrentFlowRate: Extracted user ID: %d", userID)
+	log.Printf("getUserID: Extracted user ID: %d", userID)
+	return userID, nil
+}
+
+// queryActiveFlow queries the active flow endpoint for a single device
+func (c *FlumeClient) queryActiveFlow(userID int, deviceID string) (*FlowRateResponse, error) {
+	if owner := c.sharedDeviceOwner(deviceID); owner != 0 {
+		userID = owner
+	}
 	url := fmt.Sprintf("%s/users/%d/devices/%s/query/active", c.baseURL, userID, deviceID)
-	log.Printf("GetCurrentFlowRate: Querying URL: %s", url)
+	log.Printf("queryActiveFlow: Querying URL: %s", url)
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -645,9 +1532,9 @@ func (c *FlumeClient) GetCurrentFlowRate(deviceID string) (*FlowRateResponse, er
 	}
 
 	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	req.Header.Set("Authorization", "Bearer "+c.currentAccessToken())
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.doRequest(req, "flow_rate")
 	if err != nil {
 		return nil, fmt.Errorf("failed to send flow rate request: %w", err)
 	}
@@ -658,15 +1545,23 @@ func (c *FlumeClient) GetCurrentFlowRate(deviceID string) (*FlowRateResponse, er
 		return nil, err
 	}
 
+	// Maintenance pages come back as HTML rather than JSON
+	if err := c.checkMaintenanceResponse(resp, "flow_rate"); err != nil {
+		return nil, err
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("flow rate request failed with status %d: %s", resp.StatusCode, string(body))
+		body, _ := c.readBody(resp.Body, "flow_rate")
+		return nil, newStatusError("flow_rate", resp.StatusCode, "flow rate request failed with status %d: %s", resp.StatusCode, c.logBody(body))
 	}
 
 	// Read and log the response body for debugging
-	body, _ := io.ReadAll(resp.Body)
-	log.Printf("GetCurrentFlowRate: Response status: %d", resp.StatusCode)
-	log.Printf("GetCurrentFlowRate: Response body: %s", string(body))
+	body, err := c.readBody(resp.Body, "flow_rate")
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("queryActiveFlow: Response status: %d", resp.StatusCode)
+	log.Printf("queryActiveFlow: Response body: %s", c.logBody(body))
 
 	// Parse the response using the correct structure
 	var flowRateResp struct {
@@ -674,15 +1569,21 @@ func (c *FlumeClient) GetCurrentFlowRate(deviceID string) (*FlowRateResponse, er
 		Code    int    `json:"code"`
 		Message string `json:"message"`
 		Data    []struct {
-			Active   bool    `json:"active"`
-			GPM      float64 `json:"gpm"`
-			DateTime string  `json:"datetime"`
+			Active   bool     `json:"active"`
+			GPM      float64  `json:"gpm"`
+			LPM      *float64 `json:"lpm"`
+			Units    string   `json:"units"`
+			DateTime string   `json:"datetime"`
+
+			// Optional sensor readings, not reported by every device
+			PressurePSI *float64 `json:"pressure_psi"`
+			PSI         *float64 `json:"psi"`
 		} `json:"data"`
 		Count int `json:"count"`
 	}
 
 	if err := json.Unmarshal(body, &flowRateResp); err != nil {
-		return nil, fmt.Errorf("failed to decode flow rate response: %w", err)
+		return nil, newDecodeError("flow_rate", "failed to decode flow rate response: %w", err)
 	}
 
 	if !flowRateResp.Success {
@@ -690,117 +1591,185 @@ func (c *FlumeClient) GetCurrentFlowRate(deviceID string) (*FlowRateResponse, er
 	}
 
 	if len(flowRateResp.Data) == 0 {
-		log.Printf("GetCurrentFlowRate: No flow rate data returned")
+		log.Printf("queryActiveFlow: No flow rate data returned")
 		return &FlowRateResponse{
-			Value: 0.0,
-			Units: "gallons_per_minute",
+			Value:  0.0,
+			Units:  "gallons_per_minute",
+			NoData: true,
 		}, nil
 	}
 
 	// Get the most recent flow rate data
 	flowRateData := flowRateResp.Data[0]
-	log.Printf("GetCurrentFlowRate: Flow rate data - Active: %v, GPM: %f, DateTime: %s",
+	log.Printf("queryActiveFlow: Flow rate data - Active: %v, GPM: %f, DateTime: %s",
 		flowRateData.Active, flowRateData.GPM, flowRateData.DateTime)
 
-	// Return the flow rate in gallons per minute
-	return &FlowRateResponse{
-		Value: flowRateData.GPM,
-		Units: "gallons_per_minute",
-	}, nil
-}
-
-// QueryDailyTotalWaterUsage queries daily total water usage data for a device over a date range
-func (c *FlumeClient) QueryDailyTotalWaterUsage(deviceID string, since time.Time, until time.Time) (*DailyTotalWaterUsageResponse, error) {
-	// Apply rate limiting
-	c.rateLimiter.Wait()
-
-	// Ensure we have a valid token before making the request
-	if err := c.ensureValidToken(); err != nil {
-		return nil, fmt.Errorf("failed to ensure valid token: %w", err)
+	// Pick up optional sensor readings when present, accepting either field name
+	pressure := flowRateData.PressurePSI
+	if pressure == nil {
+		pressure = flowRateData.PSI
 	}
-
-	query := Query{
-		RequestID:     "daily_total_water_usage",
-		Bucket:        "DAY",
-		SinceDatetime: since.Format("2006-01-02 15:04:05"),
-		UntilDatetime: until.Format("2006-01-02 15:04:05"),
+	if pressure != nil {
+		log.Printf("queryActiveFlow: Water pressure: %f psi", *pressure)
 	}
 
-	queryReq := QueryRequest{
-		Queries: []Query{query},
+	// Accounts configured for metric units may report liters per minute instead of gallons
+	value, sourceUnits := flowRateData.GPM, flowRateData.Units
+	if flowRateData.LPM != nil && value == 0 {
+		value = *flowRateData.LPM
+		if sourceUnits == "" {
+			sourceUnits = "lpm"
+		}
+	}
+	if sourceUnits != "" {
+		log.Printf("queryActiveFlow: Flow rate reported in '%s'", sourceUnits)
+	}
+	gpm, ok := flowRateToGPM(value, sourceUnits)
+	if !ok {
+		log.Printf("Warning: Unknown flow rate unit '%s' for device %s, reporting the value unconverted", sourceUnits, deviceID)
 	}
 
-	jsonData, err := json.Marshal(queryReq)
+	readingTime, err := UsagePoint{DateTime: flowRateData.DateTime}.TimeIn(c.location)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal query request: %w", err)
+		log.Printf("queryActiveFlow: Ignoring reading time for device %s: %v", deviceID, err)
 	}
 
-	url := fmt.Sprintf("%s/me/devices/%s/query", c.baseURL, deviceID)
-	log.Printf("QueryDailyTotalWaterUsage: Querying URL: %s", url)
-	log.Printf("QueryDailyTotalWaterUsage: Request body: %s", string(jsonData))
-	log.Printf("QueryDailyTotalWaterUsage: Since: %v, Until: %v", since, until)
+	// Return the flow rate in gallons per minute
+	return &FlowRateResponse{
+		Value:       gpm,
+		Units:       "gallons_per_minute",
+		SourceUnits: sourceUnits,
+		Active:      flowRateData.Active,
+		PressurePSI: pressure,
+		ReadingTime: readingTime,
+	}, nil
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create query request: %w", err)
+// litersPerGallon converts between US gallons and liters
+const litersPerGallon = 3.785411784
+
+// flowRateToGPM converts a flow rate reported in units to gallons per minute
+// An empty unit is treated as gallons per minute; ok is false for units that are not recognised
+func flowRateToGPM(value float64, units string) (gpm float64, ok bool) {
+	switch strings.ToLower(strings.TrimSpace(units)) {
+	case "", "gpm", "gallons", "gallons_per_minute", "gal/min":
+		return value, true
+	case "lpm", "liters", "litres", "liters_per_minute", "litres_per_minute", "l/min":
+		return value / litersPerGallon, true
 	}
+	return value, false
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+// QueryOptions describes a single usage query against a device
+type QueryOptions struct {
+	DeviceID string
+	// RequestID names the query; Flume keys the readings by it and it is used as the endpoint label.
+	// Defaults to "water_usage"
+	RequestID string
+	Bucket    string
+	// GroupMultiplier aggregates that many buckets into each reading (see Query); 0 disables grouping
+	GroupMultiplier int
+	Since           time.Time
+	Until           *time.Time // optional
+}
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send query request: %w", err)
-	}
-	defer resp.Body.Close()
+// inflightQuery is a query being sent on behalf of every caller that asked for it while it was in flight
+type inflightQuery struct {
+	done chan struct{}
+	body []byte
+	err  error
+}
 
-	// Check for rate limit error first
-	if err := c.checkRateLimitError(resp, "daily_total_water_usage"); err != nil {
-		return nil, err
+// queryKey identifies identical queries: same device, endpoint and query as sent on the wire
+func queryKey(opts QueryOptions) string {
+	until := ""
+	if opts.Until != nil {
+		until = opts.Until.Format("2006-01-02 15:04:05")
 	}
+	return fmt.Sprintf("%s|%s|%s|%d|%s|%s", opts.DeviceID, opts.RequestID, opts.Bucket, opts.GroupMultiplier,
+		opts.Since.Format("2006-01-02 15:04:05"), until)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("query request failed with status %d: %s", resp.StatusCode, string(body))
+// Query sends a usage query and returns the response body, after rate limiting, status and maintenance checks
+// The typed query methods wrap it and decode the body into their response types
+// Concurrent identical queries (e.g. a collection and an /admin/usage call) share one API request
+func (c *FlumeClient) Query(ctx context.Context, opts QueryOptions) ([]byte, error) {
+	if opts.RequestID == "" {
+		opts.RequestID = "water_usage"
+	}
+	if !validQueryBuckets[opts.Bucket] {
+		return nil, fmt.Errorf("unsupported query bucket '%s'", opts.Bucket)
+	}
+	if opts.GroupMultiplier < 0 {
+		return nil, fmt.Errorf("group multiplier must not be negative, got %d", opts.GroupMultiplier)
 	}
 
-	// Read and log the response body for debugging
-	body, _ := io.ReadAll(resp.Body)
-	log.Printf("QueryDailyTotalWaterUsage: Response status: %d", resp.StatusCode)
-	log.Printf("QueryDailyTotalWaterUsage: Response body: %s", string(body))
-
-	// Create a new reader since we consumed the body
-	bodyReader := bytes.NewReader(body)
+	key := queryKey(opts)
+	c.inflightMutex.Lock()
+	if call, ok := c.inflightQueries[key]; ok {
+		c.inflightMutex.Unlock()
+		log.Printf("Query %s: sharing the in-flight request for device %s", opts.RequestID, opts.DeviceID)
+		if c.metrics != nil {
+			c.metrics.RecordCoalescedRequest(opts.RequestID)
+		}
+		select {
+		case <-call.done:
+			return call.body, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if c.inflightQueries == nil {
+		c.inflightQueries = make(map[string]*inflightQuery)
+	}
+	call := &inflightQuery{done: make(chan struct{})}
+	c.inflightQueries[key] = call
+	c.inflightMutex.Unlock()
 
-	var dailyTotalResp DailyTotalWaterUsageResponse
-	if err := json.NewDecoder(bodyReader).Decode(&dailyTotalResp); err != nil {
-		return nil, fmt.Errorf("failed to decode query response: %w", err)
+	// The request is shared, so one caller giving up must not cancel it for the others; each caller
+	// still stops waiting when its own ctx is done
+	sendCtx, cancel := context.WithoutCancel(ctx), context.CancelFunc(func() {})
+	if c.requestTimeout > 0 {
+		sendCtx, cancel = context.WithTimeout(sendCtx, c.requestTimeout)
 	}
+	go func() {
+		defer cancel()
+		call.body, call.err = c.sendQuery(sendCtx, opts)
 
-	log.Printf("QueryDailyTotalWaterUsage: Parsed response - Count: %d, Data entries: %d",
-		dailyTotalResp.Count, len(dailyTotalResp.Data))
+		c.inflightMutex.Lock()
+		delete(c.inflightQueries, key)
+		c.inflightMutex.Unlock()
+		close(call.done)
+	}()
 
-	return &dailyTotalResp, nil
+	select {
+	case <-call.done:
+		return call.body, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
-// QueryWaterUsage queries water usage data for a device
-func (c *FlumeClient) QueryWaterUsage(deviceID string, bucket string, since time.Time, until *time.Time) (*QueryResponse, error) {
+// sendQuery sends a validated usage query to the API
+func (c *FlumeClient) sendQuery(ctx context.Context, opts QueryOptions) ([]byte, error) {
+	endpoint := opts.RequestID
+
 	// Apply rate limiting
 	c.rateLimiter.Wait()
 
 	// Ensure we have a valid token before making the request
-	if err := c.ensureValidToken(); err != nil {
+	if err := c.ensureValidToken(ctx); err != nil {
 		return nil, fmt.Errorf("failed to ensure valid token: %w", err)
 	}
 
 	query := Query{
-		RequestID:     "water_usage",
-		Bucket:        bucket,
-		SinceDatetime: since.Format("2006-01-02 15:04:05"),
+		RequestID:       opts.RequestID,
+		Bucket:          opts.Bucket,
+		SinceDatetime:   opts.Since.Format("2006-01-02 15:04:05"),
+		GroupMultiplier: opts.GroupMultiplier,
 	}
-
-	if until != nil {
-		query.UntilDatetime = until.Format("2006-01-02 15:04:05")
+	if opts.Until != nil {
+		query.UntilDatetime = opts.Until.Format("2006-01-02 15:04:05")
 	}
 
 	queryReq := QueryRequest{
@@ -812,46 +1781,145 @@ func (c *FlumeClient) QueryWaterUsage(deviceID string, bucket string, since time
 		return nil, fmt.Errorf("failed to marshal query request: %w", err)
 	}
 
-	url := fmt.Sprintf("%s/me/devices/%s/query", c.baseURL, deviceID)
-	log.Printf("QueryWaterUsage: Querying URL: %s", url)
-	log.Printf("QueryWaterUsage: Request body: %s", string(jsonData))
-	log.Printf("QueryWaterUsage: Bucket: %s, Since: %v, Until: %v", bucket, since, until)
+	url := fmt.Sprintf("%s/me/devices/%s/query", c.baseURL, opts.DeviceID)
+	if owner := c.sharedDeviceOwner(opts.DeviceID); owner != 0 {
+		url = fmt.Sprintf("%s/users/%d/devices/%s/query", c.baseURL, owner, opts.DeviceID)
+	}
+	log.Printf("Query %s: Querying URL: %s", endpoint, url)
+	log.Printf("Query %s: Request body: %s", endpoint, c.logBody(jsonData))
+	log.Printf("Query %s: Bucket: %s, Group multiplier: %d, Since: %v, Until: %v", endpoint, opts.Bucket, opts.GroupMultiplier, opts.Since, opts.Until)
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create query request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	req.Header.Set("Authorization", "Bearer "+c.currentAccessToken())
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.doRequest(req, endpoint)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send query request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Check for rate limit error first
-	if err := c.checkRateLimitError(resp, "water_usage"); err != nil {
+	if err := c.checkRateLimitError(resp, endpoint); err != nil {
+		return nil, err
+	}
+
+	// Maintenance pages come back as HTML rather than JSON
+	if err := c.checkMaintenanceResponse(resp, endpoint); err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("query request failed with status %d: %s", resp.StatusCode, string(body))
+		body, _ := c.readBody(resp.Body, endpoint)
+		return nil, newStatusError(endpoint, resp.StatusCode, "query request failed with status %d: %s", resp.StatusCode, c.logBody(body))
 	}
 
 	// Read and log the response body for debugging
-	body, _ := io.ReadAll(resp.Body)
-	log.Printf("QueryWaterUsage: Response status: %d", resp.StatusCode)
-	log.Printf("QueryWaterUsage: Response body: %s", string(body))
+	body, err := c.readBody(resp.Body, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Query %s: Response status: %d", endpoint, resp.StatusCode)
+	log.Printf("Query %s: Response body: %s", endpoint, c.logBody(body))
 
-	// Create a new reader since we consumed the body
-	bodyReader := bytes.NewReader(body)
+	return body, nil
+}
+
+// QueryDailyTotalWaterUsage queries daily total water usage data for a device over a date range
+func (c *FlumeClient) QueryDailyTotalWaterUsage(deviceID string, since time.Time, until time.Time) (*DailyTotalWaterUsageResponse, error) {
+	body, err := c.Query(context.Background(), QueryOptions{
+		DeviceID:  deviceID,
+		RequestID: "daily_total_water_usage",
+		Bucket:    "DAY",
+		Since:     since,
+		Until:     &until,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var dailyTotalResp DailyTotalWaterUsageResponse
+	if err := json.Unmarshal(body, &dailyTotalResp); err != nil {
+		return nil, newDecodeError("daily_total_water_usage", "failed to decode query response: %w", err)
+	}
+
+	log.Printf("QueryDailyTotalWaterUsage: Parsed response - Count: %d, Data entries: %d",
+		dailyTotalResp.Count, len(dailyTotalResp.Data))
+
+	return &dailyTotalResp, nil
+}
+
+// DailyTotalResult holds the outcome of a single device's daily total query within a batch
+type DailyTotalResult struct {
+	Usage    *DailyTotalWaterUsageResponse
+	Err      error
+	Duration time.Duration
+}
+
+// QueryDailyTotalsForDevices queries daily totals for several devices, keyed by device ID
+// Flume's query endpoint is per device with no multi-device variant, so each device still costs one
+// request; the queries run on up to workers goroutines so response times overlap, while the rate
+// limiter keeps spacing the requests themselves
+func (c *FlumeClient) QueryDailyTotalsForDevices(deviceIDs []string, since time.Time, until time.Time, workers int) map[string]DailyTotalResult {
+	results := make(map[string]DailyTotalResult, len(deviceIDs))
+	if len(deviceIDs) == 0 {
+		return results
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	// Refresh the token once up front so the workers do not race to refresh it
+	if err := c.ensureValidToken(context.Background()); err != nil {
+		log.Printf("QueryDailyTotalsForDevices: Token check failed, each query will retry: %v", err)
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for i := 0; i < min(workers, len(deviceIDs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for deviceID := range queue {
+				start := time.Now()
+				usage, err := c.QueryDailyTotalWaterUsage(deviceID, since, until)
+				mutex.Lock()
+				results[deviceID] = DailyTotalResult{Usage: usage, Err: err, Duration: time.Since(start)}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, deviceID := range deviceIDs {
+		queue <- deviceID
+	}
+	close(queue)
+	wg.Wait()
+
+	return results
+}
+
+// QueryWaterUsage queries water usage data for a device
+// A groupMultiplier above 1 aggregates that many buckets into each reading (see Query); 0 disables grouping
+func (c *FlumeClient) QueryWaterUsage(deviceID string, bucket string, groupMultiplier int, since time.Time, until *time.Time) (*QueryResponse, error) {
+	body, err := c.Query(context.Background(), QueryOptions{
+		DeviceID:        deviceID,
+		Bucket:          bucket,
+		GroupMultiplier: groupMultiplier,
+		Since:           since,
+		Until:           until,
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	var queryResp QueryResponse
-	if err := json.NewDecoder(bodyReader).Decode(&queryResp); err != nil {
-		return nil, fmt.Errorf("failed to decode query response: %w", err)
+	if err := json.Unmarshal(body, &queryResp); err != nil {
+		return nil, newDecodeError("water_usage", "failed to decode query response: %w", err)
 	}
 
 	// Set the bucket field manually since the API response doesn't include it
@@ -862,8 +1930,8 @@ func (c *FlumeClient) QueryWaterUsage(deviceID string, bucket string, since time
 	log.Printf("QueryWaterUsage: Parsed response - Count: %d, Data entries: %d",
 		queryResp.Count, len(queryResp.Data))
 
-	if len(queryResp.Data) > 0 && len(queryResp.Data[0].WaterUsage) > 0 {
-		log.Printf("QueryWaterUsage: First data point: %+v", queryResp.Data[0].WaterUsage[0])
+	if len(queryResp.Data) > 0 && len(queryResp.Data[0].Points()) > 0 {
+		log.Printf("QueryWaterUsage: First data point: %+v", queryResp.Data[0].Points()[0])
 	}
 
 	return &queryResp, nil
@@ -872,14 +1940,18 @@ func (c *FlumeClient) QueryWaterUsage(deviceID string, bucket string, since time
 // ValidateAuthentication checks if the current authentication is working by making a test API call
 // This method is optimized to only make API calls when necessary
 func (c *FlumeClient) ValidateAuthentication() error {
-	if c.accessToken == "" {
+	c.tokenMutex.Lock()
+	accessToken, tokenExpiry, expired := c.accessToken, c.tokenExpiry, c.isTokenExpiredLocked()
+	c.tokenMutex.Unlock()
+
+	if accessToken == "" {
 		return fmt.Errorf("no access token available")
 	}
 
 	// If token is not expired and we have a valid expiry time, assume it's working
 	// Only make API calls when we actually need to verify
-	if !c.isTokenExpired() && !c.tokenExpiry.IsZero() {
-		log.Printf("Token appears valid (expires at %v), skipping API validation", c.tokenExpiry)
+	if !expired && !tokenExpiry.IsZero() {
+		log.Printf("Token appears valid (expires at %v), skipping API validation", tokenExpiry)
 		return nil
 	}
 
@@ -892,24 +1964,28 @@ func (c *FlumeClient) ValidateAuthentication() error {
 		return fmt.Errorf("failed to create validation request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.doRequest(req, "me")
 	if err != nil {
 		return fmt.Errorf("failed to send validation request: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if err := c.checkRateLimitError(resp, "me"); err != nil {
+		return err
+	}
+
 	if resp.StatusCode == http.StatusUnauthorized {
 		// Token is invalid, clear it and force re-authentication
 		log.Printf("Validation failed: Token is unauthorized, clearing tokens")
 		c.clearTokens()
-		return fmt.Errorf("authentication token is invalid")
+		return newStatusError("me", resp.StatusCode, "authentication token is invalid")
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("validation request failed with status %d: %s", resp.StatusCode, string(body))
+		body, _ := c.readBody(resp.Body, "me")
+		return newStatusError("me", resp.StatusCode, "validation request failed with status %d: %s", resp.StatusCode, c.logBody(body))
 	}
 
 	log.Printf("Authentication validation successful")
@@ -918,13 +1994,16 @@ func (c *FlumeClient) ValidateAuthentication() error {
 
 // GetAuthenticationStatus returns the current authentication status without making API calls
 func (c *FlumeClient) GetAuthenticationStatus() map[string]interface{} {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+
 	status := map[string]interface{}{
 		"has_access_token":  c.accessToken != "",
 		"has_refresh_token": c.refreshToken != "",
 		"token_expiry":      c.tokenExpiry,
-		"is_expired":        c.isTokenExpired(),
-		"is_expiring_soon":  c.isTokenExpiringSoon(),
-		"needs_auth":        c.needsAuthentication(),
+		"is_expired":        c.isTokenExpiredLocked(),
+		"is_expiring_soon":  c.isTokenExpiringSoonLocked(),
+		"needs_auth":        c.needsAuthenticationLocked(),
 		"token_file":        c.tokenFile,
 	}
 
@@ -947,7 +2026,7 @@ func (c *FlumeClient) GetDetailedAuthenticationStatus() map[string]interface{} {
 	status := c.GetAuthenticationStatus()
 
 	// Add API validation status
-	if c.accessToken != "" && !c.isTokenExpired() {
+	if state := c.tokenState(); state.hasAccessToken && !state.expired {
 		// Only make API call if token appears valid
 		if err := c.ValidateAuthentication(); err != nil {
 			status["api_validation"] = "failed"
@@ -963,47 +2042,385 @@ func (c *FlumeClient) GetDetailedAuthenticationStatus() map[string]interface{} {
 	return status
 }
 
-// extractUserIDFromToken extracts the user ID from the JWT access token
-func (c *FlumeClient) extractUserIDFromToken() int {
+// tokenClaimsFields holds the JWT claims the exporter inspects
+type tokenClaimsFields struct {
+	UserID   int
+	Expiry   time.Time
+	Scope    string
+	Audience string
+}
+
+// jwtExpiryTolerance is how far the JWT exp claim may drift from the expires_in derived expiry before the JWT wins
+const jwtExpiryTolerance = 5 * time.Minute
+
+// decodeTokenClaims decodes the payload of the JWT access token without verifying its signature
+// Callers must hold tokenMutex
+func (c *FlumeClient) decodeTokenClaims() (map[string]interface{}, bool) {
 	if c.accessToken == "" {
-		return 0
+		return nil, false
 	}
 
 	// JWT tokens have 3 parts separated by dots
 	parts := strings.Split(c.accessToken, ".")
 	if len(parts) != 3 {
-		return 0
+		return nil, false
 	}
 
 	// Decode the payload (second part)
 	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		return 0
+		return nil, false
 	}
 
 	// Parse the JSON payload
 	var claims map[string]interface{}
 	if err := json.Unmarshal(payload, &claims); err != nil {
-		return 0
+		return nil, false
+	}
+
+	return claims, true
+}
+
+// extractTokenClaims extracts the user ID, expiry, scope and audience from the JWT access token
+// Callers must hold tokenMutex
+func (c *FlumeClient) extractTokenClaims() (tokenClaimsFields, bool) {
+	var fields tokenClaimsFields
+
+	claims, ok := c.decodeTokenClaims()
+	if !ok {
+		return fields, false
 	}
 
 	// Extract user_id from claims
 	if userID, ok := claims["user_id"]; ok {
 		switch v := userID.(type) {
 		case float64:
-			return int(v)
+			fields.UserID = int(v)
 		case int:
-			return v
+			fields.UserID = v
 		case string:
 			if parsed, err := strconv.Atoi(v); err == nil {
-				return parsed
+				fields.UserID = parsed
 			}
 		}
 	}
 
+	if exp, ok := claims["exp"].(float64); ok && exp > 0 {
+		fields.Expiry = time.Unix(int64(exp), 0)
+	}
+
+	if scope, ok := claims["scope"].(string); ok {
+		fields.Scope = scope
+	}
+
+	// aud may be a single string or a list of strings
+	switch aud := claims["aud"].(type) {
+	case string:
+		fields.Audience = aud
+	case []interface{}:
+		var audiences []string
+		for _, a := range aud {
+			if str, ok := a.(string); ok {
+				audiences = append(audiences, str)
+			}
+		}
+		fields.Audience = strings.Join(audiences, ",")
+	}
+
+	return fields, true
+}
+
+// extractUserIDFromToken extracts the user ID from the JWT access token
+func (c *FlumeClient) extractUserIDFromToken() int {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+
+	fields, ok := c.extractTokenClaims()
+	if !ok {
+		return 0
+	}
+	return fields.UserID
+}
+
+// reconcileTokenExpiry compares the JWT exp claim with the expiry derived from expires_in
+// When they disagree by more than jwtExpiryTolerance the JWT is treated as authoritative; callers must hold tokenMutex
+func (c *FlumeClient) reconcileTokenExpiry() {
+	fields, ok := c.extractTokenClaims()
+	if !ok {
+		return
+	}
+
+	if fields.Scope != "" || fields.Audience != "" {
+		log.Printf("Token claims: scope=%q, audience=%q", fields.Scope, fields.Audience)
+	}
+	if c.metrics != nil {
+		c.metrics.SetTokenClaims(fields.Expiry, fields.Scope, fields.Audience)
+	}
+
+	if fields.Expiry.IsZero() {
+		return
+	}
+
+	drift := fields.Expiry.Sub(c.tokenExpiry)
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > jwtExpiryTolerance {
+		log.Printf("Warning: JWT exp (%v) differs from computed token expiry (%v) by %v, using JWT exp", fields.Expiry, c.tokenExpiry, drift)
+		c.tokenExpiry = fields.Expiry
+	}
+}
+
+// recordOAuthMetrics records a token exchange under the oauth endpoint label and counts it as a refresh
+// or a full authentication
+func (c *FlumeClient) recordOAuthMetrics(refresh bool, duration time.Duration, err error) {
+	if c.metrics == nil {
+		return
+	}
+	if refresh {
+		c.metrics.RecordTokenRefresh(err == nil)
+	} else {
+		c.metrics.RecordFullAuth(err == nil)
+	}
+	c.metrics.RecordScrapeMetrics("oauth", duration, err == nil)
+	c.metrics.RecordScrapeError("oauth", err)
+}
+
+// requestIDHeader carries the per-request correlation ID sent to Flume
+const requestIDHeader = "X-Request-Id"
+
+// doRequest sends req with a fresh correlation ID and logs it alongside the endpoint and response status,
+// plus any request ID Flume echoes back, so exporter requests can be matched with Flume's server logs
+func (c *FlumeClient) doRequest(req *http.Request, endpoint string) (*http.Response, error) {
+	requestID := newRequestID()
+	req.Header.Set(requestIDHeader, requestID)
+
+	if err := c.reserveRequest(req.Context(), endpoint); err != nil {
+		return nil, err
+	}
+	if c.metrics != nil {
+		c.metrics.RecordAPIRequest(endpoint)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		log.Printf("doRequest: %s request %s failed: %v", endpoint, requestID, err)
+		c.lastResponses.addError(endpoint, requestID, err)
+		return nil, err
+	}
+	c.lastResponses.capture(endpoint, requestID, resp)
+	c.adaptRateLimit(resp, endpoint)
+
+	if upstreamID := resp.Header.Get(requestIDHeader); upstreamID != "" && upstreamID != requestID {
+		log.Printf("doRequest: %s request %s returned status %d (Flume request ID %s)", endpoint, requestID, resp.StatusCode, upstreamID)
+	} else {
+		log.Printf("doRequest: %s request %s returned status %d", endpoint, requestID, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// adaptRateLimit widens the rate limiter's interval after a 429, honouring Retry-After, and narrows it
+// again after successful responses
+func (c *FlumeClient) adaptRateLimit(resp *http.Response, endpoint string) {
+	var interval time.Duration
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		interval = c.rateLimiter.Backoff(retryAfter)
+		log.Printf("Rate limited on %s (Retry-After %s), spacing API requests by %s", endpoint, retryAfter, interval)
+	} else if resp.StatusCode < 400 {
+		var changed bool
+		if interval, changed = c.rateLimiter.Recover(); !changed {
+			return
+		}
+		log.Printf("Request to %s succeeded, spacing API requests by %s", endpoint, interval)
+	} else {
+		return
+	}
+
+	if c.metrics != nil {
+		c.metrics.SetEffectiveAPIInterval(interval)
+	}
+}
+
+// SetRequestPacing changes the spacing between API requests, e.g. to spread them evenly across the hour
+func (c *FlumeClient) SetRequestPacing(interval time.Duration) {
+	c.rateLimiter.SetBase(interval)
+	if c.metrics != nil {
+		c.metrics.SetEffectiveAPIInterval(c.rateLimiter.EffectiveInterval())
+	}
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date, returning 0 if absent or invalid
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now).Round(time.Second)
+	}
 	return 0
 }
 
+// quotaReserveFraction is the share of the hourly quota kept for flow rate queries;
+// once fewer requests than this remain, low-priority usage queries are deferred
+const quotaReserveFraction = 0.2
+
+// Modes for the hard request cap once it is reached
+const (
+	RequestBudgetBlock = "block" // wait until a request leaves the trailing hour
+	RequestBudgetSkip  = "skip"  // fail the request with ErrRequestBudgetExhausted
+)
+
+// reserveRequest records an outbound request for the trailing-hour quota estimate, first enforcing the
+// hard request cap: once the trailing hour holds maxRequests requests it blocks until the oldest one ages
+// out (or ctx is done), or fails the request in skip mode. Token requests always fail fast: they are sent
+// with tokenMutex held, so waiting would stall every caller queued for the token. The check and the
+// record are atomic, so concurrent workers cannot overshoot the cap
+func (c *FlumeClient) reserveRequest(ctx context.Context, endpoint string) error {
+	failFast := c.maxRequestsMode == RequestBudgetSkip || endpoint == "token"
+	for {
+		c.requestTimesMutex.Lock()
+		now := time.Now()
+		c.pruneRequestTimes(now)
+		if c.maxRequests <= 0 || len(c.requestTimes) < c.maxRequests {
+			c.requestTimes = append(c.requestTimes, now)
+			c.requestsSent++
+			c.budgetExhausted = false
+			c.requestTimesMutex.Unlock()
+			c.updateQuotaMetric()
+			return nil
+		}
+
+		wait := c.requestTimes[0].Add(time.Hour).Sub(now)
+		if !c.budgetExhausted {
+			action := "blocking"
+			if failFast {
+				action = "skipping"
+			}
+			log.Printf("Request budget of %d per hour reached; %s requests until one frees up in %s", c.maxRequests, action, wait.Round(time.Second))
+			c.budgetExhausted = true
+		}
+		c.requestTimesMutex.Unlock()
+
+		if failFast {
+			return &APIError{
+				Endpoint: endpoint,
+				Class:    ErrorClassRateLimited,
+				Err:      fmt.Errorf("%w: skipped %s request (limit %d per hour)", ErrRequestBudgetExhausted, endpoint, c.maxRequests),
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for request budget: %w", ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+}
+
+// pruneRequestTimes drops requests that have left the trailing hour; callers must hold requestTimesMutex
+func (c *FlumeClient) pruneRequestTimes(now time.Time) {
+	cutoff := now.Add(-time.Hour)
+	i := 0
+	for i < len(c.requestTimes) && c.requestTimes[i].Before(cutoff) {
+		i++
+	}
+	c.requestTimes = c.requestTimes[i:]
+}
+
+// RequestsSent returns how many API requests the client has sent since startup
+func (c *FlumeClient) RequestsSent() int64 {
+	c.requestTimesMutex.Lock()
+	defer c.requestTimesMutex.Unlock()
+
+	return c.requestsSent
+}
+
+// QuotaRemaining estimates how many requests are left in the trailing hour
+// Returns -1 when no quota is configured
+func (c *FlumeClient) QuotaRemaining() int {
+	if c.hourlyQuota <= 0 {
+		return -1
+	}
+
+	c.requestTimesMutex.Lock()
+	defer c.requestTimesMutex.Unlock()
+
+	c.pruneRequestTimes(time.Now())
+	remaining := c.hourlyQuota - len(c.requestTimes)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining
+}
+
+// NearQuota reports whether the trailing hour's requests are close enough to the quota
+// that low-priority queries should be deferred
+func (c *FlumeClient) NearQuota() bool {
+	remaining := c.QuotaRemaining()
+	return remaining >= 0 && float64(remaining) <= float64(c.hourlyQuota)*quotaReserveFraction
+}
+
+// updateQuotaMetric publishes the current quota estimate
+func (c *FlumeClient) updateQuotaMetric() {
+	if c.metrics == nil {
+		return
+	}
+	if remaining := c.QuotaRemaining(); remaining >= 0 {
+		c.metrics.SetQuotaRemaining(remaining)
+	}
+
+	c.requestTimesMutex.Lock()
+	c.pruneRequestTimes(time.Now())
+	sent := len(c.requestTimes)
+	c.requestTimesMutex.Unlock()
+	c.metrics.SetRequestsThisHour(sent)
+	if c.maxRequests > 0 {
+		c.metrics.SetRequestBudgetRemaining(max(c.maxRequests-sent, 0))
+	}
+}
+
+// newRequestID generates a random (version 4) UUID for request correlation
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// Fall back to a time-based ID; correlation is best-effort
+		return fmt.Sprintf("%032x", time.Now().UnixNano())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// readBody reads a response body, refusing to buffer more than the configured maximum size
+func (c *FlumeClient) readBody(body io.Reader, endpoint string) ([]byte, error) {
+	if c.maxBodySize <= 0 {
+		return io.ReadAll(body)
+	}
+
+	// Read one byte past the limit so an oversized body can be detected
+	data, err := io.ReadAll(io.LimitReader(body, c.maxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response body: %w", endpoint, err)
+	}
+	if int64(len(data)) > c.maxBodySize {
+		return data[:c.maxBodySize], newDecodeError(endpoint, "%s response body exceeds maximum size of %d bytes", endpoint, c.maxBodySize)
+	}
+
+	return data, nil
+}
+
+// logBody returns a response body for logging, truncated to the configured maximum length
+func (c *FlumeClient) logBody(body []byte) string {
+	if c.maxLogBody <= 0 || len(body) <= c.maxLogBody {
+		return string(body)
+	}
+	return string(body[:c.maxLogBody]) + "...[truncated]"
+}
+
 // min returns the minimum of two integers
 func min(a, b int) int {
 	if a < b {
@@ -1012,6 +2429,28 @@ func min(a, b int) int {
 	return b
 }
 
+// checkMaintenanceResponse detects Flume maintenance windows, a 503 or an HTML page served with a 2xx status,
+// and returns an ErrServiceUnavailable error instead of attempting to decode the response
+// Other statuses, whatever their Content-Type, are left to the caller's usual status handling
+func (c *FlumeClient) checkMaintenanceResponse(resp *http.Response, endpoint string) error {
+	contentType := resp.Header.Get("Content-Type")
+	htmlPage := resp.StatusCode >= 200 && resp.StatusCode < 300 && strings.Contains(strings.ToLower(contentType), "html")
+	if resp.StatusCode != http.StatusServiceUnavailable && !htmlPage {
+		return nil
+	}
+
+	log.Printf("Maintenance response from endpoint %s (status %d, Content-Type %q)", endpoint, resp.StatusCode, contentType)
+	if c.metrics != nil {
+		c.metrics.RecordMaintenanceResponse(endpoint)
+	}
+	return &APIError{
+		Endpoint:   endpoint,
+		Class:      ErrorClassServerError,
+		StatusCode: resp.StatusCode,
+		Err:        fmt.Errorf("%w: endpoint %s returned status %d with Content-Type %q", ErrServiceUnavailable, endpoint, resp.StatusCode, contentType),
+	}
+}
+
 // checkRateLimitError checks if the response indicates a rate limit error (429) and records it
 func (c *FlumeClient) checkRateLimitError(resp *http.Response, endpoint string) error {
 	if resp.StatusCode == http.StatusTooManyRequests { // 429
@@ -1020,7 +2459,7 @@ func (c *FlumeClient) checkRateLimitError(resp *http.Response, endpoint string)
 		if c.metrics != nil {
 			c.metrics.RecordRateLimitError(endpoint)
 		}
-		return fmt.Errorf("rate limit exceeded (429) for endpoint %s", endpoint)
+		return newStatusError(endpoint, resp.StatusCode, "rate limit exceeded (429) for endpoint %s", endpoint)
 	}
 	return nil
 }
@@ -0,0 +1,1211 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// stubResponse is a canned API response
+type stubResponse struct {
+	status int
+	body   string
+}
+
+// stubDoer is an HTTPDoer that answers requests from handler and records the paths it was asked for
+type stubDoer struct {
+	handler func(req *http.Request) stubResponse
+
+	mutex sync.Mutex
+	paths []string
+}
+
+// Do records the request and returns handler's response for it
+func (d *stubDoer) Do(req *http.Request) (*http.Response, error) {
+	d.mutex.Lock()
+	d.paths = append(d.paths, req.URL.Path)
+	d.mutex.Unlock()
+
+	resp := d.handler(req)
+	return fixtureResponse(req, resp.status, []byte(resp.body)), nil
+}
+
+// calls returns how many requests were sent to path
+func (d *stubDoer) calls(path string) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	count := 0
+	for _, p := range d.paths {
+		if p == path {
+			count++
+		}
+	}
+	return count
+}
+
+// stubRoutes answers requests with the body registered for their path, or a 404
+func stubRoutes(routes map[string]string) func(req *http.Request) stubResponse {
+	return func(req *http.Request) stubResponse {
+		if body, ok := routes[req.URL.Path]; ok {
+			return stubResponse{status: http.StatusOK, body: body}
+		}
+		return stubResponse{status: http.StatusNotFound, body: `{"success":false}`}
+	}
+}
+
+// newTestConfig returns a configuration for tests: no request pacing and a token file in a temporary directory
+func newTestConfig(t *testing.T) *Config {
+	t.Helper()
+
+	config := NewConfig()
+	config.BaseURL = "https://flume.test"
+	config.ClientID = "client"
+	config.ClientSecret = "secret"
+	config.Username = "user@example.com"
+	config.Password = "password"
+	config.TokenFile = filepath.Join(t.TempDir(), "tokens.json")
+	config.APIMinInterval = 0
+	return config
+}
+
+// newTestClient creates a client that sends its requests to handler and already holds a valid access token
+func newTestClient(t *testing.T, config *Config, handler func(req *http.Request) stubResponse) (*FlumeClient, *stubDoer) {
+	t.Helper()
+
+	doer := &stubDoer{handler: handler}
+	client := NewFlumeClientWithHTTP(config, NewMetricsWithRegisterer(prometheus.NewRegistry()), doer)
+	client.accessToken = "test-token"
+	client.refreshToken = "test-refresh"
+	client.tokenExpiry = time.Now().Add(24 * time.Hour)
+	client.hasAuthenticated = true
+	return client, doer
+}
+
+const testDevicesBody = `{"count":2,"data":[{"id":"d1","type":2,"location":{"name":"Home"}},{"id":"d2","type":2,"location":{"name":"Cabin"}}]}`
+
+func TestGetDevicesThroughHTTPDoer(t *testing.T) {
+	var authorization string
+	routes := stubRoutes(map[string]string{"/me/devices": testDevicesBody})
+	client, doer := newTestClient(t, newTestConfig(t), func(req *http.Request) stubResponse {
+		authorization = req.Header.Get("Authorization")
+		return routes(req)
+	})
+
+	devices, err := client.GetDevices()
+	if err != nil {
+		t.Fatalf("GetDevices: %v", err)
+	}
+	if len(devices) != 2 || devices[0].ID != "d1" || devices[1].Location.Name != "Cabin" {
+		t.Errorf("devices = %+v, want d1 and d2", devices)
+	}
+	if authorization != "Bearer test-token" {
+		t.Errorf("Authorization = %q, want the access token", authorization)
+	}
+	if n := doer.calls("/me/devices"); n != 1 {
+		t.Errorf("/me/devices called %d times, want 1", n)
+	}
+}
+
+func TestGetDevicesClassifiesStatusErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		want   ErrorClass
+	}{
+		{http.StatusUnauthorized, ErrorClassUnauthorized},
+		{http.StatusInternalServerError, ErrorClassServerError},
+		{http.StatusGatewayTimeout, ErrorClassTimeout},
+	}
+	for _, tt := range tests {
+		client, _ := newTestClient(t, newTestConfig(t), func(req *http.Request) stubResponse {
+			return stubResponse{status: tt.status, body: `{"success":false}`}
+		})
+
+		_, err := client.GetDevices()
+		if err == nil {
+			t.Fatalf("status %d: GetDevices succeeded, want an error", tt.status)
+		}
+		if got := classifyError(err); got != tt.want {
+			t.Errorf("status %d: error class = %s, want %s", tt.status, got, tt.want)
+		}
+	}
+}
+
+// recordingTransport is an http.RoundTripper that records requests and answers them from routes
+type recordingTransport struct {
+	routes   map[string]string
+	requests []*http.Request
+}
+
+// RoundTrip records req and serves the route registered for its path
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests = append(rt.requests, req)
+	resp := stubRoutes(rt.routes)(req)
+	return fixtureResponse(req, resp.status, []byte(resp.body)), nil
+}
+
+func TestNewFlumeClientWithTransport(t *testing.T) {
+	transport := &recordingTransport{routes: map[string]string{"/me/devices": testDevicesBody}}
+	client := NewFlumeClientWithTransport(newTestConfig(t), NewMetricsWithRegisterer(prometheus.NewRegistry()), transport)
+	client.accessToken = "test-token"
+	client.tokenExpiry = time.Now().Add(24 * time.Hour)
+
+	devices, err := client.GetDevices()
+	if err != nil {
+		t.Fatalf("GetDevices: %v", err)
+	}
+	if len(devices) != 2 {
+		t.Errorf("got %d devices, want 2", len(devices))
+	}
+	if len(transport.requests) != 1 {
+		t.Fatalf("transport saw %d requests, want 1", len(transport.requests))
+	}
+	req := transport.requests[0]
+	if req.URL.String() != "https://flume.test/me/devices" {
+		t.Errorf("request URL = %s", req.URL)
+	}
+	if req.Header.Get(requestIDHeader) == "" {
+		t.Errorf("request has no %s header", requestIDHeader)
+	}
+}
+
+func TestGetDevicesCache(t *testing.T) {
+	client, doer := newTestClient(t, newTestConfig(t), stubRoutes(map[string]string{"/me/devices": testDevicesBody}))
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.GetDevices(); err != nil {
+			t.Fatalf("GetDevices: %v", err)
+		}
+	}
+	if n := doer.calls("/me/devices"); n != 1 {
+		t.Fatalf("within the TTL /me/devices was called %d times, want 1", n)
+	}
+
+	// An expired entry is re-fetched
+	client.deviceCacheMutex.Lock()
+	client.deviceCacheTime = time.Now().Add(-2 * time.Hour)
+	client.deviceCacheMutex.Unlock()
+	if _, err := client.GetDevices(); err != nil {
+		t.Fatalf("GetDevices: %v", err)
+	}
+	if n := doer.calls("/me/devices"); n != 2 {
+		t.Fatalf("after the TTL /me/devices was called %d times, want 2", n)
+	}
+
+	// So is an invalidated one
+	client.InvalidateDeviceCache()
+	if _, err := client.GetDevices(); err != nil {
+		t.Fatalf("GetDevices: %v", err)
+	}
+	if n := doer.calls("/me/devices"); n != 3 {
+		t.Fatalf("after invalidation /me/devices was called %d times, want 3", n)
+	}
+}
+
+func TestGetDevicesCacheDisabled(t *testing.T) {
+	config := newTestConfig(t)
+	config.DeviceCacheTTL = 0
+	client, doer := newTestClient(t, config, stubRoutes(map[string]string{"/me/devices": testDevicesBody}))
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetDevices(); err != nil {
+			t.Fatalf("GetDevices: %v", err)
+		}
+	}
+	if n := doer.calls("/me/devices"); n != 2 {
+		t.Errorf("with caching disabled /me/devices was called %d times, want 2", n)
+	}
+}
+
+func TestGetDevicesUnauthorizedDropsCache(t *testing.T) {
+	status := http.StatusOK
+	client, doer := newTestClient(t, newTestConfig(t), func(req *http.Request) stubResponse {
+		return stubResponse{status: status, body: testDevicesBody}
+	})
+	if _, err := client.GetDevices(); err != nil {
+		t.Fatalf("GetDevices: %v", err)
+	}
+
+	// A 401 on a forced re-fetch drops the cached list, so the next call fetches again
+	status = http.StatusUnauthorized
+	if _, err := client.fetchDevices(); err == nil {
+		t.Fatal("fetchDevices succeeded on a 401")
+	}
+	status = http.StatusOK
+	if _, err := client.GetDevices(); err != nil {
+		t.Fatalf("GetDevices: %v", err)
+	}
+	if n := doer.calls("/me/devices"); n != 3 {
+		t.Errorf("/me/devices was called %d times, want 3", n)
+	}
+}
+
+const testMeBody = `{"success":true,"data":[{"id":123}],"count":1}`
+
+// readTestdata returns the contents of a file in testdata
+func readTestdata(t *testing.T, name string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// newFlowRateClient creates a client whose active flow query for device d1 returns the testdata file fixture
+func newFlowRateClient(t *testing.T, fixture string) *FlumeClient {
+	t.Helper()
+
+	client, _ := newTestClient(t, newTestConfig(t), stubRoutes(map[string]string{
+		"/me":                                testMeBody,
+		"/users/123/devices/d1/query/active": readTestdata(t, fixture),
+	}))
+	return client
+}
+
+func TestGetCurrentFlowRateSensorFields(t *testing.T) {
+	tests := []struct {
+		fixture  string
+		active   bool
+		pressure *float64
+	}{
+		{"active_basic.json", true, nil},
+		{"active_pressure.json", true, ptr(62.5)},
+		{"active_psi.json", false, ptr(48.0)},
+	}
+	for _, tt := range tests {
+		flowRate, err := newFlowRateClient(t, tt.fixture).GetCurrentFlowRate("d1")
+		if err != nil {
+			t.Fatalf("%s: GetCurrentFlowRate: %v", tt.fixture, err)
+		}
+		if flowRate.Active != tt.active {
+			t.Errorf("%s: active = %v, want %v", tt.fixture, flowRate.Active, tt.active)
+		}
+		switch {
+		case tt.pressure == nil && flowRate.PressurePSI != nil:
+			t.Errorf("%s: pressure = %v, want none", tt.fixture, *flowRate.PressurePSI)
+		case tt.pressure != nil && (flowRate.PressurePSI == nil || *flowRate.PressurePSI != *tt.pressure):
+			t.Errorf("%s: pressure = %v, want %v", tt.fixture, flowRate.PressurePSI, *tt.pressure)
+		}
+	}
+}
+
+func TestGetCurrentFlowRateUnits(t *testing.T) {
+	tests := []struct {
+		fixture     string
+		gpm         float64
+		sourceUnits string
+	}{
+		{"active_basic.json", 1.5, ""},
+		{"active_lpm.json", 2, "lpm"},
+		{"active_units.json", 1, "liters_per_minute"},
+		// Unknown units are reported unconverted rather than dropped
+		{"active_unknown_units.json", 4, "cubic_feet_per_hour"},
+	}
+	for _, tt := range tests {
+		flowRate, err := newFlowRateClient(t, tt.fixture).GetCurrentFlowRate("d1")
+		if err != nil {
+			t.Fatalf("%s: GetCurrentFlowRate: %v", tt.fixture, err)
+		}
+		if math.Abs(flowRate.Value-tt.gpm) > 1e-9 {
+			t.Errorf("%s: value = %v, want %v", tt.fixture, flowRate.Value, tt.gpm)
+		}
+		if flowRate.Units != "gallons_per_minute" || flowRate.SourceUnits != tt.sourceUnits {
+			t.Errorf("%s: units = %q from %q, want gallons_per_minute from %q", tt.fixture, flowRate.Units, flowRate.SourceUnits, tt.sourceUnits)
+		}
+	}
+}
+
+func TestFlowRateToGPM(t *testing.T) {
+	tests := []struct {
+		units string
+		gpm   float64
+		ok    bool
+	}{
+		{"", 10, true},
+		{"gpm", 10, true},
+		{" Gallons_Per_Minute ", 10, true},
+		{"LPM", 10 / litersPerGallon, true},
+		{"l/min", 10 / litersPerGallon, true},
+		{"m3/h", 10, false},
+	}
+	for _, tt := range tests {
+		gpm, ok := flowRateToGPM(10, tt.units)
+		if gpm != tt.gpm || ok != tt.ok {
+			t.Errorf("flowRateToGPM(10, %q) = %v, %v, want %v, %v", tt.units, gpm, ok, tt.gpm, tt.ok)
+		}
+	}
+}
+
+// ptr returns a pointer to v
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestOversizedResponseBody(t *testing.T) {
+	config := newTestConfig(t)
+	config.MaxResponseBodySize = 1024
+	oversized := `{"success":true,"data":[],"padding":"` + strings.Repeat("x", 4096) + `"}`
+	client, _ := newTestClient(t, config, func(req *http.Request) stubResponse {
+		return stubResponse{status: http.StatusOK, body: oversized}
+	})
+
+	_, err := client.GetDevices()
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum size of 1024 bytes") {
+		t.Errorf("GetDevices error = %v, want the size limit error", err)
+	}
+	if classifyError(err) != ErrorClassDecodeError {
+		t.Errorf("error class = %s, want %s", classifyError(err), ErrorClassDecodeError)
+	}
+
+	if err := client.Authenticate(context.Background()); err == nil || !strings.Contains(err.Error(), "exceeds maximum size") {
+		t.Errorf("Authenticate error = %v, want the size limit error", err)
+	}
+}
+
+func TestCheckMaintenanceResponse(t *testing.T) {
+	client, _ := newTestClient(t, newTestConfig(t), stubRoutes(nil))
+	tests := []struct {
+		status      int
+		contentType string
+		maintenance bool
+	}{
+		{http.StatusOK, "application/json", false},
+		{http.StatusOK, "text/html; charset=utf-8", true},
+		{http.StatusServiceUnavailable, "text/html", true},
+		{http.StatusServiceUnavailable, "application/json", true},
+		// Other errors keep their status classification, even with an HTML body
+		{http.StatusUnauthorized, "text/html", false},
+		{http.StatusBadGateway, "text/plain", false},
+		{http.StatusTooManyRequests, "text/html", false},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: http.Header{"Content-Type": {tt.contentType}}}
+		err := client.checkMaintenanceResponse(resp, "devices")
+		if got := errors.Is(err, ErrServiceUnavailable); got != tt.maintenance {
+			t.Errorf("status %d with %s: maintenance = %v (%v), want %v", tt.status, tt.contentType, got, err, tt.maintenance)
+		}
+	}
+}
+
+func TestReadBodyLimit(t *testing.T) {
+	client, _ := newTestClient(t, newTestConfig(t), stubRoutes(nil))
+	client.maxBodySize = 4
+
+	if data, err := client.readBody(strings.NewReader("1234"), "test"); err != nil || string(data) != "1234" {
+		t.Errorf("body at the limit: got %q, %v", data, err)
+	}
+	if _, err := client.readBody(strings.NewReader("12345"), "test"); err == nil {
+		t.Error("body over the limit was accepted")
+	}
+
+	client.maxBodySize = 0
+	if data, err := client.readBody(strings.NewReader("12345"), "test"); err != nil || string(data) != "12345" {
+		t.Errorf("unlimited body: got %q, %v", data, err)
+	}
+}
+
+// testJWT builds an unsigned JWT with the given payload claims
+func testJWT(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
+
+func TestExtractTokenClaims(t *testing.T) {
+	exp := time.Unix(4102444800, 0)
+	tests := []struct {
+		name   string
+		token  string
+		ok     bool
+		fields tokenClaimsFields
+	}{
+		{
+			name:   "numeric user ID and string audience",
+			token:  testJWT(t, map[string]interface{}{"user_id": 123, "exp": exp.Unix(), "scope": "read", "aud": "flume"}),
+			ok:     true,
+			fields: tokenClaimsFields{UserID: 123, Expiry: exp, Scope: "read", Audience: "flume"},
+		},
+		{
+			name:   "string user ID and audience list",
+			token:  testJWT(t, map[string]interface{}{"user_id": "456", "aud": []string{"a", "b"}}),
+			ok:     true,
+			fields: tokenClaimsFields{UserID: 456, Audience: "a,b"},
+		},
+		{name: "not a JWT", token: "opaque-token"},
+		{name: "payload is not base64", token: "a.!!!.c"},
+	}
+	for _, tt := range tests {
+		client, _ := newTestClient(t, newTestConfig(t), stubRoutes(nil))
+		client.accessToken = tt.token
+
+		fields, ok := client.extractTokenClaims()
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if fields.UserID != tt.fields.UserID || !fields.Expiry.Equal(tt.fields.Expiry) ||
+			fields.Scope != tt.fields.Scope || fields.Audience != tt.fields.Audience {
+			t.Errorf("%s: claims = %+v, want %+v", tt.name, fields, tt.fields)
+		}
+	}
+}
+
+func TestReconcileTokenExpiry(t *testing.T) {
+	jwtExpiry := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	tests := []struct {
+		name     string
+		computed time.Time
+		want     time.Time
+	}{
+		{"within tolerance keeps the computed expiry", jwtExpiry.Add(time.Minute), jwtExpiry.Add(time.Minute)},
+		{"beyond tolerance prefers the JWT", jwtExpiry.Add(time.Hour), jwtExpiry},
+		{"earlier computed expiry also prefers the JWT", jwtExpiry.Add(-time.Hour), jwtExpiry},
+	}
+	for _, tt := range tests {
+		client, _ := newTestClient(t, newTestConfig(t), stubRoutes(nil))
+		client.accessToken = testJWT(t, map[string]interface{}{"exp": jwtExpiry.Unix(), "scope": "read"})
+		client.tokenExpiry = tt.computed
+
+		client.reconcileTokenExpiry()
+		if !client.tokenExpiry.Equal(tt.want) {
+			t.Errorf("%s: expiry = %v, want %v", tt.name, client.tokenExpiry, tt.want)
+		}
+		if v := testutil.ToFloat64(client.metrics.tokenJWTExpiry); v != float64(jwtExpiry.Unix()) {
+			t.Errorf("%s: flume_exporter_token_jwt_exp_timestamp_seconds = %v, want %d", tt.name, v, jwtExpiry.Unix())
+		}
+		if v := testutil.ToFloat64(client.metrics.tokenInfo.WithLabelValues("read", "")); v != 1 {
+			t.Errorf("%s: flume_exporter_token_info{scope=\"read\"} = %v, want 1", tt.name, v)
+		}
+	}
+}
+
+func TestUsagePointUnmarshal(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    UsagePoint
+		wantErr bool
+	}{
+		{json: `{"datetime":"2026-01-01 10:00:00","value":1.5}`, want: UsagePoint{DateTime: "2026-01-01 10:00:00", Value: 1.5}},
+		{json: `["2026-01-01 10:00:00", 2.25]`, want: UsagePoint{DateTime: "2026-01-01 10:00:00", Value: 2.25}},
+		{json: `["2026-01-01 10:00:00"]`, wantErr: true},
+		{json: `[1.5, "2026-01-01 10:00:00"]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var point UsagePoint
+		err := json.Unmarshal([]byte(tt.json), &point)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.json, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && point != tt.want {
+			t.Errorf("%s: point = %+v, want %+v", tt.json, point, tt.want)
+		}
+	}
+}
+
+func TestQueryResponsePoints(t *testing.T) {
+	var resp QueryResponse
+	if err := json.Unmarshal([]byte(readTestdata(t, "query_hourly.json")), &resp); err != nil {
+		t.Fatalf("decoding query_hourly.json: %v", err)
+	}
+	if len(resp.Data) != 1 {
+		t.Fatalf("got %d results, want 1", len(resp.Data))
+	}
+	points := resp.Data[0].Points()
+	if len(points) != 4 {
+		t.Fatalf("got %d points, want 4", len(points))
+	}
+	if points[3].DateTime != "2026-01-01 10:03:00" || points[3].Value != 2.75 {
+		t.Errorf("last point = %+v", points[3])
+	}
+	if total := totalUsage(&resp); total != 4.5 {
+		t.Errorf("total usage = %v, want 4.5", total)
+	}
+}
+
+func TestQuotaRemaining(t *testing.T) {
+	config := newTestConfig(t)
+	config.APIHourlyQuota = 10
+	client, _ := newTestClient(t, config, stubRoutes(nil))
+
+	// Requests older than an hour no longer count
+	client.requestTimes = append(client.requestTimes, time.Now().Add(-2*time.Hour))
+	for i := 0; i < 7; i++ {
+		client.requestTimes = append(client.requestTimes, time.Now())
+	}
+	if got := client.QuotaRemaining(); got != 3 {
+		t.Errorf("QuotaRemaining = %d, want 3", got)
+	}
+	if client.NearQuota() {
+		t.Error("NearQuota with 3 of 10 requests left, want false until 2 are left")
+	}
+
+	client.requestTimes = append(client.requestTimes, time.Now())
+	if !client.NearQuota() {
+		t.Error("NearQuota with 2 of 10 requests left = false, want true")
+	}
+
+	// Without a quota nothing is deferred
+	unlimited, _ := newTestClient(t, newTestConfig(t), stubRoutes(nil))
+	unlimited.hourlyQuota = 0
+	if got := unlimited.QuotaRemaining(); got != -1 || unlimited.NearQuota() {
+		t.Errorf("without a quota: QuotaRemaining = %d, NearQuota = %v, want -1, false", got, unlimited.NearQuota())
+	}
+}
+
+const testTokenBody = `{"success":true,"count":1,"data":[{"token_type":"bearer","access_token":"new-token","expires_in":604800,"refresh_token":"new-refresh"}]}`
+
+// failingTokenRoutes answers the first failures token requests with a 500 and the rest with testTokenBody
+func failingTokenRoutes(failures int) func(req *http.Request) stubResponse {
+	var mutex sync.Mutex
+	return func(req *http.Request) stubResponse {
+		if req.URL.Path != "/oauth/token" {
+			return stubResponse{status: http.StatusNotFound, body: `{"success":false}`}
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failures > 0 {
+			failures--
+			return stubResponse{status: http.StatusInternalServerError, body: `{"success":false,"message":"upstream unavailable"}`}
+		}
+		return stubResponse{status: http.StatusOK, body: testTokenBody}
+	}
+}
+
+func TestAuthRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt   int
+		base, max time.Duration
+		want      time.Duration
+	}{
+		{1, 5 * time.Second, 2 * time.Minute, 5 * time.Second},
+		{2, 5 * time.Second, 2 * time.Minute, 10 * time.Second},
+		{3, 5 * time.Second, 2 * time.Minute, 20 * time.Second},
+		{5, 5 * time.Second, 2 * time.Minute, 80 * time.Second},
+		{6, 5 * time.Second, 2 * time.Minute, 2 * time.Minute},
+		{60, 5 * time.Second, 2 * time.Minute, 2 * time.Minute},
+		{1, 5 * time.Minute, 2 * time.Minute, 2 * time.Minute},
+		{4, time.Second, 0, 8 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := authRetryDelay(tt.attempt, tt.base, tt.max); got != tt.want {
+			t.Errorf("authRetryDelay(%d, %s, %s) = %s, want %s", tt.attempt, tt.base, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestAuthenticateWithRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   int
+		maxRetries int
+		wantErr    bool
+	}{
+		{"first attempt", 0, 3, false},
+		{"after two failures", 2, 3, false},
+		{"out of attempts", 3, 3, true},
+	}
+	for _, tt := range tests {
+		config := newTestConfig(t)
+		config.AuthRetryBackoff = time.Millisecond
+		config.AuthRetryMaxBackoff = 2 * time.Millisecond
+		client, doer := newTestClient(t, config, failingTokenRoutes(tt.failures))
+
+		err := client.AuthenticateWithRetry(context.Background(), tt.maxRetries)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: AuthenticateWithRetry = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		wantCalls := min(tt.failures+1, tt.maxRetries)
+		if n := doer.calls("/oauth/token"); n != wantCalls {
+			t.Errorf("%s: %d token requests, want %d", tt.name, n, wantCalls)
+		}
+		if !tt.wantErr && client.currentAccessToken() != "new-token" {
+			t.Errorf("%s: access token = %q, want new-token", tt.name, client.currentAccessToken())
+		}
+	}
+}
+
+func TestAuthenticateWithRetryCancelled(t *testing.T) {
+	config := newTestConfig(t)
+	config.AuthRetryBackoff = time.Hour
+	client, doer := newTestClient(t, config, failingTokenRoutes(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := client.AuthenticateWithRetry(ctx, 3)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AuthenticateWithRetry = %v, want the context's error", err)
+	}
+	if n := doer.calls("/oauth/token"); n != 1 {
+		t.Errorf("%d token requests, want 1 before the wait was cancelled", n)
+	}
+}
+
+func TestAuthenticateWithRetryLogsError(t *testing.T) {
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	config := newTestConfig(t)
+	config.AuthRetryBackoff = time.Millisecond
+	client, _ := newTestClient(t, config, failingTokenRoutes(1))
+	if err := client.AuthenticateWithRetry(context.Background(), 2); err != nil {
+		t.Fatalf("AuthenticateWithRetry: %v", err)
+	}
+
+	// The retry line names the attempt, the wait and the failure reason
+	var retry string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "Authentication attempt 1/2 failed") {
+			retry = line
+		}
+	}
+	if retry == "" {
+		t.Fatalf("no retry line logged:\n%s", logs.String())
+	}
+	for _, want := range []string{"retrying in 1ms", "status 500", "upstream unavailable"} {
+		if !strings.Contains(retry, want) {
+			t.Errorf("retry line %q does not contain %q", retry, want)
+		}
+	}
+}
+
+func TestQueryGroupMultiplier(t *testing.T) {
+	var bodies []string
+	client, doer := newTestClient(t, newTestConfig(t), func(req *http.Request) stubResponse {
+		var request map[string][]map[string]json.RawMessage
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			t.Errorf("decoding query request: %v", err)
+		}
+		bodies = append(bodies, string(request["queries"][0]["group_multiplier"]))
+		return stubResponse{status: http.StatusOK, body: testQueryBody}
+	})
+	since := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	// The field is only sent when grouping is requested
+	for _, multiplier := range []int{0, 15} {
+		if _, err := client.Query(context.Background(), QueryOptions{DeviceID: "d1", Bucket: "MIN", GroupMultiplier: multiplier, Since: since}); err != nil {
+			t.Fatalf("Query with group multiplier %d: %v", multiplier, err)
+		}
+	}
+	if len(bodies) != 2 || bodies[0] != "" || bodies[1] != "15" {
+		t.Errorf("group_multiplier sent as %q, want omitted and then 15", bodies)
+	}
+
+	if _, err := client.Query(context.Background(), QueryOptions{DeviceID: "d1", Bucket: "MIN", GroupMultiplier: -1, Since: since}); err == nil {
+		t.Error("Query with a negative group multiplier succeeded, want an error")
+	}
+	if n := doer.calls("/me/devices/d1/query"); n != 2 {
+		t.Errorf("%d queries sent, want 2 with the negative multiplier rejected before sending", n)
+	}
+}
+
+func TestQueryDailyTotalsForDevices(t *testing.T) {
+	var mutex sync.Mutex
+	inflight, maxInflight := 0, 0
+	client, doer := newTestClient(t, newTestConfig(t), func(req *http.Request) stubResponse {
+		if req.URL.Path == "/oauth/token" {
+			return stubResponse{status: http.StatusOK, body: testTokenBody}
+		}
+		mutex.Lock()
+		inflight++
+		maxInflight = max(maxInflight, inflight)
+		mutex.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mutex.Lock()
+		inflight--
+		mutex.Unlock()
+
+		if req.URL.Path == "/me/devices/d3/query" {
+			return stubResponse{status: http.StatusInternalServerError, body: `{"success":false}`}
+		}
+		return stubResponse{status: http.StatusOK, body: testQueryBody}
+	})
+	// An expired token is refreshed once up front rather than by every worker
+	client.tokenExpiry = time.Now().Add(-time.Minute)
+
+	deviceIDs := []string{"d1", "d2", "d3", "d4", "d5", "d6"}
+	now := time.Now()
+	results := client.QueryDailyTotalsForDevices(deviceIDs, now.AddDate(0, 0, -30), now, 3)
+
+	if len(results) != len(deviceIDs) {
+		t.Fatalf("got %d results, want %d", len(results), len(deviceIDs))
+	}
+	for _, deviceID := range deviceIDs {
+		result := results[deviceID]
+		if deviceID == "d3" {
+			if result.Err == nil {
+				t.Error("d3: no error, want the query's 500")
+			}
+			continue
+		}
+		if result.Err != nil || result.Usage == nil || len(result.Usage.Data) != 1 {
+			t.Errorf("%s: result = %+v, want one day of usage", deviceID, result)
+		}
+	}
+	if maxInflight < 2 || maxInflight > 3 {
+		t.Errorf("%d queries ran at once, want 2-3 with 3 workers", maxInflight)
+	}
+	if n := doer.calls("/oauth/token"); n != 1 {
+		t.Errorf("%d token refreshes, want 1", n)
+	}
+}
+
+func TestSharedDeviceQueriesUseOwner(t *testing.T) {
+	devicesBody := `{"count":2,"data":[{"id":"d1","type":2,"user_id":123,"location":{"name":"Home"}},{"id":"d2","type":2,"user_id":456,"location":{"name":"Parents"}}]}`
+	active := readTestdata(t, "active_basic.json")
+	client, doer := newTestClient(t, newTestConfig(t), stubRoutes(map[string]string{
+		"/me":                                testMeBody,
+		"/me/devices":                        devicesBody,
+		"/users/123/devices/d1/query/active": active,
+		"/users/456/devices/d2/query/active": active,
+		"/users/456/devices/d2/query":        testQueryBody,
+		"/me/devices/d1/query":               testQueryBody,
+	}))
+
+	devices, err := client.GetDevices()
+	if err != nil {
+		t.Fatalf("GetDevices: %v", err)
+	}
+	if len(devices) != 2 || devices[0].Shared || !devices[1].Shared {
+		t.Fatalf("devices = %+v, want only d2 shared", devices)
+	}
+
+	// Queries for the shared device go through its owner, the user's own through /me
+	for _, deviceID := range []string{"d1", "d2"} {
+		if _, err := client.GetCurrentFlowRate(deviceID); err != nil {
+			t.Errorf("%s: GetCurrentFlowRate: %v", deviceID, err)
+		}
+		if _, err := client.QueryWaterUsage(deviceID, "DAY", 0, time.Now().AddDate(0, 0, -1), nil); err != nil {
+			t.Errorf("%s: QueryWaterUsage: %v", deviceID, err)
+		}
+	}
+	for _, path := range []string{"/users/456/devices/d2/query/active", "/users/456/devices/d2/query", "/users/123/devices/d1/query/active", "/me/devices/d1/query"} {
+		if n := doer.calls(path); n != 1 {
+			t.Errorf("%s called %d times, want 1", path, n)
+		}
+	}
+}
+
+func TestUserIDRetriesRateLimitedMe(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the /me retry backoff")
+	}
+
+	var mutex sync.Mutex
+	rateLimited := true
+	routes := stubRoutes(map[string]string{
+		"/me":                                testMeBody,
+		"/users/123/devices/d1/query/active": readTestdata(t, "active_basic.json"),
+	})
+	client, doer := newTestClient(t, newTestConfig(t), func(req *http.Request) stubResponse {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if req.URL.Path == "/me" && rateLimited {
+			rateLimited = false
+			return stubResponse{status: http.StatusTooManyRequests, body: `{"success":false,"message":"rate limited"}`}
+		}
+		return routes(req)
+	})
+	// Keep the JWT fallback out of the way, so the user ID must come from the retried /me
+	client.accessToken = "not-a-jwt"
+
+	flowRate, err := client.GetCurrentFlowRate("d1")
+	if err != nil {
+		t.Fatalf("GetCurrentFlowRate: %v", err)
+	}
+	if flowRate.Value != 1.5 {
+		t.Errorf("flow rate = %v, want 1.5", flowRate.Value)
+	}
+	if n := doer.calls("/me"); n != 2 {
+		t.Errorf("/me called %d times, want a retry after the 429", n)
+	}
+
+	// Both attempts are recorded under the me endpoint, and the 429 slows the client down
+	if got := testutil.ToFloat64(client.metrics.apiRequests.WithLabelValues("me")); got != 2 {
+		t.Errorf("me requests = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(client.metrics.scrapeSuccess.WithLabelValues("me")); got != 1 {
+		t.Errorf("me scrape success = %v, want 1 after the retry", got)
+	}
+	if got := testutil.ToFloat64(client.metrics.lastErrorInfo.WithLabelValues("me", string(ErrorClassRateLimited))); got != 0 {
+		t.Errorf("me rate limited error = %v, want cleared after the retry", got)
+	}
+	if interval := client.rateLimiter.EffectiveInterval(); interval <= 0 {
+		t.Errorf("effective API interval after a 429 = %s, want the requests still spaced out", interval)
+	}
+}
+
+func TestUserIDRetryCancelled(t *testing.T) {
+	client, doer := newTestClient(t, newTestConfig(t), func(req *http.Request) stubResponse {
+		return stubResponse{status: http.StatusTooManyRequests, body: `{"success":false,"message":"rate limited"}`}
+	})
+	client.accessToken = "not-a-jwt"
+
+	// The first retry waits userIDRetryBackoff, far longer than the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.getUserID(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("getUserID = %v, want the context's error", err)
+	}
+	if waited := time.Since(start); waited >= userIDRetryBackoff {
+		t.Errorf("getUserID returned after %s, want it to stop waiting when the context is done", waited)
+	}
+	if n := doer.calls("/me"); n != 1 {
+		t.Errorf("/me called %d times, want 1 before the wait was cancelled", n)
+	}
+}
+
+func TestRequestCapSkipMode(t *testing.T) {
+	config := newTestConfig(t)
+	config.DeviceCacheTTL = 0
+	config.MaxRequestsPerHour = 2
+	config.MaxRequestsMode = RequestBudgetSkip
+	client, doer := newTestClient(t, config, stubRoutes(map[string]string{"/me/devices": testDevicesBody}))
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetDevices(); err != nil {
+			t.Fatalf("request %d within the cap: %v", i+1, err)
+		}
+	}
+	_, err := client.GetDevices()
+	if !errors.Is(err, ErrRequestBudgetExhausted) || classifyError(err) != ErrorClassRateLimited {
+		t.Errorf("request over the cap = %v, want a rate limited ErrRequestBudgetExhausted", err)
+	}
+	if n := doer.calls("/me/devices"); n != 2 {
+		t.Errorf("%d requests sent, want 2", n)
+	}
+}
+
+func TestRequestCapBlockMode(t *testing.T) {
+	config := newTestConfig(t)
+	config.MaxRequestsPerHour = 2
+	config.MaxRequestsMode = RequestBudgetBlock
+	client, _ := newTestClient(t, config, stubRoutes(nil))
+
+	// The oldest request leaves the trailing hour shortly
+	client.requestTimes = []time.Time{time.Now().Add(-time.Hour + 50*time.Millisecond), time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := client.reserveRequest(ctx, "devices"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("reserveRequest with a short deadline = %v, want the context's error", err)
+	}
+
+	start := time.Now()
+	if err := client.reserveRequest(context.Background(), "devices"); err != nil {
+		t.Fatalf("reserveRequest: %v", err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("reserveRequest returned after %s, want it to block until a request frees up", waited)
+	}
+	if n := len(client.requestTimes); n != 2 {
+		t.Errorf("%d requests in the trailing hour, want the cap of 2", n)
+	}
+}
+
+func TestRequestCapBlockModeTokenFailsFast(t *testing.T) {
+	config := newTestConfig(t)
+	config.MaxRequestsPerHour = 1
+	config.MaxRequestsMode = RequestBudgetBlock
+	client, doer := newTestClient(t, config, failingTokenRoutes(0))
+	client.requestTimes = []time.Time{time.Now()}
+
+	// Token requests run under tokenMutex, so they must not wait out the hour
+	done := make(chan error, 1)
+	go func() { done <- client.Authenticate(context.Background()) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrRequestBudgetExhausted) {
+			t.Errorf("Authenticate over the cap = %v, want ErrRequestBudgetExhausted", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Authenticate blocked on the request cap")
+	}
+	if n := doer.calls("/oauth/token"); n != 0 {
+		t.Errorf("%d token requests sent over the cap, want 0", n)
+	}
+}
+
+func TestTokenRequestCarriesContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var requestErr error
+	client, _ := newTestClient(t, newTestConfig(t), func(req *http.Request) stubResponse {
+		requestErr = req.Context().Err()
+		return stubResponse{status: http.StatusOK, body: testTokenBody}
+	})
+	if err := client.Authenticate(ctx); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if !errors.Is(requestErr, context.Canceled) {
+		t.Errorf("token request context error = %v, want the caller's context.Canceled", requestErr)
+	}
+}
+
+func TestQueryCoalescesIdenticalRequests(t *testing.T) {
+	release := make(chan struct{})
+	client, doer := newTestClient(t, newTestConfig(t), func(req *http.Request) stubResponse {
+		<-release
+		return stubResponse{status: http.StatusOK, body: testQueryBody}
+	})
+	opts := QueryOptions{DeviceID: "d1", Bucket: "DAY", Since: time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)}
+
+	const callers = 5
+	var wg sync.WaitGroup
+	bodies := make([]string, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := client.Query(context.Background(), opts)
+			bodies[i], errs[i] = string(body), err
+		}()
+	}
+
+	// Hold the request until every other caller has joined it
+	coalesced := client.metrics.coalescedRequests.WithLabelValues("water_usage")
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(coalesced) < callers-1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := doer.calls("/me/devices/d1/query"); n != 1 {
+		t.Errorf("%d requests sent for %d identical queries, want 1", n, callers)
+	}
+	if got := testutil.ToFloat64(coalesced); got != callers-1 {
+		t.Errorf("coalesced requests = %v, want %d", got, callers-1)
+	}
+	for i := range bodies {
+		if errs[i] != nil || bodies[i] != testQueryBody {
+			t.Errorf("caller %d got %q, %v, want the shared response", i, bodies[i], errs[i])
+		}
+	}
+
+	// Once the request completes, the next identical query sends its own
+	if _, err := client.Query(context.Background(), opts); err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if n := doer.calls("/me/devices/d1/query"); n != 2 {
+		t.Errorf("%d requests sent, want a new one after the first completed", n)
+	}
+}
+
+func TestQueryCoalescedSurvivesFirstCallerCancel(t *testing.T) {
+	release := make(chan struct{})
+	var requestErr error
+	client, _ := newTestClient(t, newTestConfig(t), func(req *http.Request) stubResponse {
+		<-release
+		requestErr = req.Context().Err()
+		return stubResponse{status: http.StatusOK, body: testQueryBody}
+	})
+	opts := QueryOptions{DeviceID: "d1", Bucket: "DAY", Since: time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := client.Query(ctx, opts)
+		first <- err
+	}()
+
+	// Join the first caller's request once it is in flight
+	coalesced := client.metrics.coalescedRequests.WithLabelValues("water_usage")
+	second := make(chan error, 1)
+	var body []byte
+	go func() {
+		var err error
+		body, err = client.Query(context.Background(), opts)
+		second <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(coalesced) < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled caller got %v, want context.Canceled", err)
+	}
+	close(release)
+	if err := <-second; err != nil || string(body) != testQueryBody {
+		t.Errorf("second caller got %q, %v, want the shared response", body, err)
+	}
+	if requestErr != nil {
+		t.Errorf("shared request context error = %v, want it unaffected by the first caller", requestErr)
+	}
+}
+
+func TestLoadTokensMigratesOldTokenFiles(t *testing.T) {
+	expiry := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	jwtExpiry := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	jwt := testJWT(t, map[string]interface{}{"user_id": 123, "exp": jwtExpiry.Unix()})
+
+	tests := []struct {
+		name       string
+		file       string
+		wantToken  string
+		wantExpiry time.Time
+	}{
+		{
+			name:       "version 0",
+			file:       `{"access_token":"v0-token","refresh_token":"v0-refresh","expiry_time":"` + expiry.Format(time.RFC3339) + `","username":"user@example.com","client_id":"client"}`,
+			wantToken:  "v0-token",
+			wantExpiry: expiry,
+		},
+		{
+			name:       "version 0 without expiry time",
+			file:       `{"access_token":"` + jwt + `","refresh_token":"v0-refresh","username":"user@example.com","client_id":"client"}`,
+			wantToken:  jwt,
+			wantExpiry: jwtExpiry,
+		},
+		{
+			name:       "newer version",
+			file:       `{"version":2,"access_token":"v2-token","refresh_token":"v2-refresh","expiry_time":"` + expiry.Format(time.RFC3339) + `","username":"user@example.com","client_id":"client","scopes":["read"]}`,
+			wantToken:  "v2-token",
+			wantExpiry: expiry,
+		},
+		{
+			name: "another user",
+			file: `{"version":1,"access_token":"other-token","expiry_time":"` + expiry.Format(time.RFC3339) + `","username":"other@example.com","client_id":"client"}`,
+		},
+	}
+	for _, tt := range tests {
+		config := newTestConfig(t)
+		if err := os.WriteFile(config.TokenFile, []byte(tt.file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		client := NewFlumeClientWithHTTP(config, newTestMetrics(), &stubDoer{handler: stubRoutes(nil)})
+
+		if client.accessToken != tt.wantToken || !client.tokenExpiry.Equal(tt.wantExpiry) {
+			t.Errorf("%s: loaded %q expiring %s, want %q expiring %s", tt.name, client.accessToken, client.tokenExpiry, tt.wantToken, tt.wantExpiry)
+		}
+		if tt.wantToken == "" {
+			continue
+		}
+
+		// Saving writes the current version
+		if err := client.saveTokens(); err != nil {
+			t.Fatalf("%s: saveTokens: %v", tt.name, err)
+		}
+		var saved TokenData
+		data, err := os.ReadFile(config.TokenFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &saved); err != nil {
+			t.Fatal(err)
+		}
+		if saved.Version != tokenFileVersion || saved.AccessToken != tt.wantToken {
+			t.Errorf("%s: saved version %d with %q, want version %d", tt.name, saved.Version, saved.AccessToken, tokenFileVersion)
+		}
+	}
+}
+
+func TestRefreshWithEmptyAccessTokenFallsBackToAuthentication(t *testing.T) {
+	var grants []string
+	client, _ := newTestClient(t, newTestConfig(t), func(req *http.Request) stubResponse {
+		var form map[string]string
+		if err := json.NewDecoder(req.Body).Decode(&form); err != nil {
+			t.Errorf("decoding token request: %v", err)
+		}
+		grants = append(grants, form["grant_type"])
+		if form["grant_type"] == "refresh_token" {
+			return stubResponse{status: http.StatusOK, body: `{"success":true,"count":1,"data":[{"token_type":"bearer","access_token":"","expires_in":604800,"refresh_token":"rotated-refresh"}]}`}
+		}
+		return stubResponse{status: http.StatusOK, body: testTokenBody}
+	})
+	// Expiring soon, so the next request refreshes it first
+	client.tokenExpiry = time.Now().Add(30 * time.Minute)
+
+	if err := client.ensureValidToken(context.Background()); err != nil {
+		t.Fatalf("ensureValidToken: %v", err)
+	}
+	if strings.Join(grants, ",") != "refresh_token,password" {
+		t.Errorf("token grants = %v, want a refresh and then a full authentication", grants)
+	}
+	if client.accessToken != "new-token" || client.refreshToken != "new-refresh" {
+		t.Errorf("tokens = %q, %q, want the ones from the full authentication", client.accessToken, client.refreshToken)
+	}
+
+	// The saved tokens are the new ones, not the empty access token
+	var saved TokenData
+	data, err := os.ReadFile(client.tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken != "new-token" {
+		t.Errorf("saved access token = %q, want new-token", saved.AccessToken)
+	}
+}
+
+func TestTokenFileCandidates(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", "/cache")
+	t.Setenv("HOME", "/home/flume")
+	t.Setenv("TMPDIR", "/scratch")
+
+	want := []string{"/etc/flume/tokens.json", "/var/lib/flume-exporter/tokens.json", "/cache/flume-exporter/tokens.json", "/scratch/flume_exporter_tokens.json"}
+	if got := tokenFileCandidates("/etc/flume/tokens.json"); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("candidates = %v, want %v", got, want)
+	}
+	if got := tokenFileCandidates(""); strings.Join(got, ",") != strings.Join(want[1:], ",") {
+		t.Errorf("candidates without a configured path = %v, want %v", got, want[1:])
+	}
+}
+
+func TestFirstWritableTokenFile(t *testing.T) {
+	dir := t.TempDir()
+
+	// A regular file where a directory should be makes a location unusable, even for root
+	blocker := filepath.Join(dir, "not-a-dir")
+	if err := os.WriteFile(blocker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	unusable := filepath.Join(blocker, "tokens.json")
+	fallback := filepath.Join(dir, "state", "tokens.json")
+
+	if got := firstWritableTokenFile([]string{unusable, fallback}); got != fallback {
+		t.Errorf("firstWritableTokenFile = %q, want the fallback %q with its directory created", got, fallback)
+	}
+	if _, err := os.Stat(filepath.Dir(fallback)); err != nil {
+		t.Errorf("fallback directory not created: %v", err)
+	}
+	if got := firstWritableTokenFile([]string{unusable}); got != "" {
+		t.Errorf("firstWritableTokenFile with no usable location = %q, want memory only", got)
+	}
+
+	// The probe file used to check the directory is removed again
+	entries, err := os.ReadDir(filepath.Dir(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("token directory holds %d leftover files, want none", len(entries))
+	}
+}
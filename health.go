@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"net/http"
+)
+
+// Health reason codes reported at the top level of the /health responses
+const (
+	HealthReasonOK                 = "ok"
+	HealthReasonNeverAuthenticated = "never_authenticated"
+	HealthReasonTokenExpired       = "token_expired"
+	HealthReasonRefreshFailing     = "refresh_failing"
+	HealthReasonAPIUnreachable     = "api_unreachable"
+	HealthReasonRateLimited        = "rate_limited"
+)
+
+// healthReasonStatus maps each health reason to the HTTP status /health/detailed returns for it
+var healthReasonStatus = map[string]int{
+	HealthReasonOK:                 http.StatusOK,
+	HealthReasonNeverAuthenticated: http.StatusServiceUnavailable,
+	HealthReasonTokenExpired:       http.StatusServiceUnavailable,
+	HealthReasonRefreshFailing:     http.StatusServiceUnavailable,
+	HealthReasonAPIUnreachable:     http.StatusBadGateway,
+	HealthReasonRateLimited:        http.StatusTooManyRequests,
+}
+
+// healthStatusCode returns the HTTP status for reason. /health fails only on authentication states, which a
+// restart or new credentials can fix; upstream trouble is reported in the reason alone, so liveness probes do
+// not restart the exporter during a Flume outage. /health/detailed returns the upstream statuses too
+func healthStatusCode(reason string, detailed bool) int {
+	if !detailed && (reason == HealthReasonAPIUnreachable || reason == HealthReasonRateLimited) {
+		return http.StatusOK
+	}
+	return healthReasonStatus[reason]
+}
+
+// evaluateHealth derives// evaluateHealth derives the health reason from the client's authentication state
+// and the errors seen during the exporter's most recent collection cycle
+func evaluateHealth(client *FlumeClient, exporter *FlumeExporter) string {
+	state := client.tokenState()
+	if !state.hasAuthenticated && !state.hasAccessToken {
+		return HealthReasonNeverAuthenticated
+	}
+	if state.refreshFailures > 0 {
+		return HealthReasonRefreshFailing
+	}
+	if state.expired {
+		return HealthReasonTokenExpired
+	}
+	if exporter.HasRecentError(ErrorClassTimeout) || exporter.HasRecentError(ErrorClassServerError) {
+		return HealthReasonAPIUnreachable
+	}
+	if exporter.HasRecentError(ErrorClassRateLimited) {
+		return HealthReasonRateLimited
+	}
+	return HealthReasonOK
+}
+
+// healthReasonForValidationError maps a failed API validation to a health reason
+func healthReasonForValidationError(err error) string {
+	switch classifyError(err) {
+	case ErrorClassUnauthorized:
+		return HealthReasonTokenExpired
+	case ErrorClassRateLimited:
+		return HealthReasonRateLimited
+	default:
+		return HealthReasonAPIUnreachable
+	}
+}
+
+// rateLimitStatus summarises the configured API pacing and, once the device count is known,
+// the estimated hourly request rate against Flume's limit
+func rateLimitStatus(config *Config, exporter *FlumeExporter) map[string]interface{} {
+	status := map[string]interface{}{
+		"api_min_interval": config.APIMinInterval.String(),
+		"scrape_interval":  config.ScrapeInterval.String(),
+		"hourly_limit":     flumeRequestsPerHourLimit,
+	}
+
+	deviceCount, known := exporter.DeviceCount()
+	if !known {
+		return status
+	}
+
+	estimate := config.EstimatedRequestsPerHour(deviceCount, config.ScrapeInterval)
+	status["device_count"] = deviceCount
+	status["optimal_scrape_interval"] = config.calculateOptimalScrapeInterval(deviceCount).String()
+	status["estimated_requests_per_hour"] = math.Round(estimate*10) / 10
+	status["within_limit"] = estimate <= flumeRequestsPerHourLimit
+	return status
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHealthStatusCode(t *testing.T) {
+	tests := []struct {
+		reason          string
+		basic, detailed int
+	}{
+		{HealthReasonOK, http.StatusOK, http.StatusOK},
+		{HealthReasonNeverAuthenticated, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{HealthReasonTokenExpired, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{HealthReasonRefreshFailing, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		// Upstream trouble only fails the detailed endpoint
+		{HealthReasonAPIUnreachable, http.StatusOK, http.StatusBadGateway},
+		{HealthReasonRateLimited, http.StatusOK, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		if got := healthStatusCode(tt.reason, false); got != tt.basic {
+			t.Errorf("/health status for %s = %d, want %d", tt.reason, got, tt.basic)
+		}
+		if got := healthStatusCode(tt.reason, true); got != tt.detailed {
+			t.Errorf("/health/detailed status for %s = %d, want %d", tt.reason, got, tt.detailed)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// InfluxWriter writes the exporter's metrics to InfluxDB in line protocol after each collection
+// The values come from the registry, so Flume is not queried again
+type InfluxWriter struct {
+	url     string
+	token   string
+	client  *http.Client
+	metrics *Metrics
+}
+
+// NewInfluxWriter creates a writer for the configured InfluxDB write URL
+// Returns a disabled writer when no URL is configured
+func NewInfluxWriter(config *Config, metrics *Metrics) *InfluxWriter {
+	if config.InfluxDBURL == "" {
+		return &InfluxWriter{}
+	}
+	return &InfluxWriter{
+		url:     config.InfluxDBURL,
+		token:   config.InfluxDBToken,
+		client:  &http.Client{Timeout: config.Timeout},
+		metrics: metrics,
+	}
+}
+
+// Enabled reports whether an InfluxDB URL has been configured
+func (w *InfluxWriter) Enabled() bool {
+	return w != nil && w.url != ""
+}
+
+// Write sends the current flume_* metrics to InfluxDB, one point per series
+// Points carry no timestamp, so InfluxDB stamps them with the time they are written
+func (w *InfluxWriter) Write() error {
+	if !w.Enabled() {
+		return nil
+	}
+
+	families, err := flumeMetricsGatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics for InfluxDB: %w", err)
+	}
+
+	var body bytes.Buffer
+	points := 0
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if line := influxLine(family, metric); line != "" {
+				body.WriteString(line)
+				body.WriteByte('\n')
+				points++
+			}
+		}
+	}
+
+	if err := w.post(body.Bytes()); err != nil {
+		if w.metrics != nil {
+			w.metrics.RecordInfluxDBWriteFailure()
+		}
+		return err
+	}
+	log.Printf("Wrote %d points to InfluxDB at %s", points, w.url)
+	return nil
+}
+
+// post sends a line protocol body to the InfluxDB write URL
+func (w *InfluxWriter) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create InfluxDB write request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to write to InfluxDB at %s: %w", w.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("InfluxDB write to %s failed with status %d: %s", w.url, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+// influxLine formats one series as a line protocol point: the metric name is the measurement, its
+// labels are tags, and the value is the "value" field (histograms and summaries get "count" and "sum")
+// Returns an empty string for series without a representable value
+func influxLine(family *dto.MetricFamily, metric *dto.Metric) string {
+	var fields []string
+	addField := func(name string, value float64) {
+		// Line protocol has no NaN or infinity
+		if !math.IsNaN(value) && !math.IsInf(value, 0) {
+			fields = append(fields, name+"="+strconv.FormatFloat(value, 'g', -1, 64))
+		}
+	}
+
+	switch family.GetType() {
+	case dto.MetricType_GAUGE:
+		addField("value", metric.GetGauge().GetValue())
+	case dto.MetricType_COUNTER:
+		addField("value", metric.GetCounter().GetValue())
+	case dto.MetricType_UNTYPED:
+		addField("value", metric.GetUntyped().GetValue())
+	case dto.MetricType_HISTOGRAM:
+		addField("count", float64(metric.GetHistogram().GetSampleCount()))
+		addField("sum", metric.GetHistogram().GetSampleSum())
+	case dto.MetricType_SUMMARY:
+		addField("count", float64(metric.GetSummary().GetSampleCount()))
+		addField("sum", metric.GetSummary().GetSampleSum())
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+
+	var line strings.Builder
+	line.WriteString(influxEscape(family.GetName(), ", "))
+	for _, label := range metric.GetLabel() {
+		// Line protocol does not allow empty tag values; a missing tag reads the same
+		if label.GetValue() == "" {
+			continue
+		}
+		line.WriteByte(',')
+		line.WriteString(influxEscape(label.GetName(), ",= "))
+		line.WriteByte('=')
+		line.WriteString(influxEscape(label.GetValue(), ",= "))
+	}
+	line.WriteByte(' ')
+	line.WriteString(strings.Join(fields, ","))
+	return line.String()
+}
+
+// influxEscape backslash-escapes the given special characters in a measurement, tag key or tag value
+func influxEscape(s, special string) string {
+	if !strings.ContainsAny(s, special) {
+		return s
+	}
+	var escaped strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
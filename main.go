@@ -7,10 +7,12 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -22,14 +24,47 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	if config.ValidateOnlyQuota {
+		os.Exit(runQuotaValidation(config))
+	}
+	if config.CheckAuth {
+		os.Exit(runAuthCheck(config))
+	}
 
 	log.Printf("Configuration loaded:")
 	log.Printf("  Listen Address: %s", config.ListenAddress)
 	log.Printf("  Metrics Path: %s", config.MetricsPath)
+	if len(config.MetricsPathAliasesList) > 0 {
+		log.Printf("  Metrics Path Aliases: %s", strings.Join(config.MetricsPathAliasesList, ", "))
+	}
+	log.Printf("  OpenMetrics: %v", config.EnableOpenMetrics)
 	log.Printf("  Scrape Interval: %s", config.ScrapeInterval)
+	if config.UsageInterval > 0 {
+		log.Printf("  Usage Interval: %s", config.UsageInterval)
+	}
 	log.Printf("  Timeout: %s", config.Timeout)
+	if config.CollectionTimeout > 0 {
+		log.Printf("  Collection Timeout: %s", config.CollectionTimeout)
+	}
+	if config.ConfigFile != "" {
+		log.Printf("  Config File: %s", config.ConfigFile)
+	}
 	log.Printf("  Base URL: %s", config.BaseURL)
 	log.Printf("  API Min Interval: %s", config.APIMinInterval)
+	log.Printf("  Device Cache TTL: %s", config.DeviceCacheTTL)
+	log.Printf("  Timezone: %s", config.TimeLocation())
+	if config.PushgatewayURL != "" {
+		log.Printf("  Pushgateway URL: %s (job: %s)", config.PushgatewayURL, config.PushgatewayJob)
+	}
+	if config.TextfileOutput != "" {
+		log.Printf("  Textfile Output: %s", config.TextfileOutput)
+	}
+	if config.ExtraLabels != "" {
+		log.Printf("  Extra Labels: %s", config.ExtraLabels)
+	}
+	if config.OTLPEndpoint != "" {
+		log.Printf("  OTLP Endpoint: %s (every %s)", config.OTLPEndpoint, config.OTLPInterval)
+	}
 	if config.DeviceIDs != "" {
 		log.Printf("  Device IDs Filter: %s", config.DeviceIDs)
 	} else {
@@ -37,9 +72,37 @@ func main() {
 	}
 
 	// Create metrics and exporter
-	metrics := NewMetrics()
+	registerer := prometheus.DefaultRegisterer
+	if len(config.ExtraLabelSet) > 0 {
+		// Static labels let the exporter identify its site or environment without relabeling
+		registerer = prometheus.WrapRegistererWith(prometheus.Labels(config.ExtraLabelSet), registerer)
+	}
+	if config.Demo {
+		// Label every exporter series so synthetic data is never mistaken for real usage
+		registerer = prometheus.WrapRegistererWith(prometheus.Labels{"demo": "true"}, registerer)
+	}
+	var metrics *Metrics
+	if config.SnapshotMetrics {
+		metrics = NewSnapshotMetrics(registerer, config.MetricHelpSuffixes)
+	} else {
+		metrics = NewMetricsWithHelp(registerer, config.MetricHelpSuffixes)
+	}
+	if config.CycleDurationHistogram {
+		metrics.EnableCycleDurationHistogram(registerer)
+	}
+	if config.MaxRequestsPerHour > 0 {
+		metrics.EnableRequestBudgetMetric(registerer)
+	}
+	if config.StaleMetricsPolicy == StaleMetricsFlag {
+		metrics.EnableStaleMetricsFlag(registerer, config.StaleMetricsAfter)
+	}
 	exporter := NewFlumeExporter(nil, config, metrics) // Pass metrics parameter
 
+	otlpExporter, err := NewOTLPExporter(config, metrics)
+	if err != nil {
+		log.Fatalf("Failed to set up OTLP export: %v", err)
+	}
+
 	// Create Flume client
 	client := NewFlumeClient(config, metrics)
 
@@ -48,7 +111,16 @@ func main() {
 
 	// Setup HTTP server
 	mux := http.NewServeMux()
-	mux.Handle(config.MetricsPath, promhttp.Handler())
+	metricsHandler := promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+			EnableOpenMetrics: config.EnableOpenMetrics,
+		}),
+	)
+	mux.Handle(config.MetricsPath, metricsHandler)
+	for _, alias := range config.MetricsPathAliasesList {
+		mux.Handle(alias, metricsHandler)
+	}
 
 	// Add health check endpoint
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -60,10 +132,13 @@ func main() {
 		// Only validate authentication if we need to
 		authValid := true
 
+		var validationErr error
+
 		if client.needsAuthentication() {
 			log.Printf("Health check: Authentication needed, validating...")
 			if err := client.ValidateAuthentication(); err != nil {
 				authValid = false
+				validationErr = err
 				authStatus["validation_error"] = err.Error()
 			}
 		} else {
@@ -71,26 +146,39 @@ func main() {
 			authStatus["validation_skipped"] = "token_valid"
 		}
 
+		reason := evaluateHealth(client, exporter)
+		if !authValid && reason == HealthReasonOK {
+			reason = healthReasonForValidationError(validationErr)
+		}
+
+		// A reload may replace the configuration while this request runs
+		current := exporter.config.Load()
+
 		healthData := map[string]interface{}{
 			"status":    "healthy",
+			"reason":    reason,
 			"timestamp": time.Now().Format(time.RFC3339),
 			"authentication": map[string]interface{}{
 				"valid":  authValid,
 				"status": authStatus,
 			},
 			"config": map[string]interface{}{
-				"base_url":         config.BaseURL,
-				"username":         config.Username,
-				"client_id":        config.ClientID,
-				"scrape_interval":  config.ScrapeInterval.String(),
-				"device_filtering": config.DeviceIDs != "",
-				"device_ids":       config.DeviceIDs,
+				"base_url":         current.BaseURL,
+				"username":         current.Username,
+				"client_id":        current.ClientID,
+				"scrape_interval":  current.ScrapeInterval.String(),
+				"device_filtering": current.DeviceIDs != "",
+				"device_ids":       current.DeviceIDs,
 			},
+			"rate_limit": rateLimitStatus(current, exporter),
 		}
 
-		if !authValid {
+		if code := healthStatusCode(reason, false); code != http.StatusOK {
 			healthData["status"] = "unhealthy"
-			w.WriteHeader(http.StatusServiceUnavailable)
+			w.WriteHeader(code)
+		} else if reason != HealthReasonOK {
+			// Flume is unreachable or rate limiting, but the exporter itself is fine
+			healthData["status"] = "degraded"
 		}
 
 		jsonData, _ := json.MarshalIndent(healthData, "", "  ")
@@ -106,32 +194,58 @@ func main() {
 
 		authValid := authStatus["api_validation"] == "success" || authStatus["api_validation"] == "skipped"
 
+		// A 401 during validation clears the tokens, so only non-auth failures remain unexplained here
+		reason := evaluateHealth(client, exporter)
+		if !authValid && reason == HealthReasonOK {
+			reason = HealthReasonAPIUnreachable
+		}
+
+		// A reload may replace the configuration while this request runs
+		current := exporter.config.Load()
+
 		healthData := map[string]interface{}{
 			"status":    "healthy",
+			"reason":    reason,
 			"timestamp": time.Now().Format(time.RFC3339),
 			"authentication": map[string]interface{}{
 				"valid":  authValid,
 				"status": authStatus,
 			},
 			"config": map[string]interface{}{
-				"base_url":         config.BaseURL,
-				"username":         config.Username,
-				"client_id":        config.ClientID,
-				"scrape_interval":  config.ScrapeInterval.String(),
-				"device_filtering": config.DeviceIDs != "",
-				"device_ids":       config.DeviceIDs,
+				"base_url":         current.BaseURL,
+				"username":         current.Username,
+				"client_id":        current.ClientID,
+				"scrape_interval":  current.ScrapeInterval.String(),
+				"device_filtering": current.DeviceIDs != "",
+				"device_ids":       current.DeviceIDs,
 			},
+			"rate_limit": rateLimitStatus(current, exporter),
 		}
 
-		if !authValid {
+		if reason != HealthReasonOK {
 			healthData["status"] = "unhealthy"
-			w.WriteHeader(http.StatusServiceUnavailable)
+			w.WriteHeader(healthStatusCode(reason, true))
 		}
 
 		jsonData, _ := json.MarshalIndent(healthData, "", "  ")
 		w.Write(jsonData)
 	})
 
+	// Admin endpoints are only served when a token has been configured
+	if config.AdminToken != "" {
+		mux.HandleFunc("/admin/devices", requireAdminToken(config.AdminToken, adminDevicesHandler(client, exporter)))
+		mux.HandleFunc("/admin/usage", requireAdminToken(config.AdminToken, adminUsageHandler(client)))
+		mux.HandleFunc("/export.csv", requireAdminToken(config.AdminToken, exportCSVHandler(client, metrics)))
+	}
+
+	// Prometheus HTTP service discovery, behind the admin token
+	if config.SDTarget != "" {
+		mux.HandleFunc("/targets", requireAdminToken(config.AdminToken, targetsHandler(config)))
+	}
+	if config.DebugLastResponses > 0 {
+		mux.HandleFunc("/debug/last-responses", requireAdminToken(config.AdminToken, lastResponsesHandler(client)))
+	}
+
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(http.StatusOK)
@@ -160,17 +274,28 @@ func main() {
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 
-	// Start server in goroutine
-	go func() {
-		log.Printf("Starting HTTP server on %s", config.ListenAddress)
-		log.Printf("Metrics available at http://%s%s", config.ListenAddress, config.MetricsPath)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
-		}
-	}()
+	// Start server in goroutine unless running in push-only mode
+	if config.DisableHTTPServer {
+		log.Println("HTTP server disabled, metrics are only pushed, written to the textfile or exported via OTLP, InfluxDB or MQTT")
+	} else {
+		go func() {
+			log.Printf("Starting HTTP server on %s", config.ListenAddress)
+			log.Printf("Metrics available at http://%s%s", config.ListenAddress, config.MetricsPath)
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Failed to start server: %v", err)
+			}
+		}()
+	}
+
+	// Cancelled first on shutdown so background startup work stops before collection is drained
+	rootCtx, cancelRoot := context.WithCancel(context.Background())
+	defer cancelRoot()
+	var background sync.WaitGroup
 
 	// Start authentication in background
+	background.Add(1)
 	go func() {
+		defer background.Done()
 		log.Println("Starting authentication in background...")
 
 		// Check if we need authentication before starting
@@ -178,7 +303,7 @@ func main() {
 			log.Println("Authentication needed, starting...")
 
 			// Try to authenticate with retry
-			if err := client.AuthenticateWithRetry(3); err != nil {
+			if err := client.AuthenticateWithRetry(rootCtx, config.AuthMaxRetries); err != nil {
 				log.Printf("Failed to authenticate after retries: %v", err)
 				log.Println("Metrics endpoint is still available, but data collection will fail")
 				return
@@ -189,15 +314,16 @@ func main() {
 			log.Println("Valid tokens found, authentication not needed")
 		}
 
-		// Get initial device count to calculate optimal interval
-		devices, err := client.GetDevices()
+		// Get initial device count to calculate optimal interval; the device list and user ID are
+		// handed to the first collection so it does not fetch them again
+		devices, err := client.Warmup(rootCtx)
 		if err != nil {
-			log.Printf("Failed to get initial device count: %v", err)
+			log.Printf("Failed to get initial device count after retries: %v", err)
 			log.Println("Using default scrape interval")
 		} else {
 			// Count devices that will be processed
 			deviceCount := len(devices)
-			if config.DeviceIDs != "" {
+			if exporter.config.Load().DeviceIDs != "" {
 				deviceCount = 0
 				for _, device := range devices {
 					if exporter.shouldProcessDevice(device.ID) {
@@ -207,22 +333,51 @@ func main() {
 			}
 
 			// Calculate optimal interval
-			optimalInterval := config.GetScrapeInterval(deviceCount)
+			optimalInterval := exporter.config.Load().GetScrapeInterval(deviceCount)
 			log.Printf("Device count: %d, Optimal scrape interval: %s", deviceCount, optimalInterval)
 
 			// Update config with optimal interval
-			config.ScrapeInterval = optimalInterval
+			exporter.setScrapeInterval(optimalInterval)
+		}
+
+		if rootCtx.Err() != nil {
+			log.Println("Shutting down, not starting periodic metric collection")
+			return
 		}
 
 		// Start periodic metric collection
 		log.Println("Starting periodic metric collection...")
-		log.Printf("Using scrape interval: %s", config.ScrapeInterval)
-		exporter.StartPeriodicCollection(config.ScrapeInterval)
+		scrapeInterval := exporter.config.Load().ScrapeInterval
+		log.Printf("Using scrape interval: %s", scrapeInterval)
+		exporter.StartPeriodicCollection(scrapeInterval)
+	}()
+
+	// Pick up edits to the device IDs file without a restart
+	if config.DeviceIDsFile != "" && config.DeviceIDsFileInterval > 0 {
+		log.Printf("Watching device IDs file %s every %s", config.DeviceIDsFile, config.DeviceIDsFileInterval)
+		go exporter.WatchDeviceIDsFile(config.DeviceIDsFile, config.DeviceIDsFileInterval)
+	}
+
+	// Reload the hot-reloadable settings on SIGHUP; credentials are never reloaded
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			log.Println("Received SIGHUP, reloading configuration...")
+			next, err := config.Reload()
+			if err != nil {
+				log.Printf("Configuration reload failed, keeping current settings: %v", err)
+				continue
+			}
+			exporter.ApplyReload(next)
+		}
 	}()
 
 	// Wait for shutdown signal
 	<-shutdown
 	log.Println("Shutting down...")
+	cancelRoot()
+	signal.Stop(reload)
 
 	// Graceful shutdown with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -232,19 +387,57 @@ func main() {
 		log.Printf("Error during shutdown: %v", err)
 	}
 
+	// Stop the tickers and let an in-progress collection finish so no request is left dangling
+	log.Println("Waiting for in-progress metric collection to finish...")
+	exporter.Stop(ctx)
+
+	// Export the final values before the process exits
+	if err := otlpExporter.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down OTLP export: %v", err)
+	}
+
+	// An authentication attempt that was already sending its request finishes before tokens are saved
+	authDone := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(authDone)
+	}()
+	select {
+	case <-authDone:
+	case <-ctx.Done():
+		log.Println("Shutdown budget exhausted while waiting for background authentication")
+	}
+
+	// Persist the latest tokens once nothing else can refresh them
+	if client.tokenState().hasAuthenticated {
+		if err := client.saveTokens(); err != nil {
+			log.Printf("Failed to save tokens on shutdown: %v", err)
+		}
+	}
+
 	log.Println("Exporter stopped")
 }
 
 // RateLimiter ensures that operations are not performed more frequently than a specified interval
+// After a 429 the interval is widened by Backoff and narrowed again by Recover on later successes
 type RateLimiter struct {
+	base     time.Duration
 	interval time.Duration
 	last     time.Time
+	waited   time.Duration // Total time callers spent blocked in Wait
 	mutex    sync.Mutex
 }
 
+// Adaptive backoff bounds: the smallest widened interval and the widest interval a backoff may set
+const (
+	rateLimitMinBackoff = 1 * time.Second
+	rateLimitMaxBackoff = 10 * time.Minute
+)
+
 // NewRateLimiter creates a new rate limiter with the specified minimum interval
 func NewRateLimiter(interval time.Duration) *RateLimiter {
 	return &RateLimiter{
+		base:     interval,
 		interval: interval,
 		last:     time.Time{}, // Zero time means no previous operation
 	}
@@ -252,24 +445,90 @@ func NewRateLimiter(interval time.Duration) *RateLimiter {
 
 // Wait blocks until enough time has passed since the last operation
 func (rl *RateLimiter) Wait() {
-	rl.mutex.Lock()
-	defer rl.mutex.Unlock()
+	_ = rl.WaitContext(context.Background())
+}
 
-	now := time.Now()
-	if !rl.last.IsZero() {
-		// Calculate how long to wait
-		elapsed := now.Sub(rl.last)
-		if elapsed < rl.interval {
-			waitTime := rl.interval - elapsed
-			time.Sleep(waitTime)
-			now = time.Now() // Update now after sleeping
+// WaitContext is Wait that gives up with ctx's error when ctx is done first
+// Each caller reserves the next free slot before sleeping, so waiters are still spaced by the interval
+func (rl *RateLimiter) WaitContext(ctx context.Context) error {
+	start := time.Now()
+	rl.mutex.Lock()
+	next := start
+	if !rl.last.IsZero() && next.Sub(rl.last) < rl.interval {
+		next = rl.last.Add(rl.interval)
+	}
+	rl.last = next
+	rl.mutex.Unlock()
+
+	if wait := next.Sub(start); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 
-	rl.last = now
+	rl.mutex.Lock()
+	rl.waited += time.Since(start)
+	rl.mutex.Unlock()
+	return nil
+}
+
+// Waited returns the total time callers have spent blocked in Wait since creation,
+// including time queued behind other callers
+func (rl *RateLimiter) Waited() time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	return rl.waited
 }
 
 // GetInterval returns the configured interval
 func (rl *RateLimiter) GetInterval() time.Duration {
+	return rl.base
+}
+
+// SetBase changes the configured interval, keeping a longer interval set by a backoff in place
+func (rl *RateLimiter) SetBase(interval time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if rl.interval <= rl.base || rl.interval < interval {
+		rl.interval = interval
+	}
+	rl.base = interval
+}
+
+// EffectiveInterval returns the interval currently enforced, which exceeds the configured one after a backoff
+func (rl *RateLimiter) EffectiveInterval() time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	return rl.interval
+}
+
+// Backoff doubles the enforced interval after a rate limited request, or widens it to retryAfter if that is longer
+// Returns the new interval
+func (rl *RateLimiter) Backoff(retryAfter time.Duration) time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	rl.interval = max(rl.interval*2, retryAfter, rateLimitMinBackoff)
+	if limit := max(rl.base, rateLimitMaxBackoff); rl.interval > limit {
+		rl.interval = limit
+	}
 	return rl.interval
 }
+
+// Recover halves a widened interval after a successful request, down to the configured interval
+// Returns the new interval and whether it changed
+func (rl *RateLimiter) Recover() (time.Duration, bool) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if rl.interval <= rl.base {
+		return rl.interval, false
+	}
+	rl.interval = max(rl.interval/2, rl.base)
+	return rl.interval, true
+}
@@ -1,75 +1,359 @@
 package main
 
 import (
+	"context"
 	"log"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"sync"
+	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// reservedLabelNames are the label names the exporter's own metrics (or demo mode) declare, so they cannot
+// be extra labels; a label added to a metric below must be added here too
+var reservedLabelNames = map[string]bool{
+	"device_id": true, "device_name": true, "location": true, "device_type": true, "firmware": true,
+	"product": true, "shared": true, "bucket": true, "date": true, "year": true, "endpoint": true, "error_class": true,
+	"cycle": true, "scope": true, "audience": true, "demo": true, "job": true, "instance": true,
+	"partial": true, "period": true, "reason": true,
+}
+
 // Metrics holds all Prometheus metrics for the Flume exporter
 type Metrics struct {
+	// Text appended to the help of configured metrics, by metric name
+	helpSuffixes map[string]string
+
+	// Serves the device metrics from the snapshot of the last collection cycle, nil unless enabled
+	snapshot *snapshotCollector
+
 	// Current flow rate metrics
 	currentFlowRate *prometheus.GaugeVec
+	flowActive      *prometheus.GaugeVec
+	flowRateAge     *prometheus.GaugeVec
+	dataAge         *prometheus.GaugeVec
 
-	// Water usage metrics
-	totalWaterUsage      *prometheus.GaugeVec
-	dailyTotalWaterUsage *prometheus.GaugeVec
+	// Optional sensor metrics
+	waterPressure *prometheus.GaugeVec
+
+	// Water usage metrics; bucketUsage holds one gauge per Flume query bucket, see bucketUsageMetrics
+	bucketUsage       map[string]*prometheus.GaugeVec
+	todayWaterUsage   *prometheus.GaugeVec
+	accountFlowRate   *prometheus.GaugeVec
+	accountUsage      *prometheus.GaugeVec
+	dailyTotalDays    *prometheus.GaugeVec
+	dailyTotalMissing *prometheus.GaugeVec
+	dailyBudget       *prometheus.GaugeVec
+	dailyBudgetRatio  *prometheus.GaugeVec
 
 	// Device info metrics
-	deviceInfo *prometheus.GaugeVec
+	deviceInfo             *prometheus.GaugeVec
+	deviceInstallTimestamp *prometheus.GaugeVec
+	deviceConnected        *prometheus.GaugeVec
 
 	// Exporter metrics
-	scrapeDuration *prometheus.GaugeVec
-	scrapeSuccess  *prometheus.GaugeVec
-	lastScrapeTime *prometheus.GaugeVec
+	scrapeDuration  *prometheus.GaugeVec
+	requestDuration *prometheus.HistogramVec
+	scrapeSuccess   *prometheus.GaugeVec
+	lastScrapeTime  *prometheus.GaugeVec
+	lastErrorInfo   *prometheus.GaugeVec
 
 	// API rate limit metrics
 	rateLimitErrors *prometheus.CounterVec
+	apiRequests     *prometheus.CounterVec
+
+	// Maintenance responses: a 503 or a 2xx HTML page
+	maintenanceResponses *prometheus.CounterVec
+
+	// Successful responses that carried no data
+	emptyResponses *prometheus.CounterVec
+
+	// Flume API connections rejected by TLS public key pinning
+	tlsPinFailures prometheus.Counter
+
+	// Estimated API requests left in the trailing hour
+	quotaRemaining prometheus.Gauge
+
+	// Minimum spacing the rate limiter currently enforces between API requests, and requests sent in the trailing hour
+	effectiveAPIInterval prometheus.Gauge
+	requestsThisHour     prometheus.Gauge
+
+	// API requests sent by the last collection cycle
+	requestsPerCollection prometheus.Gauge
+	collectionRateWait    prometheus.Gauge
+
+	// Device lists that added or removed devices compared with the previous cycle
+	deviceListChanges prometheus.Counter
+
+	// Age of the cached device list
+	deviceCacheAge prometheus.Gauge
+
+	// Requests left under the hard hourly request cap, nil unless the cap is enabled
+	requestBudgetRemaining prometheus.Gauge
+
+	// Last successful scrape and last outcome per endpoint, flagged as stale under the flag policy
+	dataStale          prometheus.Gauge     // nil unless the flag policy is enabled
+	endpointDataAge    *prometheus.GaugeVec // nil unless the flag policy is enabled
+	staleMetricsAfter  time.Duration
+	lastScrapeSuccess  map[string]time.Time
+	lastScrapeFailed   map[string]bool
+	scrapeOutcomeMutex sync.Mutex
+
+	// Requests answered by an identical request already in flight
+	coalescedRequests *prometheus.CounterVec
+
+	// Usage readings skipped because their datetime could not be parsed
+	malformedDatetimes *prometheus.CounterVec
+
+	// Token metrics
+	tokenJWTExpiry prometheus.Gauge
+	tokenInfo      *prometheus.GaugeVec
+
+	// Token exchanges: full authentications and refreshes, with failures
+	fullAuths            prometheus.Counter
+	fullAuthFailures     prometheus.Counter
+	tokenRefreshes       prometheus.Counter
+	tokenRefreshFailures prometheus.Counter
+
+	// Push mode metrics
+	pushFailures prometheus.Counter
+
+	// OTLP exports that failed after retries
+	otlpExportFailures prometheus.Counter
+
+	// Failed InfluxDB writes
+	influxDBWriteFailures prometheus.Counter
+
+	// Failed MQTT publishes
+	mqttPublishFailures prometheus.Counter
+
+	// Collection cycle metrics
+	collectionTimeouts    prometheus.Counter
+	skippedCollections    prometheus.Counter
+	activeCollection      prometheus.Gauge
+	cycleDuration         *prometheus.GaugeVec
+	cycleDurationHist     *prometheus.HistogramVec // nil unless enabled
+	deviceRefreshInterval *prometheus.GaugeVec
+
+	// Daily total deduplication
+	dailyTotalChanges *prometheus.CounterVec
+	lastDailyTotals   map[string]float64
+	dailyTotalsMutex  sync.Mutex
+
+	// Latest daily total per device and date, served by the CSV export
+	dailyTotalsByDevice map[string]map[string]float64
+
+	// Cumulative usage counter, derived from daily totals
+	waterUsageTotal   *prometheus.CounterVec
+	usageCounterState map[string]usageCounterState
+	usageCounterMutex sync.Mutex
+	startTime         prometheus.Gauge
+}
+
+// usageCounterState is the most recent daily total folded into the cumulative counter for a device
+type usageCounterState struct {
+	date  string
+	value float64
+}
+
+// bucketUsageMetric maps a Flume query bucket to the gauge its usage is exported as
+// Every bucket gets its own metric named after its period; a period label identifies each point when a
+// query returns one value per period, otherwise the gauge holds the sum of the query's points
+type bucketUsageMetric struct {
+	bucket      string // Flume query bucket
+	name        string
+	help        string
+	periodLabel string // label holding each point's period, empty for a summed gauge
+}
+
+// bucketUsageMetrics lists the usage gauge of each bucket the exporter queries
+var bucketUsageMetrics = []bucketUsageMetric{
+	{bucket: "HR", name: "flume_hourly_water_usage_gallons", help: "Water usage in gallons over the last hour"},
+	{bucket: "DAY", name: "flume_daily_total_water_usage_gallons", help: "Total water usage in gallons for each day over a time period", periodLabel: "date"},
+	{bucket: "YR", name: "flume_yearly_water_usage_gallons", help: "Total water usage in gallons for each calendar year", periodLabel: "year"},
+}
+
+// bucketUsageMetricFor returns the usage gauge mapping of a Flume query bucket
+func bucketUsageMetricFor(bucket string) (bucketUsageMetric, bool) {
+	for _, bm := range bucketUsageMetrics {
+		if bm.bucket == bucket {
+			return bm, true
+		}
+	}
+	return bucketUsageMetric{}, false
 }
 
-// NewMetrics creates and registers all Prometheus metrics
+// NewMetrics creates and registers all Prometheus metrics with the default registerer
 func NewMetrics() *Metrics {
+	return NewMetricsWithRegisterer(prometheus.DefaultRegisterer)
+}
+
+// NewMetricsWithRegisterer creates all Prometheus metrics and registers them with reg
+func NewMetricsWithRegisterer(reg prometheus.Registerer) *Metrics {
+	return NewMetricsWithHelp(reg, nil)
+}
+
+// NewMetricsWithHelp creates all Prometheus metrics and registers them with reg, appending the configured
+// text to the help of the metrics named in helpSuffixes. Names that match no metric are logged
+func NewMetricsWithHelp(reg prometheus.Registerer, helpSuffixes map[string]string) *Metrics {
+	return newMetrics(reg, helpSuffixes, false)
+}
+
+// NewSnapshotMetrics is like NewMetricsWithHelp, but serves the device metrics from a snapshot taken by
+// PublishSnapshot after each collection cycle instead of the live values
+func NewSnapshotMetrics(reg prometheus.Registerer, helpSuffixes map[string]string) *Metrics {
+	return newMetrics(reg, helpSuffixes, true)
+}
+
+// newMetrics creates all Prometheus metrics and registers them with reg, with the device metrics behind a
+// snapshot collector if snapshot is set
+func newMetrics(reg prometheus.Registerer, helpSuffixes map[string]string, snapshot bool) *Metrics {
+	used := make(map[string]bool)
+	help := func(name, text string) string {
+		used[name] = true
+		return metricHelp(helpSuffixes, name, text)
+	}
+
 	m := &Metrics{
 		currentFlowRate: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "flume_current_flow_rate_gallons_per_minute",
-				Help: "Current water flow rate in gallons per minute",
+				Help: help("flume_current_flow_rate_gallons_per_minute", "Current water flow rate in gallons per minute"),
+			},
+			[]string{"device_id", "device_name", "location"},
+		),
+
+		flowActive: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "flume_flow_active",
+				Help: help("flume_flow_active", "Whether the device currently reports active water flow (1) or not (0)"),
+			},
+			[]string{"device_id", "device_name", "location"},
+		),
+
+		flowRateAge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "flume_flow_rate_age_seconds",
+				Help: help("flume_flow_rate_age_seconds", "Age of the reported flow rate; nonzero while a previous reading is held over empty API responses"),
+			},
+			[]string{"device_id", "device_name", "location"},
+		),
+
+		dataAge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "flume_device_data_age_seconds",
+				Help: help("flume_device_data_age_seconds", "Time since Flume took the device's latest flow rate reading; grows while the sensor is not reporting to Flume"),
+			},
+			[]string{"device_id", "device_name", "location"},
+		),
+
+		waterPressure: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "flume_water_pressure_psi",
+				Help: help("flume_water_pressure_psi", "Water pressure in PSI, for devices that report it"),
+			},
+			[]string{"device_id", "device_name", "location"},
+		),
+
+		bucketUsage: make(map[string]*prometheus.GaugeVec, len(bucketUsageMetrics)),
+
+		todayWaterUsage: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "flume_today_water_usage_gallons",
+				Help: help("flume_today_water_usage_gallons", "Water usage in gallons since local midnight, updated every collection"),
+			},
+			[]string{"device_id", "device_name", "location"},
+		),
+
+		accountFlowRate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "flume_account_flow_rate_gallons_per_minute",
+				Help: help("flume_account_flow_rate_gallons_per_minute", "Current flow rate summed across all processed sensors; partial=\"true\" when a sensor's latest reading failed and is left out"),
+			},
+			[]string{"partial"},
+		),
+
+		accountUsage: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "flume_account_total_water_usage_gallons",
+				Help: help("flume_account_total_water_usage_gallons", "Water usage in gallons summed across all processed sensors for the last hour, today and the current year; partial=\"true\" when a sensor's latest query failed and is left out"),
+			},
+			[]string{"period", "partial"},
+		),
+
+		dailyTotalDays: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "flume_daily_total_days_retrieved",
+				Help: help("flume_daily_total_days_retrieved", "Number of days with a daily total in the most recent daily total query"),
 			},
 			[]string{"device_id", "device_name", "location"},
 		),
 
-		totalWaterUsage: prometheus.NewGaugeVec(
+		dailyTotalMissing: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "flume_daily_total_days_missing",
+				Help: help("flume_daily_total_days_missing", "Days without a daily total in the most recent daily total query, by reason: history_start (before the first reading, e.g. a new account) or gap (between readings)"),
+			},
+			[]string{"device_id", "device_name", "location", "reason"},
+		),
+
+		dailyBudget: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "flume_total_water_usage_gallons",
-				Help: "Total water usage in gallons for a specific time period",
+				Name: "flume_daily_usage_budget_gallons",
+				Help: help("flume_daily_usage_budget_gallons", "Configured daily water budget in gallons"),
 			},
-			[]string{"device_id", "device_name", "location", "bucket"},
+			[]string{"device_id", "device_name", "location"},
 		),
 
-		dailyTotalWaterUsage: prometheus.NewGaugeVec(
+		dailyBudgetRatio: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "flume_daily_total_water_usage_gallons",
-				Help: "Total water usage in gallons for each day over a time period",
+				Name: "flume_daily_usage_budget_ratio",
+				Help: help("flume_daily_usage_budget_ratio", "Today's water usage as a fraction of the configured daily budget (1 means the budget is used up)"),
 			},
-			[]string{"device_id", "device_name", "location", "date"},
+			[]string{"device_id", "device_name", "location"},
 		),
 
 		deviceInfo: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "flume_device_info",
-				Help: "Information about Flume devices",
+				Help: help("flume_device_info", "Information about Flume devices"),
+			},
+			[]string{"device_id", "device_name", "location", "device_type", "firmware", "product", "shared"},
+		),
+
+		deviceInstallTimestamp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "flume_device_install_timestamp_seconds",
+				Help: help("flume_device_install_timestamp_seconds", "Unix timestamp of when the device was added to the Flume account, only for devices the API reports it for"),
 			},
-			[]string{"device_id", "device_name", "location", "device_type"},
+			[]string{"device_id", "device_name", "location"},
+		),
+
+		deviceConnected: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "flume_device_connected",
+				Help: help("flume_device_connected", "Whether the Flume API reports the device as connected (1) or disconnected (0), only for devices the API reports it for"),
+			},
+			[]string{"device_id", "device_name", "location"},
 		),
 
 		scrapeDuration: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "flume_exporter_scrape_duration_seconds",
-				Help: "Time spent scraping Flume API",
+				Help: help("flume_exporter_scrape_duration_seconds", "Time spent scraping Flume API"),
+			},
+			[]string{"endpoint"},
+		),
+
+		requestDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "flume_exporter_api_request_duration_seconds",
+				Help:    help("flume_exporter_api_request_duration_seconds", "Distribution of time spent on Flume API calls, including rate limiter waits"),
+				Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
 			},
 			[]string{"endpoint"},
 		),
@@ -77,7 +361,7 @@ func NewMetrics() *Metrics {
 		scrapeSuccess: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "flume_exporter_scrape_success",
-				Help: "Whether the last scrape was successful",
+				Help: help("flume_exporter_scrape_success", "Whether the last scrape was successful"),
 			},
 			[]string{"endpoint"},
 		),
@@ -85,32 +369,344 @@ func NewMetrics() *Metrics {
 		lastScrapeTime: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "flume_exporter_last_scrape_timestamp_seconds",
-				Help: "Unix timestamp of the last scrape",
+				Help: help("flume_exporter_last_scrape_timestamp_seconds", "Unix timestamp of the last scrape"),
 			},
 			[]string{"endpoint"},
 		),
 
+		lastErrorInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "flume_exporter_scrape_last_error_info",
+				Help: help("flume_exporter_scrape_last_error_info", "Class of the last error seen for each endpoint (1 for the active class, 0 otherwise)"),
+			},
+			[]string{"endpoint", "error_class"},
+		),
+
 		rateLimitErrors: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "flume_exporter_rate_limit_errors_total",
-				Help: "Total number of rate limit errors encountered during Flume API scraping",
+				Help: help("flume_exporter_rate_limit_errors_total", "Total number of rate limit errors encountered during Flume API scraping"),
+			},
+			[]string{"endpoint"},
+		),
+
+		apiRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_api_requests_total",
+				Help: help("flume_exporter_api_requests_total", "Total number of requests sent to the Flume API, counting every request made by batched calls"),
+			},
+			[]string{"endpoint"},
+		),
+
+		dailyTotalChanges: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_daily_total_changes_total",
+				Help: help("flume_exporter_daily_total_changes_total", "Total number of daily total water usage values written because they were new or differed from the last value written"),
+			},
+			[]string{"device_id"},
+		),
+		lastDailyTotals: make(map[string]float64),
+
+		dailyTotalsByDevice: make(map[string]map[string]float64),
+
+		waterUsageTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "flume_water_usage_gallons_total",
+				Help: help("flume_water_usage_gallons_total", "Water usage in gallons since the exporter started, derived from daily totals"),
+			},
+			[]string{"device_id", "device_name", "location"},
+		),
+		usageCounterState: make(map[string]usageCounterState),
+
+		startTime: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "flume_exporter_start_time_seconds",
+				Help: help("flume_exporter_start_time_seconds", "Unix timestamp of when the exporter started, to correlate counter resets"),
+			},
+		),
+
+		collectionTimeouts: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_collection_timeouts_total",
+				Help: help("flume_exporter_collection_timeouts_total", "Total number of collection cycles aborted for exceeding the collection timeout"),
+			},
+		),
+
+		skippedCollections: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_collections_skipped_total",
+				Help: help("flume_exporter_collections_skipped_total", "Total number of collection cycles skipped because the previous cycle was still running"),
+			},
+		),
+
+		activeCollection: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "flume_exporter_active_collection",
+				Help: help("flume_exporter_active_collection", "Number of collection cycles currently running (flow and usage cycles may overlap)"),
+			},
+		),
+
+		cycleDuration: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "flume_exporter_collection_cycle_duration_seconds",
+				Help: help("flume_exporter_collection_cycle_duration_seconds", "Duration of the last complete collection cycle across all devices and endpoints, including rate limiter waits"),
+			},
+			[]string{"cycle"},
+		),
+
+		deviceRefreshInterval: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "flume_exporter_device_refresh_interval_seconds",
+				Help: help("flume_exporter_device_refresh_interval_seconds", "Effective interval between flow rate refreshes for each device, based on its priority"),
+			},
+			[]string{"device_id"},
+		),
+
+		maintenanceResponses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_maintenance_responses_total",
+				Help: help("flume_exporter_maintenance_responses_total", "Total number of maintenance responses (a 503, or an HTML page with a 2xx status) received from the Flume API"),
+			},
+			[]string{"endpoint"},
+		),
+
+		tlsPinFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_tls_pin_failures_total",
+				Help: help("flume_exporter_tls_pin_failures_total", "Total number of Flume API connections rejected because the certificate did not match a pinned public key"),
+			},
+		),
+
+		quotaRemaining: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "flume_exporter_quota_remaining_estimate",
+				Help: help("flume_exporter_quota_remaining_estimate", "Estimated number of Flume API requests left in the trailing hour"),
+			},
+		),
+
+		coalescedRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_coalesced_requests_total",
+				Help: help("flume_exporter_coalesced_requests_total", "Total number of usage queries that shared an identical request already in flight instead of sending their own"),
+			},
+			[]string{"endpoint"},
+		),
+
+		effectiveAPIInterval: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "flume_exporter_effective_api_interval_seconds",
+				Help: help("flume_exporter_effective_api_interval_seconds", "Minimum spacing the rate limiter currently enforces between Flume API requests; exceeds the configured API minimum interval after a 429"),
+			},
+		),
+
+		deviceListChanges: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_device_list_changes_total",
+				Help: help("flume_exporter_device_list_changes_total", "Total number of collection cycles whose device list added or removed devices compared with the previous cycle"),
+			},
+		),
+
+		requestsPerCollection: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "flume_exporter_requests_per_collection",
+				Help: help("flume_exporter_requests_per_collection", "Flume API requests sent by the last collection cycle, including device list, user ID and token refresh requests"),
+			},
+		),
+
+		collectionRateWait: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "flume_exporter_collection_rate_limit_wait_seconds",
+				Help: help("flume_exporter_collection_rate_limit_wait_seconds", "Time the last collection cycle spent blocked waiting on the API rate limiter"),
+			},
+		),
+
+		requestsThisHour: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "flume_exporter_requests_this_hour",
+				Help: help("flume_exporter_requests_this_hour", "Flume API requests this exporter sent in the trailing hour"),
+			},
+		),
+
+		deviceCacheAge: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "flume_exporter_device_cache_age_seconds",
+				Help: help("flume_exporter_device_cache_age_seconds", "Age of the device list used by the last collection cycle (0 right after a re-fetch)"),
+			},
+		),
+
+		emptyResponses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_empty_responses_total",
+				Help: help("flume_exporter_empty_responses_total", "Total number of successful Flume API responses that contained no data points"),
+			},
+			[]string{"endpoint"},
+		),
+
+		malformedDatetimes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_malformed_datetime_total",
+				Help: help("flume_exporter_malformed_datetime_total", "Total number of usage readings skipped because their datetime could not be parsed"),
 			},
 			[]string{"endpoint"},
 		),
+
+		tokenJWTExpiry: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "flume_exporter_token_jwt_exp_timestamp_seconds",
+				Help: help("flume_exporter_token_jwt_exp_timestamp_seconds", "Unix timestamp of the access token expiry according to the JWT exp claim"),
+			},
+		),
+
+		tokenInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "flume_exporter_token_info",
+				Help: help("flume_exporter_token_info", "Scope and audience claims of the current access token (always 1)"),
+			},
+			[]string{"scope", "audience"},
+		),
+
+		fullAuths: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_full_auth_total",
+				Help: help("flume_exporter_full_auth_total", "Total number of full authentications with the Flume credentials"),
+			},
+		),
+
+		fullAuthFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_full_auth_failures_total",
+				Help: help("flume_exporter_full_auth_failures_total", "Total number of full authentications that failed"),
+			},
+		),
+
+		tokenRefreshes: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_token_refresh_total",
+				Help: help("flume_exporter_token_refresh_total", "Total number of access token refreshes using the refresh token"),
+			},
+		),
+
+		tokenRefreshFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_token_refresh_failures_total",
+				Help: help("flume_exporter_token_refresh_failures_total", "Total number of access token refreshes that failed"),
+			},
+		),
+
+		otlpExportFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_otlp_export_failures_total",
+				Help: help("flume_exporter_otlp_export_failures_total", "Total number of OTLP metric exports that failed after retries"),
+			},
+		),
+
+		mqttPublishFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_mqtt_publish_failures_total",
+				Help: help("flume_exporter_mqtt_publish_failures_total", "Total number of failed attempts to publish values to the MQTT broker"),
+			},
+		),
+
+		influxDBWriteFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_influxdb_write_failures_total",
+				Help: help("flume_exporter_influxdb_write_failures_total", "Total number of failed metric writes to InfluxDB"),
+			},
+		),
+
+		pushFailures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "flume_exporter_push_failures_total",
+				Help: help("flume_exporter_push_failures_total", "Total number of failed attempts to push metrics to the Pushgateway"),
+			},
+		),
+	}
+
+	for _, bm := range bucketUsageMetrics {
+		labels := []string{"device_id", "device_name", "location"}
+		if bm.periodLabel != "" {
+			labels = append(labels, bm.periodLabel)
+		}
+		m.bucketUsage[bm.bucket] = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: bm.name,
+				Help: help(bm.name, bm.help),
+			},
+			labels,
+		)
 	}
 
-	// Register all metrics
-	prometheus.MustRegister(
+	// Register all metrics; the device metrics are served from snapshots when enabled
+	deviceCollectors := []prometheus.Collector{
 		m.currentFlowRate,
-		m.totalWaterUsage,
-		m.dailyTotalWaterUsage,
+		m.flowActive,
+		m.flowRateAge,
+		m.dataAge,
+		m.waterPressure,
+	}
+	for _, bm := range bucketUsageMetrics {
+		deviceCollectors = append(deviceCollectors, m.bucketUsage[bm.bucket])
+	}
+	deviceCollectors = append(deviceCollectors,
+		m.todayWaterUsage,
+		m.accountFlowRate,
+		m.accountUsage,
+		m.dailyTotalDays,
+		m.dailyTotalMissing,
+		m.dailyBudget,
+		m.dailyBudgetRatio,
 		m.deviceInfo,
+		m.deviceInstallTimestamp,
+		m.deviceConnected,
+		m.waterUsageTotal,
+	)
+	if snapshot {
+		m.snapshot = newSnapshotCollector(deviceCollectors)
+		reg.MustRegister(m.snapshot)
+	} else {
+		reg.MustRegister(deviceCollectors...)
+	}
+	reg.MustRegister(
 		m.scrapeDuration,
+		m.requestDuration,
 		m.scrapeSuccess,
 		m.lastScrapeTime,
+		m.lastErrorInfo,
 		m.rateLimitErrors,
+		m.apiRequests,
+		m.pushFailures,
+		m.otlpExportFailures,
+		m.influxDBWriteFailures,
+		m.mqttPublishFailures,
+		m.dailyTotalChanges,
+		m.collectionTimeouts,
+		m.skippedCollections,
+		m.activeCollection,
+		m.cycleDuration,
+		m.deviceRefreshInterval,
+		m.tokenJWTExpiry,
+		m.tokenInfo,
+		m.fullAuths,
+		m.fullAuthFailures,
+		m.tokenRefreshes,
+		m.tokenRefreshFailures,
+		m.startTime,
+		m.maintenanceResponses,
+		m.emptyResponses,
+		m.malformedDatetimes,
+		m.quotaRemaining,
+		m.effectiveAPIInterval,
+		m.coalescedRequests,
+		m.requestsThisHour,
+		m.requestsPerCollection,
+		m.collectionRateWait,
+		m.deviceListChanges,
+		m.deviceCacheAge,
+		m.tlsPinFailures,
 	)
 
+	m.startTime.Set(float64(time.Now().Unix()))
+
 	// Initialize rate limit error metric to 0 for common endpoints
 	// This ensures the metric is visible in Prometheus even before any errors occur
 	commonEndpoints := []string{"devices", "flow_rate", "daily_total_water_usage", "water_usage"}
@@ -118,103 +714,897 @@ func NewMetrics() *Metrics {
 		m.rateLimitErrors.WithLabelValues(endpoint).Add(0)
 	}
 
+	// The optional metrics are created later, only when enabled
+	m.helpSuffixes = helpSuffixes
+	used[cycleDurationHistogramName] = true
+	used[requestBudgetRemainingName] = true
+	used[dataStaleName] = true
+	used[endpointDataAgeName] = true
+	for name := range helpSuffixes {
+		if !used[name] {
+			log.Printf("Warning: Help text configured for unknown metric '%s', ignoring", name)
+		}
+	}
+
 	return m
 }
 
-// UpdateCurrentFlowRate updates the current flow rate metric
+// metricHelp returns the help text for a metric with any configured suffix appended
+func metricHelp(helpSuffixes map[string]string, name, text string) string {
+	if suffix := helpSuffixes[name]; suffix != "" {
+		return text + ". " + suffix
+	}
+	return text
+}
+
+// PublishSnapshot makes the current device metric values visible to scrapes, when snapshots are enabled
+func (m *Metrics) PublishSnapshot() {
+	if m.snapshot == nil {
+		return
+	}
+	log.Printf("Published snapshot of %d device series", m.snapshot.publish())
+}
+
+// UpdateCurrentFlowRate updates the current flow rate metric
 func (m *Metrics) UpdateCurrentFlowRate(deviceID, deviceName, location string, flowRate float64) {
 	m.currentFlowRate.WithLabelValues(deviceID, deviceName, location).Set(flowRate)
 }
 
-// UpdateWaterUsage updates water usage metrics from query response
+// SetFlowRateAge records how old the reported flow rate reading is
+func (m *Metrics) SetFlowRateAge(deviceID, deviceName, location string, age time.Duration) {
+	m.flowRateAge.WithLabelValues(deviceID, deviceName, location).Set(age.Seconds())
+}
+
+// SetDataAge records how long ago Flume took the device's latest reading
+func (m *Metrics) SetDataAge(deviceID, deviceName, location string, age time.Duration) {
+	m.dataAge.WithLabelValues(deviceID, deviceName, location).Set(age.Seconds())
+}
+
+// UpdateSensorReadings updates the active-flow flag and any optional sensor readings
+func (m *Metrics) UpdateSensorReadings(deviceID, deviceName, location string, flowRate *FlowRateResponse) {
+	if flowRate.Active {
+		m.flowActive.WithLabelValues(deviceID, deviceName, location).Set(1)
+	} else {
+		m.flowActive.WithLabelValues(deviceID, deviceName, location).Set(0)
+	}
+
+	if flowRate.PressurePSI != nil {
+		m.waterPressure.WithLabelValues(deviceID, deviceName, location).Set(*flowRate.PressurePSI)
+	}
+}
+
+// UpdateWaterUsage sets the usage gauge of each queried bucket that has no period label to the sum of its points
+// Buckets without a gauge are ignored
 func (m *Metrics) UpdateWaterUsage(deviceID, deviceName, location string, queryResp *QueryResponse) {
 	for _, data := range queryResp.Data {
-		bucket := data.Bucket
+		bm, ok := bucketUsageMetricFor(data.Bucket)
+		if !ok || bm.periodLabel != "" {
+			continue
+		}
 
 		// Calculate total usage for this time period
 		var totalUsage float64
-		for _, waterUsage := range data.WaterUsage {
+		for _, waterUsage := range data.Points() {
 			totalUsage += waterUsage.Value
 		}
+		m.bucketUsage[bm.bucket].WithLabelValues(deviceID, deviceName, location).Set(totalUsage)
+	}
+}
+
+// UpdateTodayWaterUsage records the water used since local midnight
+func (m *Metrics) UpdateTodayWaterUsage(deviceID, deviceName, location string, gallons float64) {
+	m.todayWaterUsage.WithLabelValues(deviceID, deviceName, location).Set(gallons)
+}
+
+// SetAccountTotal records an account total, replacing its series with the other partial value
+// An empty period is the flow rate total
+func (m *Metrics) SetAccountTotal(period string, value float64, partial bool) {
+	m.DeleteAccountTotal(period)
+	if period == "" {
+		m.accountFlowRate.WithLabelValues(strconv.FormatBool(partial)).Set(value)
+		return
+	}
+	m.accountUsage.WithLabelValues(period, strconv.FormatBool(partial)).Set(value)
+}
+
+// DeleteAccountTotal removes an account total, e.g. when no processed sensor collects it any more
+func (m *Metrics) DeleteAccountTotal(period string) {
+	if period == "" {
+		m.accountFlowRate.Reset()
+		return
+	}
+	m.accountUsage.DeletePartialMatch(prometheus.Labels{"period": period})
+}
+
+// UpdateDailyTotalCoverage records how many days the latest daily total query returned and why days are missing
+func (m *Metrics) UpdateDailyTotalCoverage(deviceID, deviceName, location string, coverage DailyTotalCoverage) {
+	m.dailyTotalDays.WithLabelValues(deviceID, deviceName, location).Set(float64(coverage.Retrieved))
+	m.dailyTotalMissing.WithLabelValues(deviceID, deviceName, location, "history_start").Set(float64(coverage.HistoryStartDays))
+	m.dailyTotalMissing.WithLabelValues(deviceID, deviceName, location, "gap").Set(float64(coverage.GapDays))
+}
 
-		// Update the appropriate metric based on bucket type
-		switch bucket {
-		case "HR":
-			m.totalWaterUsage.WithLabelValues(deviceID, deviceName, location, bucket).Set(totalUsage)
-		case "DAY":
-			m.totalWaterUsage.WithLabelValues(deviceID, deviceName, location, bucket).Set(totalUsage)
+// UpdateDailyBudget records a device's daily budget and how much of it today's usage has used
+// A zero budget removes both series, e.g. after the budget was dropped from the configuration
+func (m *Metrics) UpdateDailyBudget(deviceID, deviceName, location string, budget, todayGallons float64) {
+	if budget <= 0 {
+		m.dailyBudget.DeletePartialMatch(prometheus.Labels{"device_id": deviceID})
+		m.dailyBudgetRatio.DeletePartialMatch(prometheus.Labels{"device_id": deviceID})
+		return
+	}
+	m.dailyBudget.WithLabelValues(deviceID, deviceName, location).Set(budget)
+	m.dailyBudgetRatio.WithLabelValues(deviceID, deviceName, location).Set(todayGallons / budget)
+}
+
+// UpdateYearlyWaterUsage updates the yearly water usage metric from a YR bucket query
+// Returns the number of years updated; accounts with less than a year of data report only the current year
+func (m *Metrics) UpdateYearlyWaterUsage(deviceID, deviceName, location string, queryResp *QueryResponse) int {
+	years := 0
+	for _, data := range queryResp.Data {
+		for _, point := range data.Points() {
+			t, err := point.Time()
+			if err != nil {
+				log.Printf("Skipping yearly usage point for device %s: %v", deviceID, err)
+				m.RecordMalformedDatetime("yearly_water_usage")
+				continue
+			}
+			m.bucketUsage["YR"].WithLabelValues(deviceID, deviceName, location, strconv.Itoa(t.Year())).Set(point.Value)
+			years++
 		}
 	}
+	return years
 }
 
 // UpdateDailyTotalWaterUsage updates the daily total water usage metric for a specific date
+// The gauge is only written when the value differs from the last one written for that device and date
 func (m *Metrics) UpdateDailyTotalWaterUsage(deviceID, deviceName, location, date string, usage float64) {
-	m.dailyTotalWaterUsage.WithLabelValues(deviceID, deviceName, location, date).Set(usage)
+	m.dailyTotalsMutex.Lock()
+	defer m.dailyTotalsMutex.Unlock()
+
+	if m.dailyTotalsByDevice[deviceID] == nil {
+		m.dailyTotalsByDevice[deviceID] = make(map[string]float64)
+	}
+	m.dailyTotalsByDevice[deviceID][date] = usage
+
+	key := strings.Join([]string{deviceID, deviceName, location, date}, "|")
+	if last, ok := m.lastDailyTotals[key]; ok && last == usage {
+		return
+	}
+
+	if _, ok := m.lastDailyTotals[key]; ok {
+		log.Printf("Daily total for device %s on %s changed: %.2f -> %.2f", deviceID, date, m.lastDailyTotals[key], usage)
+	}
+	m.lastDailyTotals[key] = usage
+	m.dailyTotalChanges.WithLabelValues(deviceID).Inc()
+	m.bucketUsage["DAY"].WithLabelValues(deviceID, deviceName, location, date).Set(usage)
 }
 
-// UpdateDeviceInfo updates device information metric
-func (m *Metrics) UpdateDeviceInfo(device Device, deviceName string) {
-	deviceType := "unknown"
-	switch device.Type {
-	case 1:
-		deviceType = "bridge"
-	case 2:
-		deviceType = "sensor"
+// PruneDailyTotals forgets a device's daily totals dated before since (YYYY-MM-DD), which have left the lookback
+// window, so the deduplication and export state stays bounded. The gauges keep their last value
+func (m *Metrics) PruneDailyTotals(deviceID, since string) {
+	m.dailyTotalsMutex.Lock()
+	defer m.dailyTotalsMutex.Unlock()
+
+	for date := range m.dailyTotalsByDevice[deviceID] {
+		if date < since {
+			delete(m.dailyTotalsByDevice[deviceID], date)
+		}
+	}
+
+	// Keys end with the date
+	prefix := deviceID + "|"
+	for key := range m.lastDailyTotals {
+		if strings.HasPrefix(key, prefix) && key[strings.LastIndex(key, "|")+1:] < since {
+			delete(m.lastDailyTotals, key)
+		}
+	}
+}
+
+// DailyTotals returns a copy of the daily totals collected for a device, keyed by YYYY-MM-DD date
+func (m *Metrics) DailyTotals(deviceID string) map[string]float64 {
+	m.dailyTotalsMutex.Lock()
+	defer m.dailyTotalsMutex.Unlock()
+
+	days := make(map[string]float64, len(m.dailyTotalsByDevice[deviceID]))
+	for date, gallons := range m.dailyTotalsByDevice[deviceID] {
+		days[date] = gallons
+	}
+	return days
+}
+
+// DailyTotalDevices returns the sorted IDs of the devices with collected daily totals
+func (m *Metrics) DailyTotalDevices() []string {
+	m.dailyTotalsMutex.Lock()
+	defer m.dailyTotalsMutex.Unlock()
+
+	deviceIDs := make([]string, 0, len(m.dailyTotalsByDevice))
+	for deviceID := range m.dailyTotalsByDevice {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Strings(deviceIDs)
+	return deviceIDs
+}
+
+// AddUsageFromDailyTotal folds a daily total into the cumulative usage counter
+// Daily totals must be passed in date order. The first value seen for a device is only a baseline,
+// so the counter starts from 0; later values add the growth of the current day, or the whole value
+// of a new day (daily totals reset at midnight). Deltas are clamped to >= 0 so the counter never decreases.
+func (m *Metrics) AddUsageFromDailyTotal(deviceID, deviceName, location, date string, usage float64) {
+	m.usageCounterMutex.Lock()
+	defer m.usageCounterMutex.Unlock()
+
+	key := strings.Join([]string{deviceID, deviceName, location}, "|")
+	counter := m.waterUsageTotal.WithLabelValues(deviceID, deviceName, location)
+
+	last, ok := m.usageCounterState[key]
+	if !ok {
+		counter.Add(0)
+		m.usageCounterState[key] = usageCounterState{date: date, value: usage}
+		return
+	}
+
+	var delta float64
+	switch {
+	case date < last.date:
+		// Older days were already accounted for
+		return
+	case date == last.date:
+		delta = usage - last.value
+	default:
+		// New day: the daily total restarted from zero at midnight
+		delta = usage
+	}
+
+	if delta < 0 {
+		log.Printf("Ignoring decrease in daily total for device %s on %s (%.2f -> %.2f)", deviceID, date, last.value, usage)
+		delta = 0
+	}
+
+	counter.Add(delta)
+	m.usageCounterState[key] = usageCounterState{date: date, value: usage}
+}
+
+// DeleteDeviceMetrics removes every series and cached usage state for a device, reporting whether any series existed
+func (m *Metrics) DeleteDeviceMetrics(deviceID string) bool {
+	labels := prometheus.Labels{"device_id": deviceID}
+	deleted := 0
+	for _, vec := range []*prometheus.GaugeVec{
+		m.currentFlowRate, m.flowActive, m.flowRateAge, m.dataAge, m.waterPressure, m.todayWaterUsage,
+		m.dailyTotalDays, m.dailyTotalMissing, m.dailyBudget, m.dailyBudgetRatio,
+		m.deviceInfo, m.deviceInstallTimestamp, m.deviceConnected, m.deviceRefreshInterval,
+	} {
+		deleted += vec.DeletePartialMatch(labels)
+	}
+	for _, vec := range m.bucketUsage {
+		deleted += vec.DeletePartialMatch(labels)
+	}
+	deleted += m.dailyTotalChanges.DeletePartialMatch(labels)
+	deleted += m.waterUsageTotal.DeletePartialMatch(labels)
+
+	prefix := deviceID + "|"
+	m.dailyTotalsMutex.Lock()
+	for key := range m.lastDailyTotals {
+		if strings.HasPrefix(key, prefix) {
+			delete(m.lastDailyTotals, key)
+		}
+	}
+	delete(m.dailyTotalsByDevice, deviceID)
+	m.dailyTotalsMutex.Unlock()
+
+	m.usageCounterMutex.Lock()
+	for key := range m.usageCounterState {
+		if strings.HasPrefix(key, prefix) {
+			delete(m.usageCounterState, key)
+		}
 	}
+	m.usageCounterMutex.Unlock()
 
+	return deleted > 0
+}
+
+// UpdateDeviceInfo updates device information metric
+func (m *Metrics) UpdateDeviceInfo(device Device, deviceName string) {
 	m.deviceInfo.WithLabelValues(
 		device.ID,
 		deviceName,
 		device.Location.Name,
-		deviceType,
+		device.TypeLabel(),
+		device.FirmwareLabel(),
+		device.Product,
+		strconv.FormatBool(device.Shared),
 	).Set(1)
+
+	if installedAt, ok := device.InstalledAt(); ok {
+		m.deviceInstallTimestamp.WithLabelValues(device.ID, deviceName, device.Location.Name).Set(float64(installedAt.Unix()))
+	}
+
+	if device.Connected != nil {
+		connected := 0.0
+		if *device.Connected {
+			connected = 1
+		}
+		m.deviceConnected.WithLabelValues(device.ID, deviceName, device.Location.Name).Set(connected)
+	}
 }
 
 // RecordScrapeMetrics records metrics about a scrape operation
 func (m *Metrics) RecordScrapeMetrics(endpoint string, duration time.Duration, success bool) {
 	m.scrapeDuration.WithLabelValues(endpoint).Set(duration.Seconds())
+	m.requestDuration.WithLabelValues(endpoint).Observe(duration.Seconds())
 	if success {
 		m.scrapeSuccess.WithLabelValues(endpoint).Set(1)
 	} else {
 		m.scrapeSuccess.WithLabelValues(endpoint).Set(0)
 	}
 	m.lastScrapeTime.WithLabelValues(endpoint).Set(float64(time.Now().Unix()))
+	m.recordScrapeOutcome(endpoint, success, time.Now())
+}
+
+// recordScrapeOutcome tracks when an endpoint last returned data and whether its latest scrape failed
+func (m *Metrics) recordScrapeOutcome(endpoint string, success bool, now time.Time) {
+	m.scrapeOutcomeMutex.Lock()
+	defer m.scrapeOutcomeMutex.Unlock()
+
+	if m.lastScrapeSuccess == nil {
+		m.lastScrapeSuccess = make(map[string]time.Time)
+		m.lastScrapeFailed = make(map[string]bool)
+	}
+	if success {
+		m.lastScrapeSuccess[endpoint] = now
+	}
+	m.lastScrapeFailed[endpoint] = !success
+}
+
+// RecordScrapeError records the error class of the last scrape for an endpoint
+// A nil error resets every class to 0
+func (m *Metrics) RecordScrapeError(endpoint string, err error) {
+	var active ErrorClass
+	if err != nil {
+		active = classifyError(err)
+		log.Printf("Scrape error for endpoint %s (class %s): %v", endpoint, active, err)
+	}
+
+	for _, class := range errorClasses {
+		if class == active {
+			m.lastErrorInfo.WithLabelValues(endpoint, string(class)).Set(1)
+		} else {
+			m.lastErrorInfo.WithLabelValues(endpoint, string(class)).Set(0)
+		}
+	}
+}
+
+// RecordAPIRequest counts a request sent to the Flume API
+func (m *Metrics) RecordAPIRequest(endpoint string) {
+	m.apiRequests.WithLabelValues(endpoint).Inc()
+}
+
+// RecordRateLimitError records when a rate limit error (429) is encountered
+func (m *Metrics) RecordRateLimitError(endpoint string) {
+	m.rateLimitErrors.WithLabelValues(endpoint).Inc()
+}
+
+// RecordMaintenanceResponse records a Flume maintenance response
+func (m *Metrics) RecordMaintenanceResponse(endpoint string) {
+	m.maintenanceResponses.WithLabelValues(endpoint).Inc()
+}
+
+// RecordTLSPinFailure records a connection rejected by TLS public key pinning
+func (m *Metrics) RecordTLSPinFailure() {
+	m.tlsPinFailures.Inc()
+}
+
+// SetQuotaRemaining records the estimated number of API requests left in the trailing hour
+func (m *Metrics) SetQuotaRemaining(remaining int) {
+	m.quotaRemaining.Set(float64(remaining))
+}
+
+// requestBudgetRemainingName is the name of the optional request budget gauge
+const requestBudgetRemainingName = "flume_exporter_request_budget_remaining"
+
+// EnableRequestBudgetMetric exposes the requests left under the hard hourly request cap, registered with reg
+func (m *Metrics) EnableRequestBudgetMetric(reg prometheus.Registerer) {
+	m.requestBudgetRemaining = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: requestBudgetRemainingName,
+			Help: metricHelp(m.helpSuffixes, requestBudgetRemainingName, "Requests left in the trailing hour under the --max-requests-per-hour cap"),
+		},
+	)
+	reg.MustRegister(m.requestBudgetRemaining)
+}
+
+// SetRequestBudgetRemaining records the requests left under the hard hourly request cap
+func (m *Metrics) SetRequestBudgetRemaining(remaining int) {
+	if m.requestBudgetRemaining != nil {
+		m.requestBudgetRemaining.Set(float64(remaining))
+	}
+}
+
+// Stale metrics policies: what the exporter reports when the Flume API stops returning data
+const (
+	StaleMetricsFreeze = "freeze" // keep serving the last values unchanged
+	StaleMetricsFlag   = "flag"   // keep serving the last values and flag them as stale
+)
+
+const (
+	dataStaleName       = "flume_exporter_data_stale"
+	endpointDataAgeName = "flume_exporter_data_age_seconds"
+)
+
+// EnableStaleMetricsFlag exposes the age of each endpoint's data and a stale flag, registered with reg
+// The data is stale once an endpoint's latest scrape failed and its last successful scrape is older than after
+func (m *Metrics) EnableStaleMetricsFlag(reg prometheus.Registerer, after time.Duration) {
+	m.staleMetricsAfter = after
+	m.dataStale = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: dataStaleName,
+			Help: metricHelp(m.helpSuffixes, dataStaleName, "Whether the served metrics are stale (1) because an endpoint has been failing for longer than --stale-metrics-after"),
+		},
+	)
+	m.endpointDataAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: endpointDataAgeName,
+			Help: metricHelp(m.helpSuffixes, endpointDataAgeName, "Seconds since the last successful scrape of each API endpoint"),
+		},
+		[]string{"endpoint"},
+	)
+	reg.MustRegister(m.dataStale, m.endpointDataAge)
+}
+
+// UpdateDataStaleness refreshes the endpoint data ages and the stale flag
+func (m *Metrics) UpdateDataStaleness(now time.Time) {
+	if m.dataStale == nil {
+		return
+	}
+
+	m.scrapeOutcomeMutex.Lock()
+	defer m.scrapeOutcomeMutex.Unlock()
+
+	stale := false
+	for endpoint, at := range m.lastScrapeSuccess {
+		age := now.Sub(at)
+		m.endpointDataAge.WithLabelValues(endpoint).Set(age.Seconds())
+		// Endpoints collected on a schedule are only stale once they are failing
+		if m.lastScrapeFailed[endpoint] && age > m.staleMetricsAfter {
+			stale = true
+		}
+	}
+	if stale {
+		m.dataStale.Set(1)
+	} else {
+		m.dataStale.Set(0)
+	}
+}
+
+// SetEffectiveAPIInterval records the minimum spacing the rate limiter currently enforces between requests
+func (m *Metrics) SetEffectiveAPIInterval(interval time.Duration) {
+	m.effectiveAPIInterval.Set(interval.Seconds())
+}
+
+// SetRequestsThisHour records the Flume API requests sent in the trailing hour
+func (m *Metrics) SetRequestsThisHour(count int) {
+	m.requestsThisHour.Set(float64(count))
+}
+
+// SetRequestsPerCollection records the Flume API requests sent by the last collection cycle
+func (m *Metrics) SetRequestsPerCollection(count int64) {
+	m.requestsPerCollection.Set(float64(count))
+}
+
+// SetCollectionRateLimitWait records the time the last collection cycle spent waiting on the rate limiter
+func (m *Metrics) SetCollectionRateLimitWait(wait time.Duration) {
+	m.collectionRateWait.Set(wait.Seconds())
+}
+
+// RecordDeviceListChange records a device list that added or removed devices
+func (m *Metrics) RecordDeviceListChange() {
+	m.deviceListChanges.Inc()
+}
+
+// SetDeviceCacheAge records the age of the device list used by the last collection cycle
+func (m *Metrics) SetDeviceCacheAge(age time.Duration) {
+	m.deviceCacheAge.Set(age.Seconds())
+}
+
+// RecordEmptyResponse records a successful response that contained no data points
+func (m *Metrics) RecordEmptyResponse(endpoint string) {
+	m.emptyResponses.WithLabelValues(endpoint).Inc()
+}
+
+// RecordCoalescedRequest records a query that shared an identical in-flight request
+func (m *Metrics) RecordCoalescedRequest(endpoint string) {
+	m.coalescedRequests.WithLabelValues(endpoint).Inc()
+}
+
+// RecordMalformedDatetime records a usage reading skipped because of an unparseable datetime
+func (m *Metrics) RecordMalformedDatetime(endpoint string) {
+	m.malformedDatetimes.WithLabelValues(endpoint).Inc()
+}
+
+// RecordPushFailure records a failed push to the Pushgateway
+func (m *Metrics) RecordPushFailure() {
+	m.pushFailures.Inc()
+}
+
+// RecordFullAuth records a full authentication with the Flume credentials
+func (m *Metrics) RecordFullAuth(success bool) {
+	m.fullAuths.Inc()
+	if !success {
+		m.fullAuthFailures.Inc()
+	}
+}
+
+// RecordTokenRefresh records an access token refresh
+func (m *Metrics) RecordTokenRefresh(success bool) {
+	m.tokenRefreshes.Inc()
+	if !success {
+		m.tokenRefreshFailures.Inc()
+	}
+}
+
+// RecordOTLPExportFailure records an OTLP export that failed after retries
+func (m *Metrics) RecordOTLPExportFailure() {
+	m.otlpExportFailures.Inc()
+}
+
+// RecordMQTTPublishFailure records a failed publish to the MQTT broker
+func (m *Metrics) RecordMQTTPublishFailure() {
+	m.mqttPublishFailures.Inc()
+}
+
+// RecordInfluxDBWriteFailure records a failed metric write to InfluxDB
+func (m *Metrics) RecordInfluxDBWriteFailure() {
+	m.influxDBWriteFailures.Inc()
+}
+
+// RecordCollectionTimeout records a collection cycle aborted by the collection timeout
+func (m *Metrics) RecordCollectionTimeout() {
+	m.collectionTimeouts.Inc()
+}
+
+// RecordSkippedCollection records a collection cycle skipped because another was still running
+func (m *Metrics) RecordSkippedCollection() {
+	m.skippedCollections.Inc()
+}
+
+// SetActiveCollection tracks collection cycles starting (true) and finishing (false)
+func (m *Metrics) SetActiveCollection(active bool) {
+	if active {
+		m.activeCollection.Inc()
+	} else {
+		m.activeCollection.Dec()
+	}
+}
+
+// cycleDurationHistogramName is the name of the optional cycle duration histogram
+const cycleDurationHistogramName = "flume_exporter_collection_cycle_duration_histogram_seconds"
+
+// EnableCycleDurationHistogram additionally records collection cycle durations as a histogram registered with reg
+func (m *Metrics) EnableCycleDurationHistogram(reg prometheus.Registerer) {
+	m.cycleDurationHist = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    cycleDurationHistogramName,
+			Help:    metricHelp(m.helpSuffixes, cycleDurationHistogramName, "Distribution of collection cycle durations across all devices and endpoints, including rate limiter waits"),
+			Buckets: []float64{1, 5, 10, 30, 60, 120, 300, 600},
+		},
+		[]string{"cycle"},
+	)
+	reg.MustRegister(m.cycleDurationHist)
+}
+
+// RecordCycleDuration records the elapsed time of a finished collection cycle
+func (m *Metrics) RecordCycleDuration(cycle string, duration time.Duration) {
+	m.cycleDuration.WithLabelValues(cycle).Set(duration.Seconds())
+	if m.cycleDurationHist != nil {
+		m.cycleDurationHist.WithLabelValues(cycle).Observe(duration.Seconds())
+	}
+}
+
+// SetDeviceRefreshInterval records the effective flow rate refresh interval for a device
+func (m *Metrics) SetDeviceRefreshInterval(deviceID string, interval time.Duration) {
+	m.deviceRefreshInterval.WithLabelValues(deviceID).Set(interval.Seconds())
+}
+
+// SetTokenClaims records the JWT expiry and scope/audience claims of the current access token
+func (m *Metrics) SetTokenClaims(expiry time.Time, scope, audience string) {
+	if !expiry.IsZero() {
+		m.tokenJWTExpiry.Set(float64(expiry.Unix()))
+	}
+
+	// Only the current token's claims are kept
+	m.tokenInfo.Reset()
+	m.tokenInfo.WithLabelValues(scope, audience).Set(1)
+}
+
+// FlumeExporter handles the collection of metrics from Flume API
+type FlumeExporter struct {
+	client   *FlumeClient
+	metrics  *Metrics
+	pusher   *MetricsPusher
+	textfile *TextfileWriter
+	influx   *InfluxWriter
+	mqtt     *MQTTPublisher
+
+	// Running configuration; reloads store an updated copy while holding collectionMutex, so a reader
+	// never sees a half-applied reload
+	config atomic.Pointer[Config]
+
+	// Track when daily total water usage was last collected, and which devices have been backfilled since startup
+	lastDailyTotalCollection time.Time
+	dailyTotalsBackfilled    map[string]bool
+	dailyCollectionMutex     sync.Mutex
+
+	// Last nonzero flow rate reading per device, held over empty responses for the grace period
+	lastFlowRates     map[string]heldFlowRate
+	lastFlowRateMutex sync.Mutex
+
+	// Latest Flume reading time per device, to tell an offline sensor from a failing scrape
+	lastReadings map[string]deviceReading
+
+	// Track when yearly usage was last collected per device, to query it at most once a day
+	lastYearlyCollection  map[string]time.Time
+	yearlyCollectionMutex sync.Mutex
+
+	// Number of collection cycles started, used to schedule lower-priority devices
+	cycleCount int
+
+	// Held for the duration of a collection cycle so cycles of the same kind never overlap
+	collectionMutex sync.Mutex
+	usageMutex      sync.Mutex
+
+	// Tickers driving periodic collection, kept so a config reload can change their intervals
+	flowTicker  *time.Ticker
+	usageTicker *time.Ticker
+	tickerMutex sync.Mutex
+
+	// Shutdown coordination: in-flight collections and a context cancelled when shutdown runs out of time
+	inFlight       sync.WaitGroup
+	lifecycleMutex sync.Mutex
+	stopped        bool
+	cycleStarts    map[string]time.Time
+	requestPace    time.Duration
+	stopCh         chan struct{}
+	baseCtx        context.Context
+	cancelBase     context.CancelFunc
+
+	// Error classes, processed device count and all device IDs from the most recent collection cycle
+	lastCycleErrors  map[ErrorClass]bool
+	lastDeviceCount  int
+	deviceCountKnown bool
+	knownDeviceIDs   []string
+	locationLabels   map[string]string
+	cycleResults     cycleResults
+	lastCycleMutex   sync.Mutex
+
+	// Latest value per metric family and device, summed into the account totals
+	accountValues map[string]map[string]accountValue
+	accountMutex  sync.Mutex
+}
+
+// cycleResults counts successful and failed flow rate and daily total queries in a collection cycle
+type cycleResults struct {
+	flowOK   int
+	flowErr  int
+	dailyOK  int
+	dailyErr int
+}
+
+// NewFlumeExporter creates a new Flume exporter
+func NewFlumeExporter(client *FlumeClient, config *Config, metrics *Metrics) *FlumeExporter {
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	exporter := &FlumeExporter{
+		client:     client,
+		metrics:    metrics,
+		pusher:     NewMetricsPusher(config, metrics),
+		textfile:   NewTextfileWriter(config),
+		influx:     NewInfluxWriter(config, metrics),
+		mqtt:       NewMQTTPublisher(config, metrics),
+		stopCh:     make(chan struct{}),
+		baseCtx:    baseCtx,
+		cancelBase: cancelBase,
+	}
+	exporter.config.Store(config)
+	return exporter
+}
+
+// recordCycleError notes an error class seen during the current collection cycle
+func (e *FlumeExporter) recordCycleError(err error) {
+	e.lastCycleMutex.Lock()
+	defer e.lastCycleMutex.Unlock()
+
+	if e.lastCycleErrors == nil {
+		e.lastCycleErrors = make(map[ErrorClass]bool)
+	}
+	e.lastCycleErrors[classifyError(err)] = true
+}
+
+// resetCycleErrors clears the error classes recorded for the previous collection cycle
+func (e *FlumeExporter) resetCycleErrors() {
+	e.lastCycleMutex.Lock()
+	defer e.lastCycleMutex.Unlock()
+
+	e.lastCycleErrors = make(map[ErrorClass]bool)
+	e.cycleResults = cycleResults{}
+}
+
+// recordCycleResult counts a flow rate or daily total query result for the cycle summary
+func (e *FlumeExporter) recordCycleResult(endpoint string, ok bool) {
+	e.lastCycleMutex.Lock()
+	defer e.lastCycleMutex.Unlock()
+
+	switch {
+	case endpoint == "flow_rate" && ok:
+		e.cycleResults.flowOK++
+	case endpoint == "flow_rate":
+		e.cycleResults.flowErr++
+	case ok:
+		e.cycleResults.dailyOK++
+	default:
+		e.cycleResults.dailyErr++
+	}
+}
+
+// logCycleSummary logs one line summarising a collection cycle; the key=value fields are stable for log-based alerting
+func (e *FlumeExporter) logCycleSummary(status string, start time.Time, requests int64) {
+	e.lastCycleMutex.Lock()
+	results := e.cycleResults
+	devices := e.lastDeviceCount
+	e.lastCycleMutex.Unlock()
+
+	log.Printf("cycle complete: status=%s devices=%d flow_ok=%d flow_err=%d daily_ok=%d daily_err=%d duration=%.3fs requests=%d",
+		status, devices, results.flowOK, results.flowErr, results.dailyOK, results.dailyErr,
+		time.Since(start).Seconds(), requests)
+}
+
+// setDeviceCount records how many devices the current collection cycle processes
+func (e *FlumeExporter) setDeviceCount(count int) {
+	e.lastCycleMutex.Lock()
+	defer e.lastCycleMutex.Unlock()
+
+	e.lastDeviceCount = count
+	e.deviceCountKnown = true
+}
+
+// setKnownDevices records the IDs of every device on the account, filtered or not, and returns the IDs
+// added and removed since the previous device list; both are empty for the first list
+func (e *FlumeExporter) setKnownDevices(devices []Device) (added, removed []string) {
+	ids := make([]string, 0, len(devices))
+	current := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		ids = append(ids, device.ID)
+		current[device.ID] = true
+	}
+
+	e.lastCycleMutex.Lock()
+	defer e.lastCycleMutex.Unlock()
+
+	if e.knownDeviceIDs != nil {
+		previous := make(map[string]bool, len(e.knownDeviceIDs))
+		for _, id := range e.knownDeviceIDs {
+			previous[id] = true
+			if !current[id] {
+				removed = append(removed, id)
+			}
+		}
+		for _, id := range ids {
+			if !previous[id] {
+				added = append(added, id)
+			}
+		}
+	}
+	e.knownDeviceIDs = ids
+	return added, removed
+}
+
+// knownDevices returns the IDs of every device seen by the most recent collection cycle
+func (e *FlumeExporter) knownDevices() []string {
+	e.lastCycleMutex.Lock()
+	defer e.lastCycleMutex.Unlock()
+
+	return e.knownDeviceIDs
+}
+
+// DeviceCount returns the number of devices processed by the most recent collection cycle
+// The second value is false until a cycle has fetched the device list
+func (e *FlumeExporter) DeviceCount() (int, bool) {
+	e.lastCycleMutex.Lock()
+	defer e.lastCycleMutex.Unlock()
+
+	return e.lastDeviceCount, e.deviceCountKnown
+}
+
+// HasRecentError reports whether the most recent collection cycle hit an error of the given class
+func (e *FlumeExporter) HasRecentError(class ErrorClass) bool {
+	e.lastCycleMutex.Lock()
+	defer e.lastCycleMutex.Unlock()
+
+	return e.lastCycleErrors[class]
+}
+
+// heldFlowRate is a nonzero flow rate reading and when it was read
+type heldFlowRate struct {
+	reading *FlowRateResponse
+	readAt  time.Time
+}
+
+// applyFlowRateGrace returns the flow rate to report for a device and how old that reading is
+// When the API returns no reading, the last nonzero one is reported until it is older than the grace period,
+// so transient empty responses do not look like water stopping
+func (e *FlumeExporter) applyFlowRateGrace(deviceID string, flowRate *FlowRateResponse, now time.Time) (*FlowRateResponse, time.Duration) {
+	e.lastFlowRateMutex.Lock()
+	defer e.lastFlowRateMutex.Unlock()
+
+	if !flowRate.NoData {
+		if flowRate.Value > 0 {
+			if e.lastFlowRates == nil {
+				e.lastFlowRates = make(map[string]heldFlowRate)
+			}
+			e.lastFlowRates[deviceID] = heldFlowRate{reading: flowRate, readAt: now}
+		} else {
+			delete(e.lastFlowRates, deviceID)
+		}
+		return flowRate, 0
+	}
+
+	held, ok := e.lastFlowRates[deviceID]
+	if !ok {
+		return flowRate, 0
+	}
+	age := now.Sub(held.readAt)
+	if age > e.config.Load().FlowRateGracePeriod {
+		log.Printf("No flow rate reading for device %s for %s, past the %s grace period; reporting 0", deviceID, age.Round(time.Second), e.config.Load().FlowRateGracePeriod)
+		delete(e.lastFlowRates, deviceID)
+		return flowRate, 0
+	}
+
+	log.Printf("No flow rate reading for device %s, keeping last value %.2f from %s ago", deviceID, held.reading.Value, age.Round(time.Second))
+	return held.reading, age
 }
 
-// RecordRateLimitError records when a rate limit error (429) is encountered
-func (m *Metrics) RecordRateLimitError(endpoint string) {
-	m.rateLimitErrors.WithLabelValues(endpoint).Inc()
+// deviceReading is when Flume took a device's latest reading and whether it was reported as stale
+type deviceReading struct {
+	at    time.Time
+	stale bool
 }
 
-// FlumeExporter handles the collection of metrics from Flume API
-type FlumeExporter struct {
-	client  *FlumeClient
-	metrics *Metrics
-	config  *Config
+// updateDataAge records how old the device's latest Flume reading is, tracking its datetime across cycles
+// A reading that stops advancing means the sensor is not reporting to Flume even though the scrape succeeds;
+// a warning is logged once when it passes the stale data threshold and again when the sensor recovers
+func (e *FlumeExporter) updateDataAge(device Device, deviceName string, flowRate *FlowRateResponse, now time.Time) {
+	e.lastFlowRateMutex.Lock()
+	defer e.lastFlowRateMutex.Unlock()
 
-	// Track when daily total water usage was last collected
-	lastDailyTotalCollection time.Time
-	dailyCollectionMutex     sync.Mutex
-}
+	last, known := e.lastReadings[device.ID]
+	if !flowRate.ReadingTime.IsZero() && !flowRate.ReadingTime.Equal(last.at) {
+		if last.stale {
+			log.Printf("Device %s is reporting again: new Flume reading from %s", device.ID, flowRate.ReadingTime.Format(time.DateTime))
+		}
+		last = deviceReading{at: flowRate.ReadingTime}
+	} else if !known {
+		// No reading time yet, so there is no age to report
+		return
+	}
 
-// NewFlumeExporter creates a new Flume exporter
-func NewFlumeExporter(client *FlumeClient, config *Config, metrics *Metrics) *FlumeExporter {
-	return &FlumeExporter{
-		client:  client,
-		metrics: metrics,
-		config:  config,
+	age := max(now.Sub(last.at), 0)
+	if threshold := e.config.Load().StaleDataThreshold; threshold > 0 && age > threshold && !last.stale {
+		log.Printf("Warning: Latest Flume reading for device %s is from %s (%s ago); the sensor may be offline", device.ID, last.at.Format(time.DateTime), age.Round(time.Second))
+		last.stale = true
+	}
+
+	if e.lastReadings == nil {
+		e.lastReadings = make(map[string]deviceReading)
 	}
+	e.lastReadings[device.ID] = last
+	e.metrics.SetDataAge(device.ID, deviceName, device.Location.Name, age)
 }
 
 // shouldProcessDevice checks if a device should be processed based on DeviceIDs configuration
 func (e *FlumeExporter) shouldProcessDevice(deviceID string) bool {
 	// If no DeviceIDs specified, process all devices
-	if e.config.DeviceIDs == "" {
+	if e.config.Load().DeviceIDs == "" {
 		return true
 	}
 
 	// Parse comma-separated device IDs
-	deviceIDs := strings.Split(e.config.DeviceIDs, ",")
+	deviceIDs := strings.Split(e.config.Load().DeviceIDs, ",")
 	for _, id := range deviceIDs {
 		if strings.TrimSpace(id) == deviceID {
 			return true
@@ -223,13 +1613,41 @@ func (e *FlumeExporter) shouldProcessDevice(deviceID string) bool {
 	return false
 }
 
+// deviceRefreshCycles returns how many collection cycles pass between flow rate refreshes
+// for a device, based on the DevicePriorities configuration (1 means every cycle)
+func (e *FlumeExporter) deviceRefreshCycles(deviceID string) int {
+	if e.config.Load().DevicePriorities == "" {
+		return 1
+	}
+
+	// Parse comma-separated id:N pairs
+	for _, entry := range strings.Split(e.config.Load().DevicePriorities, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != deviceID {
+			continue
+		}
+		cycles, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || cycles < 1 {
+			log.Printf("Warning: Invalid device priority '%s', refreshing every cycle", entry)
+			return 1
+		}
+		return cycles
+	}
+	return 1
+}
+
+// shouldRefreshFlowRate checks whether a device's flow rate is due in the current cycle
+func (e *FlumeExporter) shouldRefreshFlowRate(deviceID string) bool {
+	return (e.cycleCount-1)%e.deviceRefreshCycles(deviceID) == 0
+}
+
 // shouldCollectDailyTotalWaterUsage checks if daily total water usage should be collected
 // Collects twice per day: once in the morning (around 6 AM) and once in the evening (around 6 PM)
 func (e *FlumeExporter) shouldCollectDailyTotalWaterUsage() bool {
 	e.dailyCollectionMutex.Lock()
 	defer e.dailyCollectionMutex.Unlock()
 
-	now := time.Now()
+	now := time.Now().In(e.config.Load().TimeLocation())
 
 	// If this is the first collection (zero time), always collect
 	if e.lastDailyTotalCollection.IsZero() {
@@ -276,8 +1694,22 @@ func (e *FlumeExporter) shouldCollectDailyTotalWaterUsage() bool {
 }
 
 // CollectMetrics collects all metrics from the Flume API
-func (e *FlumeExporter) CollectMetrics() {
+// The context is checked between API calls; once it is done the cycle stops, keeping metrics already updated
+func (e *FlumeExporter) CollectMetrics(ctx context.Context) {
 	log.Println("Starting metric collection...")
+	cycleStart := time.Now()
+	requestsBefore := e.client.RequestsSent()
+	waitedBefore := e.client.rateLimiter.Waited()
+	status := "aborted"
+	defer func() {
+		requests := e.client.RequestsSent() - requestsBefore
+		e.metrics.SetRequestsPerCollection(requests)
+		e.metrics.SetCollectionRateLimitWait(e.client.rateLimiter.Waited() - waitedBefore)
+		e.logCycleSummary(status, cycleStart, requests)
+	}()
+	e.resetCycleErrors()
+	e.client.updateQuotaMetric()
+	e.cycleCount++
 
 	// Get devices
 	start := time.Now()
@@ -287,15 +1719,24 @@ func (e *FlumeExporter) CollectMetrics() {
 	if err != nil {
 		log.Printf("Error getting devices: %v", err)
 		e.metrics.RecordScrapeMetrics("devices", duration, false)
+		e.metrics.RecordScrapeError("devices", err)
+		e.recordCycleError(err)
+		status = "failed"
 		return
 	}
 
 	e.metrics.RecordScrapeMetrics("devices", duration, true)
+	e.metrics.RecordScrapeError("devices", nil)
 	log.Printf("Found %d devices", len(devices))
+	if added, removed := e.setKnownDevices(devices); len(added) > 0 || len(removed) > 0 {
+		e.handleDeviceListChange(added, removed)
+	}
+	devices = e.disambiguateLocations(devices)
 
 	// Count devices that will be processed
-	processedCount := 0
-	if e.config.DeviceIDs != "" {
+	processedCount := len(devices)
+	if e.config.Load().DeviceIDs != "" {
+		processedCount = 0
 		for _, device := range devices {
 			if e.shouldProcessDevice(device.ID) {
 				processedCount++
@@ -303,9 +1744,28 @@ func (e *FlumeExporter) CollectMetrics() {
 		}
 		log.Printf("Device filtering active: %d of %d devices will be processed", processedCount, len(devices))
 	}
+	e.setDeviceCount(processedCount)
+
+	// With more than one sensor to query, batch the flow rate requests so the user ID is resolved once
+	var batchedFlowRates map[string]FlowRateResult
+	var sensorIDs []string
+	for _, device := range devices {
+		if device.Type != 1 && e.shouldProcessDevice(device.ID) && !e.skipOfflineDevice(device) && e.shouldRefreshFlowRate(device.ID) &&
+			e.config.Load().CollectsMetricFamily(device.ID, MetricFamilyFlowRate) {
+			sensorIDs = append(sensorIDs, device.ID)
+		}
+	}
+	if len(sensorIDs) > 1 {
+		batchedFlowRates = e.client.GetCurrentFlowRates(sensorIDs)
+	}
 
-	// Process each device
+	// Process each device; daily totals are collected for the usage devices afterwards
+	var usageDevices []Device
 	for _, device := range devices {
+		if e.collectionAborted(ctx) {
+			return
+		}
+
 		log.Printf("Processing device %s - Type: %d, Location: '%s'", device.ID, device.Type, device.Location.Name)
 
 		// Check if this device should be processed based on DeviceIDs configuration
@@ -315,90 +1775,669 @@ func (e *FlumeExporter) CollectMetrics() {
 		}
 
 		// Update device info
-		// Use device ID as device name if location name is empty, otherwise use location name
-		deviceName := device.Location.Name
-		if deviceName == "" {
-			deviceName = device.ID
-		}
-		e.metrics.UpdateDeviceInfo(device, deviceName)
+		// Device name label: the configured override, Flume device name, location name or device ID
+		deviceName := e.config.Load().DeviceName(device)
 
-		// Skip bridge devices (type 1) as they don't have sensor data
+		// Bridge devices (type 1) have no sensor data; only their info and connectivity are reported, when enabled
 		if device.Type == 1 {
+			if e.config.Load().IncludeBridgeMetrics {
+				e.metrics.UpdateDeviceInfo(device, deviceName)
+			}
 			log.Printf("Skipping bridge device %s", device.ID)
 			continue
 		}
+		e.metrics.UpdateDeviceInfo(device, deviceName)
+
+		if e.skipOfflineDevice(device) {
+			log.Printf("Skipping device %s (reported as disconnected)", device.ID)
+			continue
+		}
 
-		// Get current flow rate
-		start = time.Now()
-		flowRate, err := e.client.GetCurrentFlowRate(device.ID)
-		duration = time.Since(start)
+		e.metrics.SetDeviceRefreshInterval(device.ID, time.Duration(e.deviceRefreshCycles(device.ID))*e.config.Load().ScrapeInterval)
 
-		if err != nil {
-			log.Printf("Error getting flow rate for device %s: %v", device.ID, err)
-			e.metrics.RecordScrapeMetrics("flow_rate", duration, false)
+		if !e.config.Load().CollectsMetricFamily(device.ID, MetricFamilyFlowRate) {
+			log.Printf("Skipping flow rate for device %s (disabled by device metrics config)", device.ID)
+		} else if !e.shouldRefreshFlowRate(device.ID) {
+			log.Printf("Skipping flow rate for device %s this cycle (refreshed every %d cycles)", device.ID, e.deviceRefreshCycles(device.ID))
 		} else {
-			e.metrics.RecordScrapeMetrics("flow_rate", duration, true)
-			// Use device ID as device name if location name is empty, otherwise use location name
-			deviceName := device.Location.Name
-			if deviceName == "" {
-				deviceName = device.ID
+			// Get current flow rate, from the batch if one was made
+			var flowRate *FlowRateResponse
+			if result, ok := batchedFlowRates[device.ID]; ok {
+				flowRate, err, duration = result.FlowRate, result.Err, result.Duration
+			} else {
+				start = time.Now()
+				flowRate, err = e.client.GetCurrentFlowRate(device.ID)
+				duration = time.Since(start)
+			}
+
+			if err != nil {
+				log.Printf("Error getting flow rate for device %s: %v", device.ID, err)
+				e.metrics.RecordScrapeMetrics("flow_rate", duration, false)
+				e.metrics.RecordScrapeError("flow_rate", err)
+				e.recordCycleError(err)
+				e.recordCycleResult("flow_rate", false)
+				e.recordAccountValue(MetricFamilyFlowRate, device.ID, 0, false)
+			} else {
+				// An empty response means the API is up but has no reading; optionally report it as a failed scrape
+				if flowRate.NoData {
+					e.metrics.RecordEmptyResponse("flow_rate")
+				}
+				e.metrics.RecordScrapeMetrics("flow_rate", duration, !(flowRate.NoData && e.config.Load().EmptyResponseAsFailure))
+				e.metrics.RecordScrapeError("flow_rate", nil)
+				e.recordCycleResult("flow_rate", !(flowRate.NoData && e.config.Load().EmptyResponseAsFailure))
+				// Device name label: the configured override, Flume device name, location name or device ID
+				deviceName := e.config.Load().DeviceName(device)
+				e.updateDataAge(device, deviceName, flowRate, time.Now())
+				flowRate, age := e.applyFlowRateGrace(device.ID, flowRate, time.Now())
+				e.metrics.UpdateCurrentFlowRate(device.ID, deviceName, device.Location.Name, flowRate.Value)
+				e.recordAccountValue(MetricFamilyFlowRate, device.ID, flowRate.Value, true)
+				e.metrics.SetFlowRateAge(device.ID, deviceName, device.Location.Name, age)
+				e.metrics.UpdateSensorReadings(device.ID, deviceName, device.Location.Name, flowRate)
+				log.Printf("Flow rate for device %s: %.2f %s", device.ID, flowRate.Value, flowRate.Units)
 			}
-			e.metrics.UpdateCurrentFlowRate(device.ID, deviceName, device.Location.Name, flowRate.Value)
-			log.Printf("Flow rate for device %s: %.2f %s", device.ID, flowRate.Value, flowRate.Units)
 		}
 
-		// Check if we should collect daily total water usage (twice per day + on start)
-		if e.shouldCollectDailyTotalWaterUsage() {
-			log.Printf("Collecting daily total water usage for device %s (scheduled collection)", device.ID)
+		if e.collectionAborted(ctx) {
+			return
+		}
 
-			// Get daily total water usage for the last 30 days
-			now := time.Now()
-			thirtyDaysAgo := now.AddDate(0, 0, -30)
-			startOfThirtyDaysAgo := time.Date(thirtyDaysAgo.Year(), thirtyDaysAgo.Month(), thirtyDaysAgo.Day(), 0, 0, 0, 0, now.Location())
+		// Usage runs on its own ticker when a separate usage interval is configured
+		if e.config.Load().UsageInterval <= 0 {
+			if !e.collectUsage(ctx, device) {
+				return
+			}
+			usageDevices = append(usageDevices, device)
+		}
+	}
+	e.collectDailyTotals(ctx, usageDevices)
+	e.updateAccountTotals(devices)
 
-			start = time.Now()
-			dailyTotalUsage, err := e.client.QueryDailyTotalWaterUsage(device.ID, startOfThirtyDaysAgo, now)
-			duration = time.Since(start)
+	status = "ok"
+	log.Println("Metric collection completed")
+}
 
-			if err != nil {
-				log.Printf("Error getting daily total water usage for device %s: %v", device.ID, err)
-				e.metrics.RecordScrapeMetrics("daily_total_usage", duration, false)
-			} else {
-				e.metrics.RecordScrapeMetrics("daily_total_usage", duration, true)
-				// Use device ID as device name if location name is empty, otherwise use location name
-				deviceName := device.Location.Name
-				if deviceName == "" {
-					deviceName = device.ID
-				}
+// collectDailyTotals collects daily total water usage for all given devices when a scheduled
+// collection is due (on start and twice a day), querying the devices on the usage worker pool
+func (e *FlumeExporter) collectDailyTotals(ctx context.Context, devices []Device) {
+	var due []Device
+	var deviceIDs []string
+	for _, device := range devices {
+		if !e.config.Load().CollectsMetricFamily(device.ID, MetricFamilyDailyTotal) {
+			log.Printf("Skipping daily total water usage for device %s (disabled by device metrics config)", device.ID)
+			continue
+		}
+		due = append(due, device)
+		deviceIDs = append(deviceIDs, device.ID)
+	}
+	if len(due) == 0 || e.collectionAborted(ctx) {
+		return
+	}
+
+	// Usage queries are low priority: near the quota, keep the remaining requests for flow rate
+	if e.client.NearQuota() {
+		log.Printf("Deferring daily total water usage: about %d of %d hourly API requests left", e.client.QuotaRemaining(), e.config.Load().APIHourlyQuota)
+		return
+	}
+	if !e.shouldCollectDailyTotalWaterUsage() {
+		log.Printf("Skipping daily total water usage collection for %d device(s) (not scheduled)", len(due))
+		return
+	}
+	log.Printf("Collecting daily total water usage for %d device(s) (scheduled collection)", len(due))
+
+	// Devices not yet backfilled since startup fetch the initial backfill window, the rest the last 30 days
+	now := time.Now().In(e.config.Load().TimeLocation())
+	devicesByDays := make(map[int][]string)
+	for _, deviceID := range deviceIDs {
+		days := e.dailyTotalLookbackDays(deviceID)
+		devicesByDays[days] = append(devicesByDays[days], deviceID)
+	}
+
+	results := make(map[string]DailyTotalResult, len(deviceIDs))
+	windowStarts := make(map[string]time.Time, len(deviceIDs))
+	for days, ids := range devicesByDays {
+		since := now.AddDate(0, 0, -days)
+		startOfSince := time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, now.Location())
+		for deviceID, result := range e.client.QueryDailyTotalsForDevices(ids, startOfSince, now, e.config.Load().UsageQueryWorkers) {
+			results[deviceID] = result
+			windowStarts[deviceID] = startOfSince
+		}
+	}
+
+	for _, device := range due {
+		result := results[device.ID]
+		if result.Err != nil {
+			log.Printf("Error getting daily total water usage for device %s: %v", device.ID, result.Err)
+			e.metrics.RecordScrapeMetrics("daily_total_usage", result.Duration, false)
+			e.metrics.RecordScrapeError("daily_total_usage", result.Err)
+			e.recordCycleError(result.Err)
+			e.recordCycleResult("daily_total_usage", false)
+			continue
+		}
 
-				// Update daily total water usage metrics for each day
-				for _, data := range dailyTotalUsage.Data {
-					for _, dayData := range data.DailyTotalWaterUsage {
-						// Extract date from datetime (format: "2025-08-01 00:00:00")
-						date := dayData.DateTime[:10] // Get just the date part
-						e.metrics.UpdateDailyTotalWaterUsage(device.ID, deviceName, device.Location.Name, date, dayData.Value)
-					}
+		e.metrics.RecordScrapeMetrics("daily_total_usage", result.Duration, true)
+		e.recordCycleResult("daily_total_usage", true)
+		e.metrics.RecordScrapeError("daily_total_usage", nil)
+		// Device name label: the configured override, Flume device name, location name or device ID
+		deviceName := e.config.Load().DeviceName(device)
+
+		// Update daily total water usage metrics for each day
+		var days []time.Time
+		for _, data := range result.Usage.Data {
+			for _, dayData := range data.DailyTotalWaterUsage {
+				t, err := dayData.Time()
+				if err != nil {
+					log.Printf("Skipping daily total for device %s: %v", device.ID, err)
+					e.metrics.RecordMalformedDatetime("daily_total_usage")
+					continue
+				}
+				days = append(days, t)
+				date := t.Format("2006-01-02")
+				e.metrics.UpdateDailyTotalWaterUsage(device.ID, deviceName, device.Location.Name, date, dayData.Value)
+				if e.config.Load().EnableUsageCounter {
+					e.metrics.AddUsageFromDailyTotal(device.ID, deviceName, device.Location.Name, date, dayData.Value)
 				}
-				log.Printf("Updated daily total water usage for device %s with %d days of data", device.ID, len(dailyTotalUsage.Data))
 			}
-		} else {
-			log.Printf("Skipping daily total water usage collection for device %s (not scheduled)", device.ID)
 		}
+		log.Printf("Updated daily total water usage for device %s with %d days of data", device.ID, len(result.Usage.Data))
+		e.metrics.PruneDailyTotals(device.ID, windowStarts[device.ID].Format("2006-01-02"))
+		coverage := dailyTotalCoverage(days, windowStarts[device.ID])
+		e.metrics.UpdateDailyTotalCoverage(device.ID, deviceName, device.Location.Name, coverage)
+		if coverage.HistoryStartDays > 0 || coverage.GapDays > 0 {
+			log.Printf("Daily totals for device %s cover %d days: history starts %d days into the window, %d days missing in between",
+				device.ID, coverage.Retrieved, coverage.HistoryStartDays, coverage.GapDays)
+		}
+		e.markDailyTotalsBackfilled(device.ID, result.Usage)
 	}
+}
 
-	log.Println("Metric collection completed")
+// DailyTotalCoverage describes how many days of a daily total query returned data and why days are missing
+type DailyTotalCoverage struct {
+	Retrieved        int // distinct days with a reading
+	HistoryStartDays int // days between the start of the window and the first reading, e.g. for a new account
+	GapDays          int // days without a reading between the first and the last reading
+}
+
+// dailyTotalCoverage counts the distinct days among the readings and classifies the missing days of the
+// window starting at windowStart; days after the last reading (usually today) are not counted as missing
+func dailyTotalCoverage(days []time.Time, windowStart time.Time) DailyTotalCoverage {
+	// Compare calendar dates only, independent of time zones and DST
+	dateOf := func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	daysBetween := func(from, to time.Time) int {
+		return int(to.Sub(from) / (24 * time.Hour))
+	}
+
+	seen := make(map[time.Time]bool)
+	var first, last time.Time
+	for _, day := range days {
+		date := dateOf(day)
+		if seen[date] {
+			continue
+		}
+		seen[date] = true
+		if first.IsZero() || date.Before(first) {
+			first = date
+		}
+		if date.After(last) {
+			last = date
+		}
+	}
+
+	coverage := DailyTotalCoverage{Retrieved: len(seen)}
+	if len(seen) == 0 {
+		return coverage
+	}
+	if start := dateOf(windowStart); first.After(start) {
+		coverage.HistoryStartDays = daysBetween(start, first)
+	}
+	coverage.GapDays = daysBetween(first, last) + 1 - len(seen)
+	return coverage
+}
+
+// dailyTotalLookbackDays returns how many days of daily totals to query for a device: the initial
+// backfill window until the device has been backfilled once since startup, the last 30 days afterwards
+func (e *FlumeExporter) dailyTotalLookbackDays(deviceID string) int {
+	e.dailyCollectionMutex.Lock()
+	defer e.dailyCollectionMutex.Unlock()
+
+	if e.dailyTotalsBackfilled[deviceID] {
+		return dailyTotalLookbackDays
+	}
+	return e.config.Load().InitialBackfillDays
+}
+
+// markDailyTotalsBackfilled records a successful daily total query for a device, logging the days it
+// backfilled the first time; a failed backfill is retried with the full window on the next collection
+func (e *FlumeExporter) markDailyTotalsBackfilled(deviceID string, usage *DailyTotalWaterUsageResponse) {
+	e.dailyCollectionMutex.Lock()
+	defer e.dailyCollectionMutex.Unlock()
+
+	if e.dailyTotalsBackfilled[deviceID] {
+		return
+	}
+	days := 0
+	for _, data := range usage.Data {
+		days += len(data.DailyTotalWaterUsage)
+	}
+	log.Printf("Backfilled %d days of daily total water usage for device %s (initial backfill window %d days)", days, deviceID, e.config.Load().InitialBackfillDays)
+
+	if e.dailyTotalsBackfilled == nil {
+		e.dailyTotalsBackfilled = make(map[string]bool)
+	}
+	e.dailyTotalsBackfilled[deviceID] = true
+}
+
+// collectUsage collects the slow-moving per-device usage metrics (hourly and yearly usage) for a device
+// Daily totals are collected for all devices at once by collectDailyTotals
+// Returns false if the collection context was done and the cycle should stop
+func (e *FlumeExporter) collectUsage(ctx context.Context, device Device) bool {
+	// Usage queries are low priority: near the quota, keep the remaining requests for flow rate
+	if e.client.NearQuota() {
+		log.Printf("Deferring usage queries for device %s: about %d of %d hourly API requests left", device.ID, e.client.QuotaRemaining(), e.config.Load().APIHourlyQuota)
+		return true
+	}
+
+	if e.config.Load().CollectsMetricFamily(device.ID, MetricFamilyHourly) {
+		e.collectHourlyWaterUsage(device)
+		if e.collectionAborted(ctx) {
+			return false
+		}
+	}
+
+	if e.config.Load().CollectsMetricFamily(device.ID, MetricFamilyToday) {
+		e.collectTodayWaterUsage(device)
+		if e.collectionAborted(ctx) {
+			return false
+		}
+	}
+
+	if e.config.Load().CollectsMetricFamily(device.ID, MetricFamilyYearly) && e.shouldCollectYearlyWaterUsage(device.ID) {
+		e.collectYearlyWaterUsage(device)
+		if e.collectionAborted(ctx) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// skipOfflineDevice reports whether the device's queries are skipped because it is reported as disconnected
+func (e *FlumeExporter) skipOfflineDevice(device Device) bool {
+	return e.config.Load().SkipOfflineDevices && device.Offline()
+}
+
+// CollectUsageMetrics collects only the usage metrics for every processed sensor device
+// Used by the usage ticker when UsageInterval is configured
+func (e *FlumeExporter) CollectUsageMetrics(ctx context.Context) {
+	log.Println("Starting usage metric collection...")
+
+	devices, err := e.client.GetDevices()
+	if err != nil {
+		log.Printf("Error getting devices for usage collection: %v", err)
+		return
+	}
+	devices = e.disambiguateLocations(devices)
+
+	var usageDevices []Device
+	for _, device := range devices {
+		if e.collectionAborted(ctx) {
+			return
+		}
+		if !e.shouldProcessDevice(device.ID) || device.Type == 1 || e.skipOfflineDevice(device) {
+			continue
+		}
+		if !e.collectUsage(ctx, device) {
+			return
+		}
+		usageDevices = append(usageDevices, device)
+	}
+	e.collectDailyTotals(ctx, usageDevices)
+	e.updateAccountTotals(devices)
+
+	log.Println("Usage metric collection completed")
+}
+
+// collectHourlyWaterUsage collects water usage for the past hour in the HR bucket
+func (e *FlumeExporter) collectHourlyWaterUsage(device Device) {
+	now := time.Now().In(e.config.Load().TimeLocation())
+	since := now.Add(-1 * time.Hour)
+
+	start := time.Now()
+	usage, err := e.client.QueryWaterUsage(device.ID, "HR", 0, since, &now)
+	duration := time.Since(start)
+
+	if err != nil {
+		log.Printf("Error getting hourly water usage for device %s: %v", device.ID, err)
+		e.metrics.RecordScrapeMetrics("water_usage", duration, false)
+		e.metrics.RecordScrapeError("water_usage", err)
+		e.recordCycleError(err)
+		e.recordAccountValue(MetricFamilyHourly, device.ID, 0, false)
+		return
+	}
+
+	e.metrics.RecordScrapeMetrics("water_usage", duration, true)
+	e.metrics.RecordScrapeError("water_usage", nil)
+
+	// Device name label: the configured override, Flume device name, location name or device ID
+	deviceName := e.config.Load().DeviceName(device)
+	e.metrics.UpdateWaterUsage(device.ID, deviceName, device.Location.Name, usage)
+	e.recordAccountValue(MetricFamilyHourly, device.ID, totalUsage(usage), true)
+}
+
+// collectTodayWaterUsage collects the water used since local midnight, summing the HR buckets of today
+func (e *FlumeExporter) collectTodayWaterUsage(device Device) {
+	location := e.config.Load().TimeLocation()
+	now := time.Now().In(location)
+	midnight := startOfDay(now, location)
+
+	start := time.Now()
+	usage, err := e.client.QueryWaterUsage(device.ID, "HR", 0, midnight, &now)
+	duration := time.Since(start)
+
+	if err != nil {
+		log.Printf("Error getting today's water usage for device %s: %v", device.ID, err)
+		e.metrics.RecordScrapeMetrics("today_water_usage", duration, false)
+		e.metrics.RecordScrapeError("today_water_usage", err)
+		e.recordCycleError(err)
+		e.recordAccountValue(MetricFamilyToday, device.ID, 0, false)
+		return
+	}
+
+	e.metrics.RecordScrapeMetrics("today_water_usage", duration, true)
+	e.metrics.RecordScrapeError("today_water_usage", nil)
+
+	gallons, skipped := sumUsageSince(usage, midnight)
+	for range skipped {
+		e.metrics.RecordMalformedDatetime("today_water_usage")
+	}
+	deviceName := e.config.Load().DeviceName(device)
+	e.metrics.UpdateTodayWaterUsage(device.ID, deviceName, device.Location.Name, gallons)
+	e.recordAccountValue(MetricFamilyToday, device.ID, gallons, true)
+	e.metrics.UpdateDailyBudget(device.ID, deviceName, device.Location.Name, e.config.Load().DeviceBudgetGallons[device.ID], gallons)
+	log.Printf("Water usage today for device %s: %.2f gallons", device.ID, gallons)
+}
+
+// startOfDay returns midnight in loc of t's day there; time.Date resolves days that start at a DST change
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// sumUsageSince sums the readings at or after since, reading their datetimes in since's time zone
+// Readings from before since (e.g. a bucket Flume rounds down across midnight) are left out;
+// skipped counts readings with malformed datetimes
+func sumUsageSince(usage *QueryResponse, since time.Time) (total float64, skipped int) {
+	for _, data := range usage.Data {
+		for _, point := range data.Points() {
+			t, err := point.TimeIn(since.Location())
+			if err != nil {
+				skipped++
+				continue
+			}
+			if !t.Before(since) {
+				total += point.Value
+			}
+		}
+	}
+	return total, skipped
+}
+
+// yearlyHistoryYears is how many calendar years of usage, including the current one, are queried
+const yearlyHistoryYears = 5
+
+// shouldCollectYearlyWaterUsage reports whether yearly usage is due for a device (once per calendar day)
+// The attempt is recorded even if the query later fails, so errors do not cost extra requests
+func (e *FlumeExporter) shouldCollectYearlyWaterUsage(deviceID string) bool {
+	e.yearlyCollectionMutex.Lock()
+	defer e.yearlyCollectionMutex.Unlock()
+
+	now := time.Now().In(e.config.Load().TimeLocation())
+	if last, ok := e.lastYearlyCollection[deviceID]; ok && last.YearDay() == now.YearDay() && last.Year() == now.Year() {
+		return false
+	}
+
+	if e.lastYearlyCollection == nil {
+		e.lastYearlyCollection = make(map[string]time.Time)
+	}
+	e.lastYearlyCollection[deviceID] = now
+	return true
+}
+
+// collectYearlyWaterUsage collects usage totals per calendar year in the YR bucket
+func (e *FlumeExporter) collectYearlyWaterUsage(device Device) {
+	now := time.Now().In(e.config.Load().TimeLocation())
+	since := time.Date(now.Year()-yearlyHistoryYears+1, time.January, 1, 0, 0, 0, 0, now.Location())
+
+	start := time.Now()
+	usage, err := e.client.QueryWaterUsage(device.ID, "YR", 0, since, &now)
+	duration := time.Since(start)
+
+	if err != nil {
+		log.Printf("Error getting yearly water usage for device %s: %v", device.ID, err)
+		e.metrics.RecordScrapeMetrics("yearly_water_usage", duration, false)
+		e.metrics.RecordScrapeError("yearly_water_usage", err)
+		e.recordCycleError(err)
+		e.recordAccountValue(MetricFamilyYearly, device.ID, 0, false)
+		return
+	}
+
+	e.metrics.RecordScrapeMetrics("yearly_water_usage", duration, true)
+	e.metrics.RecordScrapeError("yearly_water_usage", nil)
+
+	deviceName := e.config.Load().DeviceName(device)
+	years := e.metrics.UpdateYearlyWaterUsage(device.ID, deviceName, device.Location.Name, usage)
+	e.recordAccountValue(MetricFamilyYearly, device.ID, currentYearUsage(usage, now), true)
+	log.Printf("Updated yearly water usage for device %s with %d years of data", device.ID, years)
+}
+
+// collectionAborted reports whether the collection context is done, logging and counting timeouts
+func (e *FlumeExporter) collectionAborted(ctx context.Context) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("Metric collection aborted: exceeded collection timeout of %s, keeping partial metrics", e.config.Load().CollectionTimeout)
+		e.metrics.RecordCollectionTimeout()
+	} else {
+		log.Printf("Metric collection aborted: %v", ctx.Err())
+	}
+	return true
+}
+
+// runCollection runs a full collection cycle
+func (e *FlumeExporter) runCollection() {
+	e.runCycle("metric", &e.collectionMutex, e.CollectMetrics)
+}
+
+// runUsageCollection runs a usage-only collection cycle for the separate usage ticker
+func (e *FlumeExporter) runUsageCollection() {
+	e.runCycle("usage", &e.usageMutex, e.CollectUsageMetrics)
+}
+
+// runCycle runs collect and afterwards pushes the metrics, writes the textfile, writes to InfluxDB and publishes
+// to MQTT, when configured
+// If the previous cycle guarded by the same mutex is still running the new one is skipped rather than queued
+func (e *FlumeExporter) runCycle(kind string, mutex *sync.Mutex, collect func(context.Context)) {
+	if !e.beginCollection() {
+		log.Println("Exporter is shutting down, not starting a new collection")
+		return
+	}
+	defer e.inFlight.Done()
+
+	if !mutex.TryLock() {
+		log.Printf("Warning: previous %s collection still running after %s, skipping this cycle", kind, e.cycleRunningFor(kind).Round(time.Second))
+		e.metrics.RecordSkippedCollection()
+		return
+	}
+	defer mutex.Unlock()
+
+	cycleStart := time.Now()
+	e.setCycleStart(kind, cycleStart)
+
+	e.metrics.SetActiveCollection(true)
+	defer e.metrics.SetActiveCollection(false)
+
+	ctx := e.baseCtx
+	if e.config.Load().CollectionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.config.Load().CollectionTimeout)
+		defer cancel()
+	}
+
+	collect(ctx)
+	e.metrics.RecordCycleDuration(kind, time.Since(cycleStart))
+	e.metrics.UpdateDataStaleness(time.Now())
+	e.metrics.PublishSnapshot()
+	e.updateRequestPacing()
+
+	if err := e.pusher.Push(); err != nil {
+		log.Printf("Error pushing metrics: %v", err)
+	}
+	if err := e.textfile.Write(); err != nil {
+		log.Printf("Error writing metrics textfile: %v", err)
+	}
+	if err := e.influx.Write(); err != nil {
+		log.Printf("Error writing metrics to InfluxDB: %v", err)
+	}
+	if err := e.mqtt.Publish(); err != nil {
+		log.Printf("Error publishing to MQTT: %v", err)
+	}
 }
 
 // StartPeriodicCollection starts periodic metric collection
+// When UsageInterval is set, usage queries run on their own ticker and interval only drives flow rate
 func (e *FlumeExporter) StartPeriodicCollection(interval time.Duration) {
 	// Initial collection (authentication will happen automatically on first API call)
-	e.CollectMetrics()
+	e.runCollection()
+	flowTicker := e.startTicker(interval, e.runCollection)
+
+	var usageTicker *time.Ticker
+	if e.config.Load().UsageInterval > 0 {
+		log.Printf("Collecting usage metrics separately every %s", e.config.Load().UsageInterval)
+		e.runUsageCollection()
+		usageTicker = e.startTicker(e.config.Load().UsageInterval, e.runUsageCollection)
+	}
+
+	e.tickerMutex.Lock()
+	e.flowTicker = flowTicker
+	e.usageTicker = usageTicker
+	e.tickerMutex.Unlock()
+}
+
+// updateRequestPacing spaces API requests evenly across the hour when request spreading is enabled
+// The spacing is the hour divided by the worst-case requests per hour for the current device count,
+// so a cycle's requests are spread over the scrape interval instead of sent back-to-back
+func (e *FlumeExporter) updateRequestPacing() {
+	if !e.config.Load().SpreadRequests {
+		return
+	}
+	count, ok := e.DeviceCount()
+	if !ok {
+		return
+	}
+
+	estimate := e.config.Load().EstimateQuota(count)
+	pace := e.config.Load().APIMinInterval
+	if estimate.Demand > 0 {
+		pace = max(pace, time.Duration(float64(time.Hour)/estimate.Demand).Round(time.Second))
+	}
+
+	e.lifecycleMutex.Lock()
+	changed := pace != e.requestPace
+	e.requestPace = pace
+	e.lifecycleMutex.Unlock()
+	if changed {
+		log.Printf("Spreading %.0f expected API requests per hour: one request every %s", estimate.Demand, pace)
+		e.client.SetRequestPacing(pace)
+	}
+}
 
-	// Start periodic collection
+// startTicker calls run every interval until the exporter is stopped
+// Each tick runs on its own goroutine so a tick that arrives while the previous cycle is still
+// running reaches the overlap guard in runCycle and is counted, instead of being silently dropped
+// The returned ticker may be Reset or Stopped to change or pause the schedule
+func (e *FlumeExporter) startTicker(interval time.Duration, run func()) *time.Ticker {
 	ticker := time.NewTicker(interval)
 	go func() {
-		for range ticker.C {
-			e.CollectMetrics()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				go run()
+			case <-e.stopCh:
+				return
+			}
 		}
 	}()
+	return ticker
+}
+
+// setCycleStart records when the running cycle of the given kind started
+func (e *FlumeExporter) setCycleStart(kind string, start time.Time) {
+	e.lifecycleMutex.Lock()
+	defer e.lifecycleMutex.Unlock()
+
+	if e.cycleStarts == nil {
+		e.cycleStarts = make(map[string]time.Time)
+	}
+	e.cycleStarts[kind] = start
+}
+
+// cycleRunningFor returns how long the running cycle of the given kind has taken so far
+func (e *FlumeExporter) cycleRunningFor(kind string) time.Duration {
+	e.lifecycleMutex.Lock()
+	defer e.lifecycleMutex.Unlock()
+
+	return time.Since(e.cycleStarts[kind])
+}
+
+// beginCollection registers an in-flight collection unless the exporter is stopping
+func (e *FlumeExporter) beginCollection() bool {
+	e.lifecycleMutex.Lock()
+	defer e.lifecycleMutex.Unlock()
+
+	if e.stopped {
+		return false
+	}
+	e.inFlight.Add(1)
+	return true
+}
+
+// Stop prevents new collections, stops the tickers and waits for an in-progress one to finish
+// If ctx expires first, the running collection is cancelled between API calls
+func (e *FlumeExporter) Stop(ctx context.Context) {
+	e.lifecycleMutex.Lock()
+	if !e.stopped {
+		e.stopped = true
+		close(e.stopCh)
+	}
+	e.lifecycleMutex.Unlock()
+
+	e.tickerMutex.Lock()
+	if e.flowTicker != nil {
+		e.flowTicker.Stop()
+	}
+	if e.usageTicker != nil {
+		e.usageTicker.Stop()
+	}
+	e.tickerMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		e.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Println("No collection in progress, or it finished before shutdown")
+	case <-ctx.Done():
+		log.Println("Shutdown budget exhausted, cancelling in-progress collection")
+		e.cancelBase()
+		<-done
+		log.Println("In-progress collection cancelled")
+	}
+	e.cancelBase()
 }
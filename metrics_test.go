@@ -0,0 +1,626 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestMetrics creates metrics registered with a fresh registry
+func newTestMetrics() *Metrics {
+	return NewMetricsWithRegisterer(prometheus.NewRegistry())
+}
+
+func TestUpdateSensorReadings(t *testing.T) {
+	m := newTestMetrics()
+
+	m.UpdateSensorReadings("d1", "Home", "Home", &FlowRateResponse{Active: true})
+	if n := testutil.CollectAndCount(m.waterPressure); n != 0 {
+		t.Errorf("pressure series without a reading = %d, want 0", n)
+	}
+	if v := testutil.ToFloat64(m.flowActive.WithLabelValues("d1", "Home", "Home")); v != 1 {
+		t.Errorf("flume_flow_active = %v, want 1", v)
+	}
+
+	m.UpdateSensorReadings("d1", "Home", "Home", &FlowRateResponse{PressurePSI: ptr(62.5)})
+	if v := testutil.ToFloat64(m.waterPressure.WithLabelValues("d1", "Home", "Home")); v != 62.5 {
+		t.Errorf("flume_water_pressure_psi = %v, want 62.5", v)
+	}
+	if v := testutil.ToFloat64(m.flowActive.WithLabelValues("d1", "Home", "Home")); v != 0 {
+		t.Errorf("flume_flow_active = %v, want 0", v)
+	}
+}
+
+// newTestExporter creates an exporter whose client answers requests from handler
+func newTestExporter(t *testing.T, config *Config, handler func(req *http.Request) stubResponse) (*FlumeExporter, *stubDoer) {
+	t.Helper()
+
+	client, doer := newTestClient(t, config, handler)
+	return NewFlumeExporter(client, config, client.metrics), doer
+}
+
+// testQueryBody answers any usage query, including daily totals, with a single reading of 1 gallon
+const testQueryBody = `{"success":true,"data":[{"water_usage":[["2026-01-01 00:00:00",1]],"daily_total_water_usage":[["2026-01-01 00:00:00",1]]}],"count":1}`
+
+// testAPI answers the requests of a collection cycle: the device list devicesBody, the user ID 123,
+// an active flow of 1.5 gpm for every device and testQueryBody for every usage query
+func testAPI(t *testing.T, devicesBody string) func(req *http.Request) stubResponse {
+	t.Helper()
+
+	activeBody := readTestdata(t, "active_basic.json")
+	return func(req *http.Request) stubResponse {
+		switch path := req.URL.Path; {
+		case path == "/me":
+			return stubResponse{status: http.StatusOK, body: testMeBody}
+		case path == "/me/devices":
+			return stubResponse{status: http.StatusOK, body: devicesBody}
+		case strings.HasSuffix(path, "/query/active"):
+			return stubResponse{status: http.StatusOK, body: activeBody}
+		case strings.HasSuffix(path, "/query"):
+			return stubResponse{status: http.StatusOK, body: testQueryBody}
+		}
+		return stubResponse{status: http.StatusNotFound, body: `{"success":false}`}
+	}
+}
+
+const testOneDeviceBody = `{"count":1,"data":[{"id":"d1","type":2,"location":{"name":"Home"}}]}`
+
+func TestRunCycleSkipsOverlappingCycles(t *testing.T) {
+	e, _ := newTestExporter(t, newTestConfig(t), stubRoutes(nil))
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.runCycle("metric", &e.collectionMutex, func(ctx context.Context) {
+			close(started)
+			<-release
+		})
+	}()
+	<-started
+
+	// A tick while the slow cycle runs is skipped and counted
+	ran := false
+	e.runCycle("metric", &e.collectionMutex, func(ctx context.Context) { ran = true })
+	if ran {
+		t.Error("overlapping metric cycle ran")
+	}
+	if v := testutil.ToFloat64(e.metrics.skippedCollections); v != 1 {
+		t.Errorf("flume_exporter_collections_skipped_total = %v, want 1", v)
+	}
+
+	// Usage cycles have their own guard
+	e.runCycle("usage", &e.usageMutex, func(ctx context.Context) { ran = true })
+	if !ran {
+		t.Error("usage cycle was skipped while a metric cycle ran")
+	}
+
+	close(release)
+	<-done
+
+	// Once the slow cycle finished the next tick runs again
+	ran = false
+	e.runCycle("metric", &e.collectionMutex, func(ctx context.Context) { ran = true })
+	if !ran {
+		t.Error("metric cycle after the slow one finished was skipped")
+	}
+	if v := testutil.ToFloat64(e.metrics.skippedCollections); v != 1 {
+		t.Errorf("flume_exporter_collections_skipped_total = %v, want 1", v)
+	}
+}
+
+func TestAddUsageFromDailyTotal(t *testing.T) {
+	m := newTestMetrics()
+	counter := m.waterUsageTotal.WithLabelValues("d1", "Home", "Home")
+	add := func(date string, usage float64) {
+		m.AddUsageFromDailyTotal("d1", "Home", "Home", date, usage)
+	}
+
+	// The first value is only a baseline
+	add("2026-01-01", 100)
+	if v := testutil.ToFloat64(counter); v != 0 {
+		t.Fatalf("counter after the baseline = %v, want 0", v)
+	}
+
+	// Growth of the same day is added
+	add("2026-01-01", 130)
+	if v := testutil.ToFloat64(counter); v != 30 {
+		t.Fatalf("counter after same-day growth = %v, want 30", v)
+	}
+
+	// After midnight the daily total restarts, so the whole new value is added
+	add("2026-01-02", 20)
+	if v := testutil.ToFloat64(counter); v != 50 {
+		t.Fatalf("counter after midnight = %v, want 50", v)
+	}
+
+	// A revised-down total and an older day never decrease the counter
+	add("2026-01-02", 15)
+	add("2026-01-01", 500)
+	if v := testutil.ToFloat64(counter); v != 50 {
+		t.Fatalf("counter after a decrease = %v, want 50", v)
+	}
+	add("2026-01-02", 25)
+	if v := testutil.ToFloat64(counter); v != 60 {
+		t.Fatalf("counter after growth past the decrease = %v, want 60", v)
+	}
+}
+
+func TestAddUsageFromDailyTotalAfterRestart(t *testing.T) {
+	before := newTestMetrics()
+	before.AddUsageFromDailyTotal("d1", "Home", "Home", "2026-01-01", 100)
+	before.AddUsageFromDailyTotal("d1", "Home", "Home", "2026-01-01", 150)
+
+	// A restarted exporter starts its counter from 0 again and publishes a new start time
+	after := newTestMetrics()
+	after.AddUsageFromDailyTotal("d1", "Home", "Home", "2026-01-01", 160)
+	if v := testutil.ToFloat64(after.waterUsageTotal.WithLabelValues("d1", "Home", "Home")); v != 0 {
+		t.Errorf("counter after a restart = %v, want 0", v)
+	}
+	if v := testutil.ToFloat64(after.startTime); v <= 0 {
+		t.Errorf("flume_exporter_start_time_seconds = %v, want the start time", v)
+	}
+}
+
+func TestUpdateWaterUsageSumsEachBucket(t *testing.T) {
+	var resp QueryResponse
+	if err := json.Unmarshal([]byte(readTestdata(t, "query_mixed.json")), &resp); err != nil {
+		t.Fatalf("decoding query_mixed.json: %v", err)
+	}
+
+	m := newTestMetrics()
+	m.UpdateWaterUsage("d1", "Home", "Home", &resp)
+	if v := testutil.ToFloat64(m.bucketUsage["HR"].WithLabelValues("d1", "Home", "Home")); v != 5 {
+		t.Errorf("flume_hourly_water_usage_gallons = %v, want 5", v)
+	}
+
+	// Buckets reported per period are written elsewhere, one series per period
+	if n := testutil.CollectAndCount(m.bucketUsage["DAY"]); n != 0 {
+		t.Errorf("daily usage series = %d, want 0", n)
+	}
+}
+
+func TestSeparateUsageCollection(t *testing.T) {
+	config := newTestConfig(t)
+	config.UsageInterval = time.Hour
+	e, doer := newTestExporter(t, config, testAPI(t, testOneDeviceBody))
+
+	// With a usage interval the flow cycle leaves the usage queries to the usage cycle
+	e.CollectMetrics(context.Background())
+	if n := doer.calls("/users/123/devices/d1/query/active"); n != 1 {
+		t.Errorf("flow cycle sent %d flow rate queries, want 1", n)
+	}
+	if n := doer.calls("/me/devices/d1/query"); n != 0 {
+		t.Errorf("flow cycle sent %d usage queries, want 0", n)
+	}
+
+	e.CollectUsageMetrics(context.Background())
+	if n := doer.calls("/users/123/devices/d1/query/active"); n != 1 {
+		t.Errorf("usage cycle sent %d more flow rate queries, want 0", n-1)
+	}
+	if n := doer.calls("/me/devices/d1/query"); n == 0 {
+		t.Error("usage cycle sent no usage queries")
+	}
+}
+
+func TestDualTickerScheduling(t *testing.T) {
+	config := newTestConfig(t)
+	config.UsageInterval = 250 * time.Millisecond
+	config.DeviceMetricFamilies = map[string]map[string]bool{"d1": {MetricFamilyFlowRate: true, MetricFamilyHourly: true}}
+	e, doer := newTestExporter(t, config, testAPI(t, testOneDeviceBody))
+
+	e.StartPeriodicCollection(25 * time.Millisecond)
+	time.Sleep(600 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	e.Stop(ctx)
+
+	// The fast ticker queries flow rate many times per usage query
+	flow := doer.calls("/users/123/devices/d1/query/active")
+	usage := doer.calls("/me/devices/d1/query")
+	if usage < 2 || usage > 4 {
+		t.Errorf("usage ticker sent %d hourly queries in 600ms at a 250ms interval, want 2-4", usage)
+	}
+	if flow < 3*usage {
+		t.Errorf("flow ticker sent %d flow rate queries against %d usage queries, want many more", flow, usage)
+	}
+}
+
+func TestDeviceInfoProductLabel(t *testing.T) {
+	client, _ := newTestClient(t, newTestConfig(t), stubRoutes(map[string]string{
+		"/me/devices": readTestdata(t, "devices_product.json"),
+	}))
+	devices, err := client.GetDevices()
+	if err != nil {
+		t.Fatalf("GetDevices: %v", err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("got %d devices, want 2", len(devices))
+	}
+
+	m := newTestMetrics()
+	for _, device := range devices {
+		m.UpdateDeviceInfo(device, device.Location.Name)
+	}
+
+	// A device without a product reports an empty label rather than being left out
+	for _, labels := range [][]string{
+		{"d1", "Home", "Home", "sensor", "2.1.0", "flume2", "false"},
+		{"d2", "Cabin", "Cabin", "sensor", "", "", "false"},
+	} {
+		if got := testutil.ToFloat64(m.deviceInfo.WithLabelValues(labels...)); got != 1 {
+			t.Errorf("flume_device_info%v = %v, want 1", labels, got)
+		}
+	}
+	if n := testutil.CollectAndCount(m.deviceInfo); n != 2 {
+		t.Errorf("flume_device_info has %d series, want 2", n)
+	}
+}
+
+func TestCollectYearlyWaterUsageNewAccount(t *testing.T) {
+	// An account installed this year has a single YR reading
+	year := time.Now().Year()
+	body := fmt.Sprintf(`{"success":true,"data":[{"water_usage":[["%d-01-01 00:00:00",1234.5]]}],"count":1}`, year)
+
+	var queries []Query
+	var mutex sync.Mutex
+	e, _ := newTestExporter(t, newTestConfig(t), func(req *http.Request) stubResponse {
+		var request QueryRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			t.Errorf("decoding query request: %v", err)
+		}
+		mutex.Lock()
+		queries = append(queries, request.Queries...)
+		mutex.Unlock()
+		return stubResponse{status: http.StatusOK, body: body}
+	})
+	device := Device{ID: "d1", Type: 2}
+	device.Location.Name = "Home"
+
+	e.collectYearlyWaterUsage(device)
+
+	if len(queries) != 1 || queries[0].Bucket != "YR" {
+		t.Fatalf("queries = %+v, want a single YR query", queries)
+	}
+	wantSince := fmt.Sprintf("%d-01-01 00:00:00", year-yearlyHistoryYears+1)
+	if queries[0].SinceDatetime != wantSince {
+		t.Errorf("since_datetime = %s, want %s", queries[0].SinceDatetime, wantSince)
+	}
+
+	yearly := e.metrics.bucketUsage["YR"]
+	if n := testutil.CollectAndCount(yearly); n != 1 {
+		t.Errorf("flume_yearly_water_usage_gallons has %d series, want only the current year", n)
+	}
+	if got := testutil.ToFloat64(yearly.WithLabelValues("d1", "Home", "Home", strconv.Itoa(year))); got != 1234.5 {
+		t.Errorf("usage for %d = %v, want 1234.5", year, got)
+	}
+	if got := e.accountValues[MetricFamilyYearly]["d1"]; got.failed || got.value != 1234.5 {
+		t.Errorf("account value = %+v, want 1234.5", got)
+	}
+}
+
+func TestMalformedDatetimeSkipped(t *testing.T) {
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	body := fmt.Sprintf(`{"success":true,"data":[{"daily_total_water_usage":[["%s 00:00:00",42],["yesterday",7],["",3]]}],"count":1}`, yesterday)
+	e, _ := newTestExporter(t, newTestConfig(t), stubRoutes(map[string]string{"/me/devices/d1/query": body}))
+	device := Device{ID: "d1", Type: 2}
+	device.Location.Name = "Home"
+
+	e.collectDailyTotals(context.Background(), []Device{device})
+
+	if n := testutil.CollectAndCount(e.metrics.bucketUsage["DAY"]); n != 1 {
+		t.Errorf("daily total series = %d, want only %s", n, yesterday)
+	}
+	if got := testutil.ToFloat64(e.metrics.bucketUsage["DAY"].WithLabelValues("d1", "Home", "Home", yesterday)); got != 42 {
+		t.Errorf("daily total for %s = %v, want 42", yesterday, got)
+	}
+	if got := testutil.ToFloat64(e.metrics.malformedDatetimes.WithLabelValues("daily_total_usage")); got != 2 {
+		t.Errorf("flume_exporter_malformed_datetime_total{endpoint=\"daily_total_usage\"} = %v, want 2", got)
+	}
+
+	// Yearly readings are skipped and counted the same way
+	var yearly QueryResponse
+	if err := json.Unmarshal([]byte(`{"data":[{"water_usage":[["2025-01-01 00:00:00",1],["2025",2]]}]}`), &yearly); err != nil {
+		t.Fatal(err)
+	}
+	if years := e.metrics.UpdateYearlyWaterUsage("d1", "Home", "Home", &yearly); years != 1 {
+		t.Errorf("UpdateYearlyWaterUsage updated %d years, want 1", years)
+	}
+	if got := testutil.ToFloat64(e.metrics.malformedDatetimes.WithLabelValues("yearly_water_usage")); got != 1 {
+		t.Errorf("flume_exporter_malformed_datetime_total{endpoint=\"yearly_water_usage\"} = %v, want 1", got)
+	}
+}
+
+func TestUsageDeferredNearQuota(t *testing.T) {
+	tests := []struct {
+		name        string
+		earlier     int // requests already sent in the trailing hour
+		wantUsage   bool
+		wantMinLeft int
+	}{
+		{"plenty left", 0, true, 3},
+		{"near the quota", 6, false, 0},
+	}
+	for _, tt := range tests {
+		config := newTestConfig(t)
+		config.APIHourlyQuota = 10
+		config.DeviceMetricFamilies = map[string]map[string]bool{"d1": {MetricFamilyFlowRate: true, MetricFamilyHourly: true}}
+		e, doer := newTestExporter(t, config, testAPI(t, testOneDeviceBody))
+		for i := 0; i < tt.earlier; i++ {
+			e.client.requestTimes = append(e.client.requestTimes, time.Now())
+		}
+
+		e.CollectMetrics(context.Background())
+
+		// Flow rate is always queried; usage only while enough of the quota is left
+		if n := doer.calls("/users/123/devices/d1/query/active"); n != 1 {
+			t.Errorf("%s: sent %d flow rate queries, want 1", tt.name, n)
+		}
+		if usage := doer.calls("/me/devices/d1/query") > 0; usage != tt.wantUsage {
+			t.Errorf("%s: usage queried = %v, want %v", tt.name, usage, tt.wantUsage)
+		}
+		remaining := e.client.QuotaRemaining()
+		if remaining < tt.wantMinLeft {
+			t.Errorf("%s: %d requests left, want at least %d", tt.name, remaining, tt.wantMinLeft)
+		}
+		if got := testutil.ToFloat64(e.metrics.quotaRemaining); int(got) != remaining {
+			t.Errorf("%s: flume_exporter_quota_remaining_estimate = %v, want %d", tt.name, got, remaining)
+		}
+	}
+}
+
+func TestApplyFlowRateGrace(t *testing.T) {
+	config := newTestConfig(t)
+	config.FlowRateGracePeriod = 2 * time.Minute
+	e, _ := newTestExporter(t, config, stubRoutes(nil))
+	start := time.Date(2026, time.January, 1, 12, 0, 0, 0, time.UTC)
+	noData := &FlowRateResponse{NoData: true}
+
+	// A missing reading right after water was flowing keeps the last value
+	steps := []struct {
+		name    string
+		reading *FlowRateResponse
+		after   time.Duration
+		want    float64
+		wantAge time.Duration
+	}{
+		{"flowing", &FlowRateResponse{Value: 2.5}, 0, 2.5, 0},
+		{"gap within grace", noData, time.Minute, 2.5, time.Minute},
+		{"gap at grace", noData, 2 * time.Minute, 2.5, 2 * time.Minute},
+		{"gap past grace", noData, 3 * time.Minute, 0, 0},
+		{"still no data", noData, 4 * time.Minute, 0, 0},
+		{"flowing again", &FlowRateResponse{Value: 1}, 5 * time.Minute, 1, 0},
+		{"stopped", &FlowRateResponse{Value: 0}, 6 * time.Minute, 0, 0},
+		{"gap after stopping", noData, 7 * time.Minute, 0, 0},
+	}
+	for _, step := range steps {
+		got, age := e.applyFlowRateGrace("d1", step.reading, start.Add(step.after))
+		if got.Value != step.want || age != step.wantAge {
+			t.Errorf("%s: flow rate = %v aged %s, want %v aged %s", step.name, got.Value, age, step.want, step.wantAge)
+		}
+	}
+}
+
+func TestExtraLabelsOnMetrics(t *testing.T) {
+	labels, err := parseExtraLabels("site=home,env=prod")
+	if err != nil {
+		t.Fatalf("parseExtraLabels: %v", err)
+	}
+	registry := prometheus.NewRegistry()
+	// Registered the way main does, so a clash with a metric's own labels would panic here
+	m := NewMetricsWithRegisterer(prometheus.WrapRegistererWith(labels, registry))
+	device := Device{ID: "d1", Type: 2}
+	device.Location.Name = "Home"
+	m.UpdateDeviceInfo(device, "Home")
+	m.UpdateCurrentFlowRate("d1", "Home", "Home", 1.5)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	if len(families) == 0 {
+		t.Fatal("no metrics gathered")
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			got := make(map[string]string)
+			for _, pair := range metric.GetLabel() {
+				got[pair.GetName()] = pair.GetValue()
+			}
+			if got["site"] != "home" || got["env"] != "prod" {
+				t.Errorf("%s has labels %v, want site=home and env=prod", family.GetName(), got)
+			}
+		}
+	}
+}
+
+func TestDailyTotalLookbackAfterBackfill(t *testing.T) {
+	config := newTestConfig(t)
+	config.InitialBackfillDays = 90
+
+	var mutex sync.Mutex
+	since := make(map[string][]string)
+	failD2 := true
+	e, _ := newTestExporter(t, config, func(req *http.Request) stubResponse {
+		var request QueryRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			t.Errorf("decoding query request: %v", err)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		since[req.URL.Path] = append(since[req.URL.Path], request.Queries[0].SinceDatetime)
+		if req.URL.Path == "/me/devices/d2/query" && failD2 {
+			failD2 = false
+			return stubResponse{status: http.StatusInternalServerError, body: `{"success":false}`}
+		}
+		return stubResponse{status: http.StatusOK, body: testQueryBody}
+	})
+	devices := []Device{{ID: "d1", Type: 2}, {ID: "d2", Type: 2}}
+
+	// d2's failed backfill is retried with the full window; d1 moves on to the regular lookback
+	for cycle := 0; cycle < 3; cycle++ {
+		e.lastDailyTotalCollection = time.Time{}
+		e.collectDailyTotals(context.Background(), devices)
+	}
+
+	daysAgo := func(days int) string {
+		now := time.Now()
+		day := now.AddDate(0, 0, -days)
+		return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, now.Location()).Format("2006-01-02 15:04:05")
+	}
+	want := map[string][]string{
+		"/me/devices/d1/query": {daysAgo(90), daysAgo(dailyTotalLookbackDays), daysAgo(dailyTotalLookbackDays)},
+		"/me/devices/d2/query": {daysAgo(90), daysAgo(90), daysAgo(dailyTotalLookbackDays)},
+	}
+	for path, wantSince := range want {
+		if got := strings.Join(since[path], ", "); got != strings.Join(wantSince, ", ") {
+			t.Errorf("%s queried since %s, want %s", path, got, strings.Join(wantSince, ", "))
+		}
+	}
+}
+
+// loadTestLocation loads the named time zone, skipping the test when it is not available
+func loadTestLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s not available: %v", name, err)
+	}
+	return location
+}
+
+func TestStartOfDay(t *testing.T) {
+	newYork := loadTestLocation(t, "America/New_York")
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want time.Time
+	}{
+		{"afternoon", time.Date(2026, time.January, 2, 15, 0, 0, 0, newYork), time.Date(2026, time.January, 2, 0, 0, 0, 0, newYork)},
+		{"just after midnight", time.Date(2026, time.January, 2, 0, 0, 1, 0, newYork), time.Date(2026, time.January, 2, 0, 0, 0, 0, newYork)},
+		{"just before midnight", time.Date(2026, time.January, 1, 23, 59, 59, 0, newYork), time.Date(2026, time.January, 1, 0, 0, 0, 0, newYork)},
+		// Already the next day in UTC, still the evening before in New York
+		{"UTC after midnight", time.Date(2026, time.January, 2, 3, 0, 0, 0, time.UTC), time.Date(2026, time.January, 1, 0, 0, 0, 0, newYork)},
+		{"DST change", time.Date(2026, time.March, 8, 12, 0, 0, 0, newYork), time.Date(2026, time.March, 8, 0, 0, 0, 0, newYork)},
+	}
+	for _, tt := range tests {
+		if got := startOfDay(tt.at, newYork); !got.Equal(tt.want) || got.Location() != newYork {
+			t.Errorf("%s: startOfDay(%s) = %s, want %s", tt.name, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestSumUsageSinceMidnight(t *testing.T) {
+	newYork := loadTestLocation(t, "America/New_York")
+	midnight := time.Date(2026, time.January, 2, 0, 0, 0, 0, newYork)
+
+	// Readings are in the account's time zone: only those from midnight on count towards today
+	var usage QueryResponse
+	body := `{"data":[{"water_usage":[["2026-01-01 23:00:00",5],["2026-01-02 00:00:00",1],["2026-01-02 01:00:00",2],["01/02/2026",4]]}]}`
+	if err := json.Unmarshal([]byte(body), &usage); err != nil {
+		t.Fatal(err)
+	}
+	total, skipped := sumUsageSince(&usage, midnight)
+	if total != 3 || skipped != 1 {
+		t.Errorf("sumUsageSince = %v with %d skipped, want 3 with 1 skipped", total, skipped)
+	}
+}
+
+func TestCollectTodayWaterUsageQueriesSinceMidnight(t *testing.T) {
+	tokyo := loadTestLocation(t, "Asia/Tokyo")
+	config := newTestConfig(t)
+	config.Location = tokyo
+
+	var query Query
+	e, _ := newTestExporter(t, config, func(req *http.Request) stubResponse {
+		var request QueryRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			t.Errorf("decoding query request: %v", err)
+		}
+		query = request.Queries[0]
+		return stubResponse{status: http.StatusOK, body: testQueryBody}
+	})
+	device := Device{ID: "d1", Type: 2}
+	device.Location.Name = "Home"
+
+	e.collectTodayWaterUsage(device)
+
+	wantSince := time.Now().In(tokyo).Format("2006-01-02") + " 00:00:00"
+	if query.Bucket != "HR" || query.SinceDatetime != wantSince || query.UntilDatetime == "" {
+		t.Errorf("query = %+v, want HR buckets since %s until now", query, wantSince)
+	}
+}
+
+func TestDailyTotalCoverage(t *testing.T) {
+	windowStart := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	day := func(d int) time.Time {
+		return windowStart.AddDate(0, 0, d).Add(6 * time.Hour)
+	}
+	tests := []struct {
+		name string
+		days []time.Time
+		want DailyTotalCoverage
+	}{
+		{"no data", nil, DailyTotalCoverage{}},
+		{"full window", []time.Time{day(0), day(1), day(2)}, DailyTotalCoverage{Retrieved: 3}},
+		{"duplicate readings", []time.Time{day(0), day(0).Add(time.Hour), day(1)}, DailyTotalCoverage{Retrieved: 2}},
+		// A new account's history starts part way into the window
+		{"new account", []time.Time{day(10), day(11), day(12)}, DailyTotalCoverage{Retrieved: 3, HistoryStartDays: 10}},
+		{"gaps", []time.Time{day(0), day(3), day(5)}, DailyTotalCoverage{Retrieved: 3, GapDays: 3}},
+		{"new account with a gap", []time.Time{day(12), day(4), day(6)}, DailyTotalCoverage{Retrieved: 3, HistoryStartDays: 4, GapDays: 6}},
+	}
+	for _, tt := range tests {
+		if got := dailyTotalCoverage(tt.days, windowStart); got != tt.want {
+			t.Errorf("%s: dailyTotalCoverage = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSkipOfflineDevices(t *testing.T) {
+	devicesBody := `{"count":2,"data":[{"id":"d1","type":2,"connected":true,"location":{"name":"Home"}},{"id":"d2","type":2,"connected":false,"location":{"name":"Cabin"}}]}`
+	for _, skip := range []bool{false, true} {
+		config := newTestConfig(t)
+		config.SkipOfflineDevices = skip
+		e, doer := newTestExporter(t, config, testAPI(t, devicesBody))
+
+		e.CollectMetrics(context.Background())
+
+		// The offline device is only queried when offline devices are not skipped
+		wantOffline := 1
+		if skip {
+			wantOffline = 0
+		}
+		if n := doer.calls("/users/123/devices/d1/query/active"); n != 1 {
+			t.Errorf("skip %v: online device queried %d times, want 1", skip, n)
+		}
+		if n := doer.calls("/users/123/devices/d2/query/active"); n != wantOffline {
+			t.Errorf("skip %v: offline device's flow rate queried %d times, want %d", skip, n, wantOffline)
+		}
+		if skip && doer.calls("/me/devices/d2/query") != 0 {
+			t.Errorf("skip %v: offline device's usage queried", skip)
+		}
+
+		// Connectivity is reported either way
+		if n := testutil.CollectAndCount(e.metrics.deviceConnected); n != 2 {
+			t.Errorf("skip %v: flume_device_connected has %d series, want 2", skip, n)
+		}
+		if got := testutil.ToFloat64(e.metrics.deviceConnected.WithLabelValues("d1", "Home", "Home")); got != 1 {
+			t.Errorf("skip %v: d1 connected = %v, want 1", skip, got)
+		}
+		if got := testutil.ToFloat64(e.metrics.deviceConnected.WithLabelValues("d2", "Cabin", "Cabin")); got != 0 {
+			t.Errorf("skip %v: d2 connected = %v, want 0", skip, got)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MQTT payload formats
+const (
+	MQTTFormatJSON  = "json"  // {"value": 1.5}
+	MQTTFormatPlain = "plain" // 1.5
+)
+
+// mqttSensor maps a device metric to the topic suffix and Home Assistant sensor it is published as
+type mqttSensor struct {
+	metric      string
+	key         string // topic suffix and discovery object ID
+	name        string
+	unit        string
+	deviceClass string
+	stateClass  string
+	latestLabel string // for metrics with one series per period, only the series with the latest value of this label is published
+}
+
+// mqttSensors lists the collected values published to MQTT
+var mqttSensors = []mqttSensor{
+	{metric: "flume_current_flow_rate_gallons_per_minute", key: "flow_rate", name: "Flow rate", unit: "gal/min", deviceClass: "volume_flow_rate", stateClass: "measurement"},
+	{metric: "flume_daily_total_water_usage_gallons", key: "daily_total", name: "Daily total", unit: "gal", deviceClass: "water", stateClass: "total_increasing", latestLabel: "date"},
+	{metric: "flume_today_water_usage_gallons", key: "today", name: "Usage today", unit: "gal", deviceClass: "water", stateClass: "total_increasing"},
+}
+
+// MQTTPublisher publishes the collected flow rate and usage values to an MQTT broker after each collection
+// The values come from the registry, so Flume is not queried again. Each publish opens its own connection
+// and sends QoS 0 messages, so no session state is kept between cycles
+type MQTTPublisher struct {
+	address         string
+	useTLS          bool
+	clientID        string
+	username        string
+	password        string
+	topicPrefix     string
+	format          string
+	discovery       bool
+	discoveryPrefix string
+	timeout         time.Duration
+	metrics         *Metrics
+
+	// State topics whose Home Assistant discovery configs have been published
+	announced      map[string]bool
+	announcedMutex sync.Mutex
+}
+
+// NewMQTTPublisher creates a publisher for the configured broker
+// Returns a disabled publisher when no broker is configured
+func NewMQTTPublisher(config *Config, metrics *Metrics) *MQTTPublisher {
+	if config.MQTTBroker == "" {
+		return &MQTTPublisher{}
+	}
+	// The broker was validated when the configuration was loaded
+	address, useTLS, _ := parseMQTTBroker(config.MQTTBroker)
+
+	clientID := "flume-exporter"
+	if hostname, err := os.Hostname(); err == nil {
+		clientID += "-" + hostname
+	}
+	return &MQTTPublisher{
+		address:         address,
+		useTLS:          useTLS,
+		clientID:        clientID,
+		username:        config.MQTTUsername,
+		password:        config.MQTTPassword,
+		topicPrefix:     strings.TrimSuffix(config.MQTTTopicPrefix, "/"),
+		format:          config.MQTTFormat,
+		discovery:       config.MQTTDiscovery,
+		discoveryPrefix: strings.TrimSuffix(config.MQTTDiscoveryPrefix, "/"),
+		timeout:         config.Timeout,
+		metrics:         metrics,
+		announced:       make(map[string]bool),
+	}
+}
+
+// Enabled reports whether an MQTT broker has been configured
+func (p *MQTTPublisher) Enabled() bool {
+	return p != nil && p.address != ""
+}
+
+// mqttMessage is one message to publish
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// Publish sends the current values to the broker, preceded by the Home Assistant discovery configs of
+// sensors not announced yet when discovery is enabled
+func (p *MQTTPublisher) Publish() error {
+	if !p.Enabled() {
+		return nil
+	}
+
+	families, err := flumeMetricsGatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics for MQTT: %w", err)
+	}
+	values, deviceNames := mqttValues(families)
+	if len(values) == 0 {
+		return nil
+	}
+
+	var messages []mqttMessage
+	var newTopics []string
+	p.announcedMutex.Lock()
+	for _, value := range values {
+		topic := p.stateTopic(value.deviceID, value.sensor.key)
+		if p.discovery && !p.announced[topic] {
+			newTopics = append(newTopics, topic)
+			messages = append(messages, p.discoveryMessage(value, deviceNames[value.deviceID]))
+		}
+		messages = append(messages, mqttMessage{topic: topic, payload: p.statePayload(value), retain: true})
+	}
+	p.announcedMutex.Unlock()
+
+	if err := p.send(messages); err != nil {
+		if p.metrics != nil {
+			p.metrics.RecordMQTTPublishFailure()
+		}
+		return err
+	}
+
+	p.announcedMutex.Lock()
+	for _, topic := range newTopics {
+		p.announced[topic] = true
+	}
+	p.announcedMutex.Unlock()
+	log.Printf("Published %d messages to MQTT broker %s", len(messages), p.address)
+	return nil
+}
+
+// mqttValue is the current value of one sensor of one device
+type mqttValue struct {
+	deviceID string
+	sensor   mqttSensor
+	value    float64
+	period   string // value of the sensor's latestLabel, if any
+}
+
+// mqttValues extracts the published sensor values and the device names from the gathered metrics
+func mqttValues(families []*dto.MetricFamily) ([]mqttValue, map[string]string) {
+	var values []mqttValue
+	deviceNames := make(map[string]string)
+	for _, sensor := range mqttSensors {
+		latest := make(map[string]mqttValue)
+		var order []string
+		for _, family := range families {
+			if family.GetName() != sensor.metric {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				labels := make(map[string]string)
+				for _, label := range metric.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				deviceID := labels["device_id"]
+				if deviceID == "" {
+					continue
+				}
+				deviceNames[deviceID] = labels["device_name"]
+
+				value := mqttValue{deviceID: deviceID, sensor: sensor, value: metric.GetGauge().GetValue(), period: labels[sensor.latestLabel]}
+				current, seen := latest[deviceID]
+				if !seen {
+					order = append(order, deviceID)
+				}
+				if !seen || value.period > current.period {
+					latest[deviceID] = value
+				}
+			}
+		}
+		for _, deviceID := range order {
+			values = append(values, latest[deviceID])
+		}
+	}
+	return values, deviceNames
+}
+
+// stateTopic returns the topic a device's sensor value is published to, e.g. flume/<device_id>/flow_rate
+func (p *MQTTPublisher) stateTopic(deviceID, key string) string {
+	return p.topicPrefix + "/" + deviceID + "/" + key
+}
+
+// statePayload formats a sensor value in the configured payload format
+func (p *MQTTPublisher) statePayload(value mqttValue) []byte {
+	formatted := strconv.FormatFloat(value.value, 'f', -1, 64)
+	if p.format == MQTTFormatPlain {
+		return []byte(formatted)
+	}
+	payload := map[string]interface{}{"value": json.Number(formatted)}
+	if value.period != "" {
+		payload[value.sensor.latestLabel] = value.period
+	}
+	data, _ := json.Marshal(payload)
+	return data
+}
+
+// discoveryMessage builds the retained Home Assistant MQTT discovery config for a device's sensor
+func (p *MQTTPublisher) discoveryMessage(value mqttValue, deviceName string) mqttMessage {
+	if deviceName == "" {
+		deviceName = value.deviceID
+	}
+	objectID := "flume_" + value.deviceID + "_" + value.sensor.key
+	config := map[string]interface{}{
+		"name":                value.sensor.name,
+		"unique_id":           objectID,
+		"state_topic":         p.stateTopic(value.deviceID, value.sensor.key),
+		"unit_of_measurement": value.sensor.unit,
+		"device_class":        value.sensor.deviceClass,
+		"state_class":         value.sensor.stateClass,
+		"device": map[string]interface{}{
+			"identifiers":  []string{"flume_" + value.deviceID},
+			"name":         "Flume " + deviceName,
+			"manufacturer": "Flume",
+		},
+	}
+	if p.format != MQTTFormatPlain {
+		config["value_template"] = "{{ value_json.value }}"
+	}
+	data, _ := json.Marshal(config)
+	return mqttMessage{topic: p.discoveryPrefix + "/sensor/" + objectID + "/config", payload: data, retain: true}
+}
+
+// send connects to the broker, publishes the messages with QoS 0 and disconnects
+func (p *MQTTPublisher) send(messages []mqttMessage) error {
+	dialer := &net.Dialer{Timeout: p.timeout}
+	var conn net.Conn
+	var err error
+	if p.useTLS {
+		host, _, _ := net.SplitHostPort(p.address)
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", p.address)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to MQTT broker %s: %w", p.address, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(p.timeout))
+
+	if _, err := conn.Write(mqttConnectPacket(p.clientID, p.username, p.password)); err != nil {
+		return fmt.Errorf("failed to send MQTT connect to %s: %w", p.address, err)
+	}
+	connack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, connack); err != nil {
+		return fmt.Errorf("failed to read MQTT connack from %s: %w", p.address, err)
+	}
+	if connack[0] != 0x20 || connack[1] != 0x02 {
+		return fmt.Errorf("unexpected MQTT connack from %s: % x", p.address, connack)
+	}
+	if connack[3] != 0 {
+		return fmt.Errorf("MQTT broker %s refused the connection (return code %d)", p.address, connack[3])
+	}
+
+	var packets bytes.Buffer
+	for _, message := range messages {
+		packets.Write(mqttPublishPacket(message))
+	}
+	packets.Write([]byte{0xE0, 0x00}) // DISCONNECT
+	if _, err := conn.Write(packets.Bytes()); err != nil {
+		return fmt.Errorf("failed to publish to MQTT broker %s: %w", p.address, err)
+	}
+	return nil
+}
+
+// mqttConnectPacket builds an MQTT 3.1.1 CONNECT packet with a clean session
+func mqttConnectPacket(clientID, username, password string) []byte {
+	var body bytes.Buffer
+	body.Write(mqttString("MQTT"))
+	body.WriteByte(4) // protocol level 3.1.1
+
+	flags := byte(0x02) // clean session
+	if username != "" {
+		flags |= 0x80
+		if password != "" {
+			flags |= 0x40
+		}
+	}
+	body.WriteByte(flags)
+	body.Write([]byte{0, 60}) // keep alive in seconds
+
+	body.Write(mqttString(clientID))
+	if username != "" {
+		body.Write(mqttString(username))
+		if password != "" {
+			body.Write(mqttString(password))
+		}
+	}
+	return mqttPacket(0x10, body.Bytes())
+}
+
+// mqttPublishPacket builds a QoS 0 PUBLISH packet
+func mqttPublishPacket(message mqttMessage) []byte {
+	header := byte(0x30)
+	if message.retain {
+		header |= 0x01
+	}
+	var body bytes.Buffer
+	body.Write(mqttString(message.topic))
+	body.Write(message.payload)
+	return mqttPacket(header, body.Bytes())
+}
+
+// mqttPacket prefixes a packet body with its fixed header and variable-length remaining length
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// mqttString encodes a string with its two-byte length prefix
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// parseMQTTBroker parses a broker as host:port or a tcp://, mqtt://, ssl://, tls:// or mqtts:// URL
+// The port defaults to 1883, or 8883 with TLS
+func parseMQTTBroker(broker string) (string, bool, error) {
+	address := broker
+	useTLS := false
+	if scheme, rest, ok := strings.Cut(broker, "://"); ok {
+		switch scheme {
+		case "tcp", "mqtt":
+		case "ssl", "tls", "mqtts":
+			useTLS = true
+		default:
+			return "", false, fmt.Errorf("unsupported MQTT broker scheme '%s' (expected tcp, mqtt, ssl, tls or mqtts)", scheme)
+		}
+		address = strings.TrimSuffix(rest, "/")
+	}
+	if address == "" {
+		return "", false, fmt.Errorf("invalid MQTT broker '%s' (expected host:port)", broker)
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := "1883"
+		if useTLS {
+			port = "8883"
+		}
+		address = net.JoinHostPort(address, port)
+	}
+	if host, _, err := net.SplitHostPort(address); err != nil || host == "" {
+		return "", false, fmt.Errorf("invalid MQTT broker '%s' (expected host:port)", broker)
+	}
+	return address, useTLS, nil
+}
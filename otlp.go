@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	prombridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// OTLPExporter periodically exports the flume_* metrics to an OpenTelemetry collector over OTLP/HTTP
+// It reads the same registry that /metrics serves, so Prometheus stays the source of truth: gauges map to
+// OTel gauges, counters to monotonic sums and histograms to histograms, with labels as attributes
+type OTLPExporter struct {
+	provider *sdkmetric.MeterProvider
+}
+
+// NewOTLPExporter creates an exporter for the configured OTLP endpoint
+// Returns nil when no endpoint is configured
+func NewOTLPExporter(config *Config, metrics *Metrics) (*OTLPExporter, error) {
+	if config.OTLPEndpoint == "" {
+		return nil, nil
+	}
+
+	// Failed exports are retried with exponential backoff before they count as failures
+	exporter, err := otlpmetrichttp.New(context.Background(),
+		otlpmetrichttp.WithEndpointURL(config.OTLPEndpoint),
+		otlpmetrichttp.WithTimeout(config.Timeout),
+		otlpmetrichttp.WithRetry(otlpmetrichttp.RetryConfig{
+			Enabled:         true,
+			InitialInterval: 5 * time.Second,
+			MaxInterval:     30 * time.Second,
+			MaxElapsedTime:  config.OTLPInterval / 2,
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter for %s: %w", config.OTLPEndpoint, err)
+	}
+
+	reader := sdkmetric.NewPeriodicReader(
+		&countingOTLPExporter{Exporter: exporter, metrics: metrics},
+		sdkmetric.WithInterval(config.OTLPInterval),
+		sdkmetric.WithTimeout(config.OTLPInterval),
+		sdkmetric.WithProducer(prombridge.NewMetricProducer(prombridge.WithGatherer(flumeMetricsGatherer))),
+	)
+
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "flume-water-prometheus-exporter"),
+		)),
+	)
+
+	// Export failures reach the SDK's global error handler; log them once, with context
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Printf("Error exporting metrics via OTLP: %v", err)
+	}))
+
+	log.Printf("Exporting metrics via OTLP to %s every %s", config.OTLPEndpoint, config.OTLPInterval)
+	return &OTLPExporter{provider: provider}, nil
+}
+
+// Shutdown sends a final export and stops the periodic exports
+func (o *OTLPExporter) Shutdown(ctx context.Context) error {
+	if o == nil {
+		return nil
+	}
+	return o.provider.Shutdown(ctx)
+}
+
+// countingOTLPExporter counts exports that still failed after retries
+type countingOTLPExporter struct {
+	sdkmetric.Exporter
+	metrics *Metrics
+}
+
+// Export forwards to the OTLP exporter, counting failures
+func (c *countingOTLPExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	err := c.Exporter.Export(ctx, rm)
+	if err != nil {
+		c.metrics.RecordOTLPExportFailure()
+	}
+	return err
+}
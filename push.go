@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// MetricsPusher pushes the registered metrics to a Prometheus Pushgateway
+// Used when the exporter sits behind NAT or a firewall and cannot be scraped
+type MetricsPusher struct {
+	url     string
+	pusher  *push.Pusher
+	metrics *Metrics
+	enabled bool
+}
+
+// Push retry behaviour: attempts per collection cycle and the initial backoff, doubled after each failure
+const (
+	pushMaxAttempts    = 3
+	pushInitialBackoff = 2 * time.Second
+)
+
+// NewMetricsPusher creates a pusher for the configured Pushgateway URL
+// Returns a disabled pusher when no URL is configured
+func NewMetricsPusher(config *Config, metrics *Metrics) *MetricsPusher {
+	if config.PushgatewayURL == "" {
+		return &MetricsPusher{}
+	}
+
+	instance := config.PushgatewayInstance
+	if instance == "" {
+		if hostname, err := os.Hostname(); err == nil {
+			instance = hostname
+		}
+	}
+
+	pusher := push.New(config.PushgatewayURL, config.PushgatewayJob).
+		Gatherer(prometheus.DefaultGatherer).
+		Client(&http.Client{Timeout: config.Timeout})
+
+	if instance != "" {
+		pusher = pusher.Grouping("instance", instance)
+	}
+
+	if config.PushgatewayUsername != "" {
+		pusher = pusher.BasicAuth(config.PushgatewayUsername, config.PushgatewayPassword)
+	}
+
+	return &MetricsPusher{
+		url:     config.PushgatewayURL,
+		pusher:  pusher,
+		metrics: metrics,
+		enabled: true,
+	}
+}
+
+// Enabled reports whether a Pushgateway URL has been configured
+func (p *MetricsPusher) Enabled() bool {
+	return p != nil && p.enabled
+}
+
+// Push sends all registered metrics to the Pushgateway, replacing the previous push
+// Failed pushes are retried with exponential backoff and counted in the push failure metric
+func (p *MetricsPusher) Push() error {
+	if !p.Enabled() {
+		return nil
+	}
+
+	var lastErr error
+	backoff := pushInitialBackoff
+	for attempt := 1; attempt <= pushMaxAttempts; attempt++ {
+		lastErr = p.pusher.Push()
+		if lastErr == nil {
+			log.Printf("Pushed metrics to Pushgateway at %s", p.url)
+			return nil
+		}
+
+		if p.metrics != nil {
+			p.metrics.RecordPushFailure()
+		}
+		log.Printf("Push attempt %d/%d to %s failed: %v", attempt, pushMaxAttempts, p.url, lastErr)
+
+		if attempt < pushMaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	return fmt.Errorf("failed to push metrics to %s after %d attempts: %w", p.url, pushMaxAttempts, lastErr)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// QuotaEstimate is the worst-case number of API requests the exporter makes in any one hour
+type QuotaEstimate struct {
+	DeviceCount    int
+	ScrapeInterval time.Duration
+	UsageInterval  time.Duration
+
+	// Requests per hour by source
+	FlowRequests   float64 // device list + flow rate, every scrape
+	HourlyRequests float64 // hourly usage, every usage cycle, for devices that enable it
+	TodayRequests  float64 // today's usage, every usage cycle, for devices that enable it
+	DailyRequests  float64 // daily totals, collected twice a day; worst case is one round in the hour
+	YearlyRequests float64 // yearly usage, collected once a day
+
+	Demand         float64 // all requests the schedule asks for
+	LimiterCeiling float64 // most requests API_MIN_INTERVAL lets through (+Inf if disabled)
+	Effective      float64 // requests actually sent: the smaller of the two
+	Quota          int
+}
+
+// EstimateQuota computes the worst-case hourly request count for deviceCount devices with this configuration
+// Flow requests reuse the per-scrape estimate behind the optimal scrape interval; the device list is assumed
+// to be fetched every scrape even though it is usually cached
+func (c *Config) EstimateQuota(deviceCount int) QuotaEstimate {
+	scrapeInterval := c.GetScrapeInterval(deviceCount)
+	q := QuotaEstimate{
+		DeviceCount:    deviceCount,
+		ScrapeInterval: scrapeInterval,
+		UsageInterval:  scrapeInterval,
+		FlowRequests:   c.EstimatedRequestsPerHour(deviceCount, scrapeInterval),
+		Quota:          c.APIHourlyQuota,
+	}
+	if c.UsageInterval > 0 {
+		q.UsageInterval = c.UsageInterval
+	}
+	if q.Quota <= 0 {
+		q.Quota = flumeRequestsPerHourLimit
+	}
+
+	// Hourly and today's usage are opt-in per device; daily and yearly usage are assumed for every device
+	hourlyDevices, todayDevices := 0, 0
+	for _, families := range c.DeviceMetricFamilies {
+		if families[MetricFamilyHourly] {
+			hourlyDevices++
+		}
+		if families[MetricFamilyToday] {
+			todayDevices++
+		}
+	}
+	hourlyDevices = min(hourlyDevices, deviceCount)
+	todayDevices = min(todayDevices, deviceCount)
+
+	usageCyclesPerHour := float64(time.Hour) / float64(q.UsageInterval)
+	q.HourlyRequests = usageCyclesPerHour * float64(hourlyDevices)
+	q.TodayRequests = usageCyclesPerHour * float64(todayDevices)
+	q.DailyRequests = float64(deviceCount)
+	q.YearlyRequests = float64(deviceCount)
+	q.Demand = q.FlowRequests + q.HourlyRequests + q.TodayRequests + q.DailyRequests + q.YearlyRequests
+
+	q.LimiterCeiling = math.Inf(1)
+	if c.APIMinInterval > 0 {
+		q.LimiterCeiling = float64(time.Hour) / float64(c.APIMinInterval)
+	}
+	q.Effective = math.Min(q.Demand, q.LimiterCeiling)
+
+	return q
+}
+
+// ExceedsQuota reports whether the requests actually sent in the worst hour exceed the hourly quota
+func (q QuotaEstimate) ExceedsQuota() bool {
+	return q.Effective > float64(q.Quota)
+}
+
+// WriteReport explains the estimate, naming the settings to change when the quota is exceeded
+func (q QuotaEstimate) WriteReport(w io.Writer) {
+	row := func(label string, value float64) {
+		fmt.Fprintf(w, "  %-38s %6.1f\n", label+":", value)
+	}
+	fmt.Fprintf(w, "Worst-case Flume API requests per hour for %d device(s):\n", q.DeviceCount)
+	row(fmt.Sprintf("Flow rate (scrape interval %s)", q.ScrapeInterval), q.FlowRequests)
+	row(fmt.Sprintf("Hourly usage (usage interval %s)", q.UsageInterval), q.HourlyRequests)
+	row(fmt.Sprintf("Today's usage (usage interval %s)", q.UsageInterval), q.TodayRequests)
+	row("Daily totals", q.DailyRequests)
+	row("Yearly usage", q.YearlyRequests)
+	row("Total demand", q.Demand)
+	if !math.IsInf(q.LimiterCeiling, 1) {
+		row("API_MIN_INTERVAL ceiling", q.LimiterCeiling)
+	}
+	fmt.Fprintf(w, "  %-38s %6.1f of %d allowed (API_HOURLY_QUOTA)\n", "Requests sent:", q.Effective, q.Quota)
+
+	if q.Demand > q.LimiterCeiling {
+		fmt.Fprintln(w, "Warning: the schedule asks for more requests than API_MIN_INTERVAL allows, so collection cycles will fall behind")
+	}
+
+	if !q.ExceedsQuota() {
+		fmt.Fprintln(w, "OK: the configuration stays within the hourly quota")
+		return
+	}
+
+	var fixes []string
+	fixes = append(fixes, "raise SCRAPE_INTERVAL")
+	if q.HourlyRequests > 0 || q.TodayRequests > 0 {
+		fixes = append(fixes, "set or raise USAGE_INTERVAL, or drop hourly and today from DEVICE_METRICS")
+	}
+	fixes = append(fixes, fmt.Sprintf("set API_MIN_INTERVAL to at least %s", time.Duration(float64(time.Hour)/float64(q.Quota)).Round(time.Second)))
+	fixes = append(fixes, "filter devices with DEVICE_IDS")
+	fmt.Fprintf(w, "FAIL: %.1f requests per hour exceed the quota of %d by %.1f; %s\n",
+		q.Effective, q.Quota, q.Effective-float64(q.Quota), strings.Join(fixes, ", "))
+}
+
+// runQuotaValidation prints the worst-case quota estimate and returns the process exit code:
+// 0 if the configuration fits the hourly quota, 1 if it does not and 2 if the device count is unknown
+// The device count comes from --quota-device-count or the DEVICE_IDS filter, so no API calls are made
+func runQuotaValidation(config *Config) int {
+	deviceCount := config.QuotaDeviceCount
+	if deviceCount <= 0 && config.DeviceIDs != "" {
+		for _, id := range strings.Split(config.DeviceIDs, ",") {
+			if strings.TrimSpace(id) != "" {
+				deviceCount++
+			}
+		}
+	}
+	if deviceCount <= 0 {
+		fmt.Fprintln(os.Stderr, "Cannot validate the quota without a device count: set --quota-device-count/QUOTA_DEVICE_COUNT or DEVICE_IDS")
+		return 2
+	}
+
+	estimate := config.EstimateQuota(deviceCount)
+	if estimate.ExceedsQuota() {
+		estimate.WriteReport(os.Stderr)
+		return 1
+	}
+	estimate.WriteReport(os.Stdout)
+	return 0
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"time"
+)
+
+// ApplyReload copies the hot-reloadable settings from next into the running configuration and
+// adjusts the collection tickers. Credentials, listen address and other settings need a restart.
+// Hot-reloadable: DEVICE_IDS (or the contents of DEVICE_IDS_FILE), DEVICE_PRIORITIES, DEVICE_METRICS, DEVICE_NAMES, DEVICE_BUDGETS, SCRAPE_INTERVAL,
+// USAGE_INTERVAL and COLLECTION_TIMEOUT
+func (e *FlumeExporter) ApplyReload(next *Config) {
+	// The optimal interval depends on the device count, just like at startup
+	scrapeInterval := next.ScrapeInterval
+	if deviceCount, known := e.DeviceCount(); known {
+		scrapeInterval = next.GetScrapeInterval(deviceCount)
+	}
+
+	// Wait for running cycles so they never see a half-applied configuration
+	e.collectionMutex.Lock()
+	e.usageMutex.Lock()
+
+	changed := 0
+	logChange := func(name string, from, to interface{}) {
+		if !reflect.DeepEqual(from, to) {
+			log.Printf("Reload: %s changed from '%v' to '%v'", name, from, to)
+			changed++
+		}
+	}
+
+	current := e.config.Load()
+	logChange("device IDs", current.DeviceIDs, next.DeviceIDs)
+	logChange("device priorities", current.DevicePriorities, next.DevicePriorities)
+	logChange("device metrics", current.DeviceMetrics, next.DeviceMetrics)
+	logChange("device names", current.DeviceNames, next.DeviceNames)
+	logChange("device budgets", current.DeviceBudgets, next.DeviceBudgets)
+	logChange("scrape interval", current.ScrapeInterval, scrapeInterval)
+	logChange("usage interval", current.UsageInterval, next.UsageInterval)
+	logChange("collection timeout", current.CollectionTimeout, next.CollectionTimeout)
+
+	// Readers outside the cycles, such as /health and /admin/devices, keep the copy they loaded
+	updated := *current
+	updated.DeviceIDs = next.DeviceIDs
+	updated.DevicePriorities = next.DevicePriorities
+	updated.DeviceMetrics = next.DeviceMetrics
+	updated.DeviceMetricFamilies = next.DeviceMetricFamilies
+	updated.DeviceNames = next.DeviceNames
+	updated.DeviceNameOverrides = next.DeviceNameOverrides
+	updated.DeviceBudgets = next.DeviceBudgets
+	updated.DeviceBudgetGallons = next.DeviceBudgetGallons
+	updated.ScrapeInterval = scrapeInterval
+	updated.UsageInterval = next.UsageInterval
+	updated.CollectionTimeout = next.CollectionTimeout
+	e.config.Store(&updated)
+	e.pruneExcludedDevices()
+
+	e.usageMutex.Unlock()
+	e.collectionMutex.Unlock()
+
+	e.resetTickers(scrapeInterval, next.UsageInterval)
+
+	if changed == 0 {
+		log.Println("Reload: no reloadable settings changed")
+	} else {
+		log.Printf("Reload: applied %d changed setting(s)", changed)
+	}
+}
+
+// setScrapeInterval sets the scrape interval of the running configuration, e.g. to the optimal
+// interval once the device count is known
+func (e *FlumeExporter) setScrapeInterval(interval time.Duration) {
+	e.collectionMutex.Lock()
+	defer e.collectionMutex.Unlock()
+
+	updated := *e.config.Load()
+	updated.ScrapeInterval = interval
+	e.config.Store(&updated)
+}
+
+// resetTickers moves the running tickers to new intervals, starting or stopping the separate
+// usage ticker as needed. Before periodic collection has started there is nothing to reset
+func (e *FlumeExporter) resetTickers(scrapeInterval, usageInterval time.Duration) {
+	e.tickerMutex.Lock()
+	defer e.tickerMutex.Unlock()
+
+	if e.flowTicker == nil {
+		return
+	}
+	e.flowTicker.Reset(scrapeInterval)
+
+	switch {
+	case usageInterval > 0 && e.usageTicker != nil:
+		e.usageTicker.Reset(usageInterval)
+	case usageInterval > 0:
+		log.Printf("Collecting usage metrics separately every %s", usageInterval)
+		e.usageTicker = e.startTicker(usageInterval, e.runUsageCollection)
+	case e.usageTicker != nil:
+		// Usage is collected with every flow cycle again; the stopped ticker's goroutine exits on shutdown
+		e.usageTicker.Stop()
+		e.usageTicker = nil
+	}
+}
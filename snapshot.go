@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// snapshotCollector serves the device metrics from an immutable snapshot taken after each collection
+// cycle instead of reading the live GaugeVecs, so a scrape never sees a half-updated cycle
+type snapshotCollector struct {
+	collectors []prometheus.Collector
+	current    atomic.Pointer[[]snapshotMetric]
+}
+
+// snapshotMetric is one series frozen at the time of the snapshot
+type snapshotMetric struct {
+	desc *prometheus.Desc
+	pb   *dto.Metric
+}
+
+// newSnapshotCollector creates a snapshot collector for the given collectors, initially serving no series
+func newSnapshotCollector(collectors []prometheus.Collector) *snapshotCollector {
+	return &snapshotCollector{collectors: collectors}
+}
+
+// Describe forwards the descriptions of the wrapped collectors
+func (s *snapshotCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range s.collectors {
+		c.Describe(ch)
+	}
+}
+
+// Collect sends the series of the latest snapshot
+func (s *snapshotCollector) Collect(ch chan<- prometheus.Metric) {
+	snapshot := s.current.Load()
+	if snapshot == nil {
+		return
+	}
+	for _, m := range *snapshot {
+		ch <- m
+	}
+}
+
+// publish freezes the current values of the wrapped collectors and serves them from now on
+func (s *snapshotCollector) publish() int {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		for _, c := range s.collectors {
+			c.Collect(ch)
+		}
+		close(ch)
+	}()
+
+	var snapshot []snapshotMetric
+	for m := range ch {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			continue
+		}
+		snapshot = append(snapshot, snapshotMetric{desc: m.Desc(), pb: pb})
+	}
+	s.current.Store(&snapshot)
+	return len(snapshot)
+}
+
+// Desc returns the description of the series
+func (m snapshotMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+// Write copies the frozen value into out; the snapshot is never modified, so its parts can be shared
+func (m snapshotMetric) Write(out *dto.Metric) error {
+	out.Label = m.pb.Label
+	out.Gauge = m.pb.Gauge
+	out.Counter = m.pb.Counter
+	out.Untyped = m.pb.Untyped
+	out.Histogram = m.pb.Histogram
+	out.Summary = m.pb.Summary
+	out.TimestampMs = m.pb.TimestampMs
+	return nil
+}
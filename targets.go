@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// TargetGroup is one entry of a Prometheus HTTP service discovery response
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// targetsHandler serves this exporter's scrape target in the Prometheus http_sd_config format, so a central
+// Prometheus can discover and label exporter instances uniformly. The metrics path is passed as __metrics_path__
+func targetsHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		labels := map[string]string{"__metrics_path__": config.MetricsPath}
+		for name, value := range config.SDLabelSet {
+			labels[name] = value
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		jsonData, _ := json.MarshalIndent([]TargetGroup{{
+			Targets: []string{config.SDTarget},
+			Labels:  labels,
+		}}, "", "  ")
+		w.Write(jsonData)
+	}
+}
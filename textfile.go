@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TextfileWriter writes the exporter's metrics to a file for node_exporter's textfile collector
+type TextfileWriter struct {
+	path string
+}
+
+// NewTextfileWriter creates a writer for the configured textfile path
+// Returns a disabled writer when no path is configured
+func NewTextfileWriter(config *Config) *TextfileWriter {
+	return &TextfileWriter{path: config.TextfileOutput}
+}
+
+// Enabled reports whether a textfile path has been configured
+func (t *TextfileWriter) Enabled() bool {
+	return t != nil && t.path != ""
+}
+
+// Write atomically replaces the textfile with the current flume_* metrics
+// Go runtime and process metrics are left out because node_exporter already exports its own
+func (t *TextfileWriter) Write() error {
+	if !t.Enabled() {
+		return nil
+	}
+
+	if err := prometheus.WriteToTextfile(t.path, flumeMetricsGatherer); err != nil {
+		return fmt.Errorf("failed to write metrics textfile %s: %w", t.path, err)
+	}
+	log.Printf("Wrote metrics to textfile %s", t.path)
+	return nil
+}
+
+// flumeMetricsGatherer gathers only the flume_ metric families from the default registry
+var flumeMetricsGatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+
+	filtered := families[:0]
+	for _, family := range families {
+		if strings.HasPrefix(family.GetName(), "flume_") {
+			filtered = append(filtered, family)
+		}
+	}
+	return filtered, err
+})
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errPinMismatch is returned when no certificate in the verified chain matches a configured pin
+var errPinMismatch = errors.New("TLS certificate does not match any pinned public key")
+
+// parseSPKIPins parses comma-separated base64 SHA-256 SPKI hashes, optionally prefixed with "sha256/"
+func parseSPKIPins(value string) ([][]byte, error) {
+	var pins [][]byte
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimPrefix(strings.TrimSpace(entry), "sha256/")
+		if entry == "" {
+			continue
+		}
+
+		pin, err := base64.StdEncoding.DecodeString(entry)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid TLS pin '%s' (expected a base64 SHA-256 hash of the certificate's public key)", entry)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// loadCACertPool returns the system roots plus the PEM certificates in path, which may be a file or
+// a directory whose .pem, .crt and .cer files are all loaded. Every file loaded must contain a certificate
+func loadCACertPool(path string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		log.Printf("Warning: Failed to load system CA certificates, trusting only %s: %v", path, err)
+		pool = x509.NewCertPool()
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificates: %w", err)
+	}
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate directory: %w", err)
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			switch strings.ToLower(filepath.Ext(entry.Name())) {
+			case ".pem", ".crt", ".cer":
+				if !entry.IsDir() {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("CA certificate directory %s contains no .pem, .crt or .cer files", path)
+		}
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificates: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificates could be parsed from %s", file)
+		}
+	}
+	return pool, nil
+}
+
+// pinVerifier returns a VerifyPeerCertificate callback that runs after standard certificate verification
+// and requires a certificate in the verified chain to match one of the pinned SPKI hashes
+func pinVerifier(pins [][]byte, metrics *Metrics) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range pins {
+					if string(hash[:]) == string(pin) {
+						return nil
+					}
+				}
+			}
+		}
+
+		log.Printf("Warning: %v", errPinMismatch)
+		if metrics != nil {
+			metrics.RecordTLSPinFailure()
+		}
+		return errPinMismatch
+	}
+}
+
+// newAPITransport returns a transport applying the configured TLS pins, extra CAs and insecure mode
+// Returns nil when none are configured, so the client keeps the default transport
+func newAPITransport(config *Config, metrics *Metrics) *http.Transport {
+	if len(config.TLSPinBytes) == 0 && config.CACertPool == nil && !config.InsecureSkipVerify {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(config.TLSPinBytes) > 0 {
+		log.Printf("TLS public key pinning enabled with %d pin(s)", len(config.TLSPinBytes))
+		tlsConfig.VerifyPeerCertificate = pinVerifier(config.TLSPinBytes, metrics)
+	}
+	if config.CACertPool != nil {
+		log.Printf("Trusting additional CA certificates from %s", config.CACertFile)
+		tlsConfig.RootCAs = config.CACertPool
+	}
+	if config.InsecureSkipVerify {
+		log.Printf("WARNING: INSECURE: TLS certificate verification for the Flume API is DISABLED (--insecure-skip-verify)")
+		log.Printf("WARNING: INSECURE: credentials and tokens can be intercepted; only use this against a local mock server, NEVER in production")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport
+}
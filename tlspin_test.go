@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseSPKIPins(t *testing.T) {
+	hash := sha256.Sum256([]byte("key"))
+	encoded := base64.StdEncoding.EncodeToString(hash[:])
+
+	pins, err := parseSPKIPins(" sha256/" + encoded + ", ," + encoded)
+	if err != nil {
+		t.Fatalf("parseSPKIPins: %v", err)
+	}
+	if len(pins) != 2 || string(pins[0]) != string(hash[:]) {
+		t.Errorf("pins = %x, want the hash twice", pins)
+	}
+
+	for _, value := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := parseSPKIPins(value); err == nil {
+			t.Errorf("parseSPKIPins(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestTLSPinning(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testDevicesBody))
+	}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	serverPin := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	otherPin := sha256.Sum256([]byte("another key"))
+
+	tests := []struct {
+		name     string
+		pins     [][]byte
+		wantErr  bool
+		failures float64
+	}{
+		{"matching pin", [][]byte{otherPin[:], serverPin[:]}, false, 0},
+		{"mismatched pin", [][]byte{otherPin[:]}, true, 1},
+	}
+	for _, tt := range tests {
+		config := newTestConfig(t)
+		config.BaseURL = server.URL
+		config.CACertPool = roots
+		config.TLSPinBytes = tt.pins
+		metrics := newTestMetrics()
+		client := NewFlumeClient(config, metrics)
+		client.accessToken = "test-token"
+		client.tokenExpiry = time.Now().Add(24 * time.Hour)
+		client.hasAuthenticated = true
+
+		devices, err := client.GetDevices()
+		switch {
+		case tt.wantErr && err == nil:
+			t.Errorf("%s: GetDevices succeeded, want a pin mismatch", tt.name)
+		case tt.wantErr && !errors.Is(err, errPinMismatch):
+			t.Errorf("%s: error = %v, want a pin mismatch", tt.name, err)
+		case !tt.wantErr && (err != nil || len(devices) != 2):
+			t.Errorf("%s: GetDevices = %d devices, %v, want 2 devices", tt.name, len(devices), err)
+		}
+		if got := testutil.ToFloat64(metrics.tlsPinFailures); got != tt.failures {
+			t.Errorf("%s: TLS pin failures = %v, want %v", tt.name, got, tt.failures)
+		}
+	}
+}